@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops querying a FAHClient that could not be reached on
+// several consecutive scrapes, like a machine that is powered off, and only
+// tries again once a cool-down has passed.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mtx         sync.Mutex
+	consecutive int
+	opened      time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(failures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{failures: failures, cooldown: cooldown}
+}
+
+// allow reports whether the client should be queried. Once the cool-down of
+// an open breaker has passed, a single query is allowed to probe the client
+// until its outcome is recorded.
+func (b *circuitBreaker) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.opened.IsZero() {
+		return true
+	}
+	if b.probing || time.Since(b.opened) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records whether an allowed query reached the client.
+func (b *circuitBreaker) record(reached bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.probing = false
+	if reached {
+		b.consecutive = 0
+		b.opened = time.Time{}
+		return
+	}
+	b.consecutive++
+	if b.consecutive >= b.failures {
+		b.opened = time.Now()
+	}
+}
+
+// open reports whether the breaker stops queries to the client.
+func (b *circuitBreaker) open() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return !b.opened.IsZero()
+}
+
+// breakerSet holds the circuit breakers of probe targets, which outlive the
+// exporters created per probe request.
+type breakerSet struct {
+	failures int
+	cooldown time.Duration
+
+	mtx      sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerSet(failures int, cooldown time.Duration) *breakerSet {
+	return &breakerSet{
+		failures: failures,
+		cooldown: cooldown,
+		breakers: map[string]*circuitBreaker{},
+	}
+}
+
+// get returns the circuit breaker of target, or nil if circuit breakers are
+// disabled.
+func (s *breakerSet) get(target string) *circuitBreaker {
+	if s.failures <= 0 {
+		return nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	b, ok := s.breakers[target]
+	if !ok {
+		b = newCircuitBreaker(s.failures, s.cooldown)
+		s.breakers[target] = b
+	}
+	return b
+}
+
+// forget discards the circuit breaker of target.
+func (s *breakerSet) forget(target string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.breakers, target)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// commandErrors counts the commands to a FAHClient that failed, by command.
+// The counts are kept apart from the Exporter, as exporters are created per
+// probe request and rebuilt on reloads, which would start them over.
+type commandErrors struct {
+	mtx    sync.Mutex
+	counts map[string]float64
+}
+
+func newCommandErrors() *commandErrors {
+	return &commandErrors{counts: map[string]float64{}}
+}
+
+func (c *commandErrors) inc(command string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.counts[command]++
+}
+
+// collect delivers the counts as counters of desc, labeled by command.
+func (c *commandErrors) collect(desc *prometheus.Desc, ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for command, n := range c.counts {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, n, command)
+	}
+}
+
+// commandErrorSet holds the command error counts of clients by target, which
+// outlive the exporters of the clients.
+type commandErrorSet struct {
+	mtx    sync.Mutex
+	errors map[string]*commandErrors
+}
+
+func newCommandErrorSet() *commandErrorSet {
+	return &commandErrorSet{errors: map[string]*commandErrors{}}
+}
+
+// get returns the command error counts of target.
+func (s *commandErrorSet) get(target string) *commandErrors {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, ok := s.errors[target]
+	if !ok {
+		c = newCommandErrors()
+		s.errors[target] = c
+	}
+	return c
+}
+
+// forget discards the command error counts of target.
+func (s *commandErrorSet) forget(target string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.errors, target)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// Timeouts, retry, circuit breaker and scrape concurrency settings applied to
+// clients that don't configure their own.
+const (
+	defaultDialTimeout          = 5 * time.Second
+	defaultReadTimeout          = 10 * time.Second
+	defaultRetryDelay           = 100 * time.Millisecond
+	defaultRetryJitter          = 0.2
+	defaultBreakerCooldown      = 5 * time.Minute
+	defaultMaxConcurrentScrapes = 1
+)
+
+// Config is the configuration file listing the FAHClients to scrape.
+type Config struct {
+	Clients []ClientConfig `yaml:"clients"`
+}
+
+// ClientConfig describes how to reach a FAHClient.
+type ClientConfig struct {
+	// Name is the value of the client label, defaulting to the address.
+	Name         string `yaml:"name"`
+	Address      string `yaml:"address"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	// Timeout bounds all commands of a scrape together.
+	Timeout time.Duration `yaml:"timeout"`
+	// DialTimeout bounds connecting to the client, ReadTimeout waiting for
+	// the output of a single command.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// Retries is the number of times a scrape is retried after a transient
+	// failure, waiting RetryDelay, doubled for each retry and randomized by
+	// the RetryJitter fraction.
+	Retries     int           `yaml:"retries"`
+	RetryDelay  time.Duration `yaml:"retry_delay"`
+	RetryJitter float64       `yaml:"retry_jitter"`
+	// BreakerFailures enables the circuit breaker, which stops querying the
+	// client after this many consecutive failures to reach it until
+	// BreakerCooldown has passed.
+	BreakerFailures int           `yaml:"breaker_failures"`
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+	// UpdatesInterval enables serving scrapes from the updates pushed by
+	// a v7 client at this interval.
+	UpdatesInterval time.Duration `yaml:"updates_interval"`
+	// LogUpdates enables counting the errors and warnings in the log
+	// pushed by a v7 client.
+	LogUpdates bool `yaml:"log_updates"`
+	// CollectInterval enables polling the client in the background at
+	// this interval.
+	CollectInterval time.Duration `yaml:"collect_interval"`
+	// MinInterval enables serving the metrics of the last scrape to
+	// scrapes arriving less than this interval after it.
+	MinInterval time.Duration `yaml:"min_interval"`
+	// MaxConcurrentScrapes is the number of scrapes that may query the
+	// client at the same time, defaulting to 1.
+	MaxConcurrentScrapes int `yaml:"max_concurrent_scrapes"`
+	// Protocol is the API of the client, v7, v8 or auto (default), or log
+	// to read its state from the log in LogDir.
+	Protocol string            `yaml:"protocol"`
+	LogDir   string            `yaml:"log_dir"`
+	Labels   map[string]string `yaml:"labels"`
+	// LogCounters enables counting the work units returned, points
+	// credited and bytes transferred from the log in LogDir, backfilled
+	// from the logs of the last LogBackfill. Only the client given on the
+	// command line can have them.
+	LogCounters bool          `yaml:"-"`
+	LogBackfill time.Duration `yaml:"-"`
+	// SlotInclude and SlotExclude select the slots exported by their ID or
+	// description. Slots that aren't included or are excluded are left out
+	// of the metrics and the status.
+	SlotInclude Regexp `yaml:"slot_include"`
+	SlotExclude Regexp `yaml:"slot_exclude"`
+	// SSH is the SSH server to reach the client through, if any.
+	SSH *SSHConfig `yaml:"ssh"`
+	// ProxyURL is the SOCKS5 or HTTP proxy to reach the client through, if
+	// any.
+	ProxyURL ProxyURL `yaml:"proxy_url"`
+}
+
+// Regexp is a regular expression that has to match a whole string, like the
+// regular expressions of Prometheus. The zero Regexp is unset.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// NewRegexp compiles a Regexp.
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	return Regexp{re}, err
+}
+
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	r, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+	*re = r
+	return nil
+}
+
+// source returns the regular expression as written, or the empty string if
+// unset.
+func (re Regexp) source() string {
+	if re.Regexp == nil {
+		return ""
+	}
+	return re.String()
+}
+
+// LoadConfig reads and validates the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Clients) == 0 {
+		return fmt.Errorf("no clients configured")
+	}
+
+	names := map[string]bool{}
+	for i := range c.Clients {
+		client := &c.Clients[i]
+		if client.Address == "" && client.Protocol == protocolLog {
+			// The log directory identifies a client that isn't reached.
+			client.Address = client.LogDir
+		}
+		if client.Address == "" {
+			return fmt.Errorf("client %d has no address", i)
+		}
+		if client.Protocol != protocolLog {
+			if err := validateAddress(client.Address); err != nil {
+				return fmt.Errorf("client %d: %w", i, err)
+			}
+		}
+		if client.Name == "" {
+			client.Name = client.Address
+		}
+		if names[client.Name] {
+			return fmt.Errorf("duplicate client name %q", client.Name)
+		}
+		names[client.Name] = true
+
+		if client.PasswordFile != "" {
+			if client.Password != "" {
+				return fmt.Errorf("client %q: at most one of password and password_file must be set", client.Name)
+			}
+			password, err := readPasswordFile(client.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("client %q: %w", client.Name, err)
+			}
+			client.Password = password
+		}
+
+		if client.DialTimeout == 0 {
+			client.DialTimeout = defaultDialTimeout
+		}
+		if client.ReadTimeout == 0 {
+			client.ReadTimeout = defaultReadTimeout
+		}
+		if client.Retries < 0 {
+			return fmt.Errorf("client %q: negative retries", client.Name)
+		}
+		if client.RetryDelay == 0 {
+			client.RetryDelay = defaultRetryDelay
+		}
+		if client.RetryJitter == 0 {
+			client.RetryJitter = defaultRetryJitter
+		}
+		if client.RetryJitter < 0 || client.RetryJitter > 1 {
+			return fmt.Errorf("client %q: retry_jitter must be between 0 and 1", client.Name)
+		}
+		if client.BreakerFailures < 0 {
+			return fmt.Errorf("client %q: negative breaker_failures", client.Name)
+		}
+		if client.BreakerCooldown == 0 {
+			client.BreakerCooldown = defaultBreakerCooldown
+		}
+		if client.UpdatesInterval < 0 {
+			return fmt.Errorf("client %q: negative updates_interval", client.Name)
+		}
+		if client.CollectInterval < 0 {
+			return fmt.Errorf("client %q: negative collect_interval", client.Name)
+		}
+		if client.MinInterval < 0 {
+			return fmt.Errorf("client %q: negative min_interval", client.Name)
+		}
+		if client.MaxConcurrentScrapes == 0 {
+			client.MaxConcurrentScrapes = defaultMaxConcurrentScrapes
+		}
+		if client.MaxConcurrentScrapes < 0 {
+			return fmt.Errorf("client %q: negative max_concurrent_scrapes", client.Name)
+		}
+
+		if client.SSH != nil {
+			if client.ProxyURL.URL != nil {
+				return fmt.Errorf("client %q: at most one of ssh and proxy_url must be set", client.Name)
+			}
+			if err := client.SSH.validate(); err != nil {
+				return fmt.Errorf("client %q: %w", client.Name, err)
+			}
+		}
+
+		switch client.Protocol {
+		case "":
+			client.Protocol = protocolAuto
+		case protocolAuto, protocolV7, protocolV8:
+		case protocolLog:
+			if client.LogDir == "" {
+				return fmt.Errorf("client %q: protocol log requires log_dir", client.Name)
+			}
+		default:
+			return fmt.Errorf("client %q: unknown protocol %q", client.Name, client.Protocol)
+		}
+
+		for name := range client.Labels {
+			if !model.LabelName(name).IsValid() {
+				return fmt.Errorf("client %q: invalid label name %q", client.Name, name)
+			}
+			if name == "client" {
+				return fmt.Errorf("client %q: label name %q is reserved", client.Name, name)
+			}
+		}
+	}
+
+	fillLabels(c.Clients)
+	return nil
+}
+
+// fillLabels sets the labels some clients have and others don't to the empty
+// string for the others, as all series of a metric family need the same
+// label names.
+func fillLabels(clients []ClientConfig) {
+	labelNames := map[string]bool{}
+	for _, client := range clients {
+		for name := range client.Labels {
+			labelNames[name] = true
+		}
+	}
+	for i := range clients {
+		client := &clients[i]
+		labels := make(map[string]string, len(labelNames))
+		for name := range labelNames {
+			labels[name] = client.Labels[name]
+		}
+		client.Labels = labels
+	}
+}
+
+// readPasswordFile returns the password stored in a file, ignoring trailing
+// newlines.
+func readPasswordFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// labels returns the labels attached to all metrics of the client.
+func (c ClientConfig) labels() prometheus.Labels {
+	labels := prometheus.Labels{"client": c.Name}
+	for name, value := range c.Labels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// validateAddress checks that address is a host and port, with IPv6 literals
+// in brackets, so that mistakes are reported when the configuration is
+// loaded rather than when the client is scraped.
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// An IPv6 literal without brackets, with or without a port.
+		if i := strings.LastIndex(address, ":"); i > 0 && net.ParseIP(address[:i]) != nil {
+			return fmt.Errorf("invalid address %q: IPv6 addresses must be in brackets, like %s", address, net.JoinHostPort(address[:i], address[i+1:]))
+		}
+		if strings.Contains(address, ":") && net.ParseIP(strings.Trim(address, "[]")) != nil {
+			return fmt.Errorf("invalid address %q: missing port, like %s", address, net.JoinHostPort(strings.Trim(address, "[]"), "36330"))
+		}
+		return fmt.Errorf("invalid address %q: must be host:port, like localhost:36330 or [fd00::5]:36330", address)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid address %q: missing host", address)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid address %q: invalid port %q", address, port)
+	}
+	return nil
+}
+
+// isLocal reports whether the client runs on the exporter's host, which is
+// required by the collectors reading local hardware telemetry. The address of
+// a tunneled client is resolved on the far end, so even localhost is another
+// host.
+func (c ClientConfig) isLocal() bool {
+	if c.tunneled() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// tunneled reports whether the client is reached through an SSH tunnel or a
+// proxy.
+func (c ClientConfig) tunneled() bool {
+	return c.SSH != nil || c.ProxyURL.URL != nil
+}
+
+// sameClient reports whether a and b describe the same client the same way,
+// so that an exporter created for one serves the other.
+func sameClient(a, b ClientConfig) bool {
+	if a.SlotInclude.source() != b.SlotInclude.source() || a.SlotExclude.source() != b.SlotExclude.source() {
+		return false
+	}
+	a.SlotInclude, a.SlotExclude = Regexp{}, Regexp{}
+	b.SlotInclude, b.SlotExclude = Regexp{}, Regexp{}
+	return reflect.DeepEqual(a, b)
+}
+
+// clientKey identifies the client across the exporters created for it: in
+// the frame history, the state file and the counts kept across reloads. It is
+// the address of clients reached directly, and otherwise also names the
+// SSH server or proxy, as the same address behind different ones, like
+// localhost:36330, is a different client.
+func (c ClientConfig) clientKey() string {
+	switch {
+	case c.SSH != nil:
+		return "ssh://" + c.SSH.User + "@" + c.SSH.Address + "/" + c.Address
+	case c.ProxyURL.URL != nil:
+		return c.ProxyURL.Scheme + "://" + c.ProxyURL.Host + "/" + c.Address
+	}
+	return c.Address
+}
+
+// includeSlot reports whether the slot is exported according to SlotInclude
+// and SlotExclude.
+func (c ClientConfig) includeSlot(slot fahclient.SlotInfo) bool {
+	matches := func(re Regexp) bool {
+		return re.MatchString(slot.ID) || re.MatchString(slot.Description)
+	}
+	if c.SlotInclude.Regexp != nil && !matches(c.SlotInclude) {
+		return false
+	}
+	return c.SlotExclude.Regexp == nil || !matches(c.SlotExclude)
+}
+
+// filtersSlots reports whether any slots may be left out of the metrics.
+func (c ClientConfig) filtersSlots() bool {
+	return c.SlotInclude.Regexp != nil || c.SlotExclude.Regexp != nil
+}
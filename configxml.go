@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+)
+
+// fahConfig is the part of the config.xml of a v7 client that the client
+// reports at runtime too. Options are set in the v attribute of an element of
+// their name, like <user v='Anonymous'/>.
+type fahConfig struct {
+	User  xmlValue `xml:"user"`
+	Team  xmlValue `xml:"team"`
+	Power xmlValue `xml:"power"`
+	Slots []struct {
+		ID   string   `xml:"id,attr"`
+		Type string   `xml:"type,attr"`
+		CPUs xmlValue `xml:"cpus"`
+	} `xml:"slot"`
+}
+
+type xmlValue struct {
+	V string `xml:"v,attr"`
+}
+
+// configXMLCollector exports the slots and donor configured in the config.xml
+// of a client, which may differ from those it runs with until it is
+// restarted, or after they were changed from FAHControl.
+type configXMLCollector struct {
+	path string
+
+	info     *prometheus.Desc
+	slotInfo *prometheus.Desc
+	slotCPUs *prometheus.Desc
+}
+
+func newConfigXMLCollector(path string) *configXMLCollector {
+	return &configXMLCollector{
+		path: path,
+		info: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "config", "info"),
+			"The donor and power setting configured in config.xml, empty if not set, with a constant value of 1.",
+			[]string{"user", "team", "power"},
+			nil,
+		),
+		slotInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "config", "slot_info"),
+			"A slot configured in config.xml, with its type, cpu or gpu, with a constant value of 1.",
+			[]string{"id", "type"},
+			nil,
+		),
+		slotCPUs: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "config", "slot_cpus"),
+			"Number of CPU threads configured in config.xml for the slot.",
+			[]string{"id"},
+			nil,
+		),
+	}
+}
+
+func (c *configXMLCollector) Name() string { return "config-xml" }
+
+func (c *configXMLCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.slotInfo
+	ch <- c.slotCPUs
+}
+
+func (c *configXMLCollector) Update(ctx context.Context, client collector.Client, ch chan<- prometheus.Metric) error {
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var config fahConfig
+	if err := xml.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("parsing %s: %w", c.path, err)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, config.User.V, config.Team.V, strings.ToLower(config.Power.V))
+	for _, slot := range config.Slots {
+		id := slot.ID
+		// The client reports the IDs of slots with two digits.
+		if n, err := strconv.Atoi(id); err == nil {
+			id = fmt.Sprintf("%02d", n)
+		}
+		ch <- prometheus.MustNewConstMetric(c.slotInfo, prometheus.GaugeValue, 1, id, strings.ToLower(slot.Type))
+		if cpus, err := strconv.Atoi(slot.CPUs.V); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.slotCPUs, prometheus.GaugeValue, float64(cpus), id)
+		}
+	}
+	return nil
+}
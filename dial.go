@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// contextDialer connects to an address, like net.Dialer.DialContext.
+type contextDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dialer returns how to connect to the client: through its SSH tunnel or
+// proxy, if any, or directly. Connecting must not take longer than timeout.
+func (c ClientConfig) dialer(timeout time.Duration) contextDialer {
+	if c.SSH != nil {
+		tunnel := sshTunnels.get(*c.SSH)
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return tunnel.dial(ctx, network, address, timeout)
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if c.ProxyURL.URL != nil {
+		return c.ProxyURL.dialer(dialer)
+	}
+	return dialer.DialContext
+}
+
+// dialFAHClient connects to the command port of a v7 client.
+func dialFAHClient(ctx context.Context, client ClientConfig) (*fahclient.Client, error) {
+	conn, err := client.dialer(client.DialTimeout)(ctx, "tcp", client.Address)
+	if err != nil {
+		return nil, err
+	}
+	return fahclient.NewClient(ctx, conn, client.ReadTimeout)
+}
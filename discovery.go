@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// A discoverer lists FAHClients to scrape in addition to those of the
+// configuration file. They are otherwise configured like defaults and named
+// by their address.
+type discoverer interface {
+	clients(defaults ClientConfig) ([]ClientConfig, error)
+}
+
+// targetFile is a discoverer reading the clients from a target file.
+type targetFile string
+
+func (f targetFile) clients(defaults ClientConfig) ([]ClientConfig, error) {
+	return loadTargetFile(string(f), defaults)
+}
+
+// discoveredTarget is the address of a client found by a discoverer, and the
+// labels added to its metrics.
+type discoveredTarget struct {
+	address string
+	labels  map[string]string
+}
+
+// resolvedTargets are the clients found by a discoverer that looks for them
+// periodically.
+type resolvedTargets struct {
+	mtx     sync.Mutex
+	targets []discoveredTarget
+}
+
+func (t *resolvedTargets) clients(defaults ClientConfig) ([]ClientConfig, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	clients := make([]ClientConfig, 0, len(t.targets))
+	for _, target := range t.targets {
+		client := defaults
+		client.Name = target.address
+		client.Address = target.address
+		client.Labels = target.labels
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// set replaces the targets, reporting whether they changed. Of targets with
+// the same address, the first is kept.
+func (t *resolvedTargets) set(targets []discoveredTarget) bool {
+	seen := map[string]bool{}
+	unique := []discoveredTarget{}
+	for _, target := range targets {
+		if !seen[target.address] {
+			seen[target.address] = true
+			unique = append(unique, target)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		return unique[i].address < unique[j].address
+	})
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if reflect.DeepEqual(unique, t.targets) {
+		return false
+	}
+	t.targets = unique
+	return true
+}
+
+// runDiscovery calls refresh at interval, and reload whenever refresh reports
+// that the clients found changed.
+func runDiscovery(interval time.Duration, refresh func() bool, reload func() error, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !refresh() {
+			continue
+		}
+		level.Info(logger).Log("msg", "Discovered clients changed, reloading clients")
+		if err := reload(); err != nil {
+			level.Error(logger).Log("msg", "Error reloading config", "err", err)
+		}
+	}
+}
+
+// targetGroup is a group of FAHClients listed in a target file in the format
+// of the file-based service discovery of Prometheus, in JSON or YAML:
+//
+//	[{"targets": ["192.168.1.20:36330"], "labels": {"location": "basement"}}]
+//
+// Labels starting with __ are dropped, like Prometheus drops them after
+// relabeling.
+type targetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// loadTargetFile returns the clients listed in a target file, which are
+// otherwise configured like defaults and named by their address.
+func loadTargetFile(path string, defaults ClientConfig) ([]ClientConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML.
+	var groups []targetGroup
+	if err := yaml.UnmarshalStrict(b, &groups); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	var clients []ClientConfig
+	for _, group := range groups {
+		labels := map[string]string{}
+		for name, value := range group.Labels {
+			if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				continue
+			}
+			if !model.LabelName(name).IsValid() || name == "client" {
+				return nil, fmt.Errorf("invalid target file %s: invalid label name %q", path, name)
+			}
+			labels[name] = value
+		}
+		for _, target := range group.Targets {
+			if target == "" {
+				return nil, fmt.Errorf("invalid target file %s: empty target", path)
+			}
+			if err := validateAddress(target); err != nil {
+				return nil, fmt.Errorf("invalid target file %s: %w", path, err)
+			}
+			client := defaults
+			client.Name = target
+			client.Address = target
+			client.Labels = labels
+			clients = append(clients, client)
+		}
+	}
+	return clients, nil
+}
+
+// targetFileWatcher tells when the content of target files changed, so that
+// the clients can be reloaded, adding and removing clients without restarting
+// the exporter.
+type targetFileWatcher struct {
+	paths    []string
+	contents map[string][]byte
+}
+
+func newTargetFileWatcher(paths []string) *targetFileWatcher {
+	w := &targetFileWatcher{
+		paths:    paths,
+		contents: map[string][]byte{},
+	}
+	w.changed()
+	return w
+}
+
+// changed reads the target files and reports whether any of them changed
+// since the last call. Files that can't be read are left for the reload to
+// report.
+func (w *targetFileWatcher) changed() bool {
+	changed := false
+	for _, path := range w.paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			b = nil
+		}
+		if !bytes.Equal(b, w.contents[path]) {
+			changed = true
+		}
+		w.contents[path] = b
+	}
+	return changed
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// srvDiscovery is a discoverer resolving the clients from DNS SRV records,
+// like _fahclient._tcp.example.lan, each of which gives the host and port of
+// a client. The records are resolved again periodically, and the clients
+// reloaded when they changed.
+type srvDiscovery struct {
+	resolvedTargets
+	names   []string
+	timeout time.Duration
+	logger  log.Logger
+}
+
+func newSRVDiscovery(names []string, timeout time.Duration, logger log.Logger) *srvDiscovery {
+	return &srvDiscovery{
+		names:   names,
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// refresh resolves the records and reports whether the targets changed. The
+// targets are kept if any of the names fails to resolve, but not if it has
+// no records.
+func (d *srvDiscovery) refresh() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	var targets []discoveredTarget
+	for _, name := range d.names {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue
+		}
+		if err != nil {
+			level.Error(d.logger).Log("msg", "Failed to resolve SRV records", "name", name, "err", err)
+			return false
+		}
+		for _, srv := range records {
+			address := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			targets = append(targets, discoveredTarget{address: address})
+		}
+	}
+	return d.set(targets)
+}
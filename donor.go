@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// donorLabelNames are the labels of foldingathome_options_info that
+// donorLabelsGatherer adds to the metrics of a client.
+var donorLabelNames = map[string]bool{"user": true, "team": true}
+
+// donorLabelsGatherer adds the donor a client folds for, the user and team
+// labels of its foldingathome_options_info, to all metrics of the client, so
+// that dashboards of multi-user households and teams can be sliced by donor
+// without joining. The metrics of different clients are told apart by their
+// client label. Labels a metric already has are left alone.
+type donorLabelsGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g donorLabelsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+
+	donors := map[string][]*dto.LabelPair{}
+	for _, mf := range mfs {
+		if mf.GetName() != namespace+"_options_info" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			var donor []*dto.LabelPair
+			for _, lp := range m.Label {
+				if donorLabelNames[lp.GetName()] {
+					donor = append(donor, lp)
+				}
+			}
+			donors[labelValue(m, "client")] = donor
+		}
+	}
+	if len(donors) == 0 {
+		return mfs, err
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			added := false
+			for _, lp := range donors[labelValue(m, "client")] {
+				if !hasLabel(m, lp.GetName()) {
+					m.Label = append(m.Label, lp)
+					added = true
+				}
+			}
+			if added {
+				sortLabels(m)
+			}
+		}
+	}
+	return mfs, err
+}
+
+// labelValue returns the value of the named label of m, or the empty string.
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+// sortLabels sorts the labels of m by name after labels were added.
+func sortLabels(m *dto.Metric) {
+	sort.Slice(m.Label, func(i, j int) bool {
+		return m.Label[i].GetName() < m.Label[j].GetName()
+	})
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// statusHub polls the status of the clients at an interval while anyone is
+// subscribed, and hands each snapshot to all subscribers, so that live
+// dashboards don't each query the FAHClients.
+type statusHub struct {
+	registries *clientRegistries
+	interval   time.Duration
+	logger     log.Logger
+
+	mtx     sync.Mutex
+	subs    map[chan []clientStatus]bool
+	polling bool
+	done    chan struct{}
+	closed  bool
+}
+
+func newStatusHub(registries *clientRegistries, interval time.Duration, logger log.Logger) *statusHub {
+	return &statusHub{
+		registries: registries,
+		interval:   interval,
+		logger:     logger,
+		subs:       map[chan []clientStatus]bool{},
+		done:       make(chan struct{}),
+	}
+}
+
+// subscribe returns a channel receiving the snapshots, starting with the next
+// poll, and a function to end the subscription. A subscriber that falls
+// behind only receives the latest snapshot.
+func (h *statusHub) subscribe() (<-chan []clientStatus, func()) {
+	ch := make(chan []clientStatus, 1)
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.subs[ch] = true
+	if !h.polling {
+		h.polling = true
+		go h.poll()
+	}
+	return ch, func() {
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+		delete(h.subs, ch)
+	}
+}
+
+// poll polls the clients until there are no subscribers left.
+func (h *statusHub) poll() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+		statuses := h.registries.statuses(ctx)
+		cancel()
+
+		h.mtx.Lock()
+		if len(h.subs) == 0 {
+			h.polling = false
+			h.mtx.Unlock()
+			return
+		}
+		for ch := range h.subs {
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- statuses
+		}
+		h.mtx.Unlock()
+
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// close ends the streams of all subscribers on shutdown, which would
+// otherwise keep their connections open.
+func (h *statusHub) close() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if !h.closed {
+		h.closed = true
+		close(h.done)
+	}
+}
+
+// event is a change of the status of a client observed between two polls.
+type event struct {
+	kind string
+	data interface{}
+}
+
+// clientEvent tells whether a client could be reached.
+type clientEvent struct {
+	Client string `json:"client,omitempty"`
+	Up     bool   `json:"up"`
+}
+
+// slotEvent tells the status of a slot.
+type slotEvent struct {
+	Client string `json:"client,omitempty"`
+	Slot   string `json:"slot"`
+	Status string `json:"status"`
+}
+
+// progressEvent tells the progress of a work unit.
+type progressEvent struct {
+	Client      string  `json:"client,omitempty"`
+	Slot        string  `json:"slot"`
+	WorkUnit    string  `json:"work_unit"`
+	State       string  `json:"state"`
+	PercentDone float64 `json:"percent_done"`
+}
+
+// statusEvents returns the events for the changes from the previous to the
+// current statuses. Everything is new compared to no previous statuses.
+func statusEvents(previous, current []clientStatus) []event {
+	type wuKey struct{ client, slot, wu string }
+	up := map[string]bool{}
+	slots := map[[2]string]string{}
+	wus := map[wuKey]workUnitStatus{}
+	for _, c := range previous {
+		up[c.Name] = c.Up
+		for _, s := range c.Slots {
+			slots[[2]string{c.Name, s.ID}] = s.Status
+			for _, wu := range s.WorkUnits {
+				wus[wuKey{c.Name, s.ID, wu.ID}] = wu
+			}
+		}
+	}
+
+	var events []event
+	for _, c := range current {
+		if wasUp, ok := up[c.Name]; !ok || wasUp != c.Up {
+			events = append(events, event{"client", clientEvent{c.Name, c.Up}})
+		}
+		for _, s := range c.Slots {
+			if status, ok := slots[[2]string{c.Name, s.ID}]; !ok || status != s.Status {
+				events = append(events, event{"slot", slotEvent{c.Name, s.ID, s.Status}})
+			}
+			for _, wu := range s.WorkUnits {
+				prev, ok := wus[wuKey{c.Name, s.ID, wu.ID}]
+				if !ok || prev.State != wu.State || prev.PercentDone != wu.PercentDone {
+					events = append(events, event{"progress", progressEvent{c.Name, s.ID, wu.ID, wu.State, wu.PercentDone}})
+				}
+			}
+		}
+	}
+	return events
+}
+
+// eventsHandler streams the changes of slot status and work unit progress as
+// Server-Sent Events. The first events describe the current status.
+func (h *statusHub) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch, unsubscribe := h.subscribe()
+	defer unsubscribe()
+	var previous []clientStatus
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		case statuses := <-ch:
+			events := statusEvents(previous, statuses)
+			previous = statuses
+			if len(events) == 0 {
+				// Keep proxies from closing the idle connection.
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			for _, e := range events {
+				data, err := json.Marshal(e.data)
+				if err != nil {
+					level.Error(h.logger).Log("msg", "Failed to encode event", "err", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.kind, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
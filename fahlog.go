@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// FAHClient writes its current log to log.txt in its data directory and moves
+// it to logs/log-YYYYMMDD-HHMMSS.txt on restart. Log lines only carry the UTC
+// time of day; the date is announced when the log starts and at midnight.
+var (
+	logStartedRegexp = regexp.MustCompile(`Log Started (\d{4}-\d{2}-\d{2})T`)
+	logDateRegexp    = regexp.MustCompile(`\*+ Date: (\d{4}-\d{2}-\d{2}) \*+`)
+	logLineRegexp    = regexp.MustCompile(`^(\d{2}:\d{2}:\d{2}):WU(\d+):FS(\d+):(.*)$`)
+	logCreditRegexp  = regexp.MustCompile(`^Final credit estimate, ([0-9.]+) points`)
+	logWorkAckRegexp = regexp.MustCompile(`^Server responded WORK_ACK`)
+	// Transfers are logged with their size before they start, like
+	// "Downloading 27.46MiB" or "Uploading 15.23MiB to 128.252.203.10".
+	logTransferRegexp = regexp.MustCompile(`^(Downloading|Uploading) ([0-9.]+)(B|KiB|MiB|GiB)\b`)
+	// Their progress is logged as "Upload 45.12%" until "Upload complete".
+	logTransferProgressRegexp = regexp.MustCompile(`^(Download|Upload) ([0-9.]+)%`)
+	logTransferCompleteRegexp = regexp.MustCompile(`^(Download|Upload) complete`)
+)
+
+// The state of the slots and their work units is followed from these lines,
+// for clients whose state is read from the log, see logstate.go.
+var (
+	logSlotEnabledRegexp  = regexp.MustCompile(`^(\d{2}:\d{2}:\d{2}):Enabled folding slot (\d+): (\S+) (.*)$`)
+	logSlotLineRegexp     = regexp.MustCompile(`^(\d{2}:\d{2}:\d{2}):FS(\d+):(.*)$`)
+	logPausedRegexp       = regexp.MustCompile(`^(Paused|Unpaused)\b`)
+	logReceivedUnitRegexp = regexp.MustCompile(`^Received Unit: id:\S+ state:(\S+) error:\S+ project:(\d+) run:(\d+) clone:(\d+) gen:(\d+) core:(\S+)`)
+	logProjectRegexp      = regexp.MustCompile(`^(0x[0-9a-f]+):Project: (\d+) \(Run (\d+), Clone (\d+), Gen (\d+)\)`)
+	logStartingRegexp     = regexp.MustCompile(`^Starting$`)
+	logStepsRegexp        = regexp.MustCompile(`^0x[0-9a-f]+:Completed (\d+) out of (\d+) steps`)
+	logSendingRegexp      = regexp.MustCompile(`^Sending unit results:`)
+	logCleaningUpRegexp   = regexp.MustCompile(`^Cleaning up`)
+)
+
+var logSizeUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+}
+
+type logEventKind int
+
+const (
+	logEventCompleted logEventKind = iota
+	logEventCredited
+	logEventDownloaded
+	logEventUploaded
+	logEventTransferProgress
+	logEventTransferComplete
+	logEventSlot
+	logEventSlotStatus
+	logEventUnit
+	logEventUnitState
+	logEventSteps
+	logEventCleanedUp
+)
+
+type logEvent struct {
+	kind   logEventKind
+	time   time.Time
+	slot   string
+	unit   string
+	credit float64
+	bytes  float64
+	// direction is download or upload for the progress of a transfer, and
+	// progress its ratio.
+	direction string
+	progress  float64
+	// status is the status of a slot, or the state of a work unit, and
+	// description the description of a slot.
+	status      string
+	description string
+	// project, run, clone, gen and core identify a work unit.
+	project, run, clone, gen int
+	core                     string
+}
+
+// logParser extracts work unit events from FAHClient log lines, keeping track
+// of the date announced by the log.
+type logParser struct {
+	date string
+}
+
+func (p *logParser) parseLine(line string) (logEvent, bool) {
+	if m := logStartedRegexp.FindStringSubmatch(line); m != nil {
+		p.date = m[1]
+		return logEvent{}, false
+	}
+	if m := logDateRegexp.FindStringSubmatch(line); m != nil {
+		p.date = m[1]
+		return logEvent{}, false
+	}
+
+	var event logEvent
+	var clock, msg string
+	if m := logLineRegexp.FindStringSubmatch(line); m != nil {
+		clock, msg = m[1], m[4]
+		event.slot, event.unit = m[3], m[2]
+	} else if m := logSlotLineRegexp.FindStringSubmatch(line); m != nil {
+		clock, msg = m[1], m[3]
+		event.slot = m[2]
+	} else if m := logSlotEnabledRegexp.FindStringSubmatch(line); m != nil {
+		clock = m[1]
+		event.kind = logEventSlot
+		event.slot, event.status, event.description = m[2], m[3], m[4]
+	} else {
+		return logEvent{}, false
+	}
+	if p.date != "" {
+		event.time, _ = time.Parse("2006-01-02 15:04:05", p.date+" "+clock)
+	}
+
+	switch {
+	case event.kind == logEventSlot:
+		// Parsed above.
+	case logWorkAckRegexp.MatchString(msg):
+		event.kind = logEventCompleted
+	case logCreditRegexp.MatchString(msg):
+		credit, err := strconv.ParseFloat(logCreditRegexp.FindStringSubmatch(msg)[1], 64)
+		if err != nil {
+			return logEvent{}, false
+		}
+		event.kind = logEventCredited
+		event.credit = credit
+	case logTransferRegexp.MatchString(msg):
+		m := logTransferRegexp.FindStringSubmatch(msg)
+		size, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			return logEvent{}, false
+		}
+		event.kind = logEventDownloaded
+		if m[1] == "Uploading" {
+			event.kind = logEventUploaded
+		}
+		event.bytes = size * logSizeUnits[m[3]]
+	case logTransferProgressRegexp.MatchString(msg):
+		m := logTransferProgressRegexp.FindStringSubmatch(msg)
+		percent, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			return logEvent{}, false
+		}
+		event.kind = logEventTransferProgress
+		event.direction = strings.ToLower(m[1])
+		event.progress = percent / 100
+	case logTransferCompleteRegexp.MatchString(msg):
+		event.kind = logEventTransferComplete
+	case logPausedRegexp.MatchString(msg):
+		event.kind = logEventSlotStatus
+		event.status = "PAUSED"
+		if logPausedRegexp.FindStringSubmatch(msg)[1] == "Unpaused" {
+			event.status = "READY"
+		}
+	case event.unit == "":
+		return logEvent{}, false
+	case logReceivedUnitRegexp.MatchString(msg):
+		m := logReceivedUnitRegexp.FindStringSubmatch(msg)
+		event.kind = logEventUnit
+		event.status = m[1]
+		event.project, _ = strconv.Atoi(m[2])
+		event.run, _ = strconv.Atoi(m[3])
+		event.clone, _ = strconv.Atoi(m[4])
+		event.gen, _ = strconv.Atoi(m[5])
+		event.core = m[6]
+	case logProjectRegexp.MatchString(msg):
+		m := logProjectRegexp.FindStringSubmatch(msg)
+		event.kind = logEventUnit
+		event.core = m[1]
+		event.project, _ = strconv.Atoi(m[2])
+		event.run, _ = strconv.Atoi(m[3])
+		event.clone, _ = strconv.Atoi(m[4])
+		event.gen, _ = strconv.Atoi(m[5])
+	case logStartingRegexp.MatchString(msg):
+		event.kind = logEventUnitState
+		event.status = "RUNNING"
+	case logStepsRegexp.MatchString(msg):
+		m := logStepsRegexp.FindStringSubmatch(msg)
+		steps, _ := strconv.ParseFloat(m[1], 64)
+		totalSteps, err := strconv.ParseFloat(m[2], 64)
+		if err != nil || totalSteps == 0 {
+			return logEvent{}, false
+		}
+		event.kind = logEventSteps
+		event.progress = steps / totalSteps
+	case logSendingRegexp.MatchString(msg):
+		event.kind = logEventUnitState
+		event.status = "SEND"
+	case logCleaningUpRegexp.MatchString(msg):
+		event.kind = logEventCleanedUp
+	default:
+		return logEvent{}, false
+	}
+
+	return event, true
+}
+
+// logCounters maintains per-slot counters of completed work units, credited
+// points and bytes transferred from the FAHClient log. On startup the counters
+// can be backfilled from the existing logs; afterwards lines appended to
+// log.txt are consumed on every scrape.
+type logCounters struct {
+	dir    string
+	logger log.Logger
+
+	mtx        sync.Mutex
+	parser     logParser
+	current    os.FileInfo
+	offset     int64
+	completed  map[string]float64
+	credited   map[string]float64
+	downloaded map[string]float64
+	uploaded   map[string]float64
+	// slots, units and transfers hold the state followed through the
+	// current log.
+	slots     map[string]*fahclient.SlotInfo
+	units     map[logUnitKey]*fahclient.SlotQueueInfo
+	transfers map[logUnitKey]logTransfer
+
+	workUnitsCompleted *prometheus.Desc
+	creditedPoints     *prometheus.Desc
+	downloadedBytes    *prometheus.Desc
+	uploadedBytes      *prometheus.Desc
+	transferProgress   *prometheus.Desc
+}
+
+func newLogCounters(dir string, logger log.Logger) *logCounters {
+	c := &logCounters{
+		dir:        dir,
+		logger:     logger,
+		completed:  map[string]float64{},
+		credited:   map[string]float64{},
+		downloaded: map[string]float64{},
+		uploaded:   map[string]float64{},
+		workUnitsCompleted: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "work_units_returned_total"),
+			"Number of work units the slot completed and returned to a work server, counted from the log.",
+			[]string{"id"},
+			nil,
+		),
+		creditedPoints: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "credited_points_total"),
+			"Estimated number of points credited for the work units returned by the slot.",
+			[]string{"id"},
+			nil,
+		),
+		downloadedBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "downloaded_bytes_total"),
+			"Number of bytes of work units the slot downloaded from work servers, including retries.",
+			[]string{"id"},
+			nil,
+		),
+		uploadedBytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "uploaded_bytes_total"),
+			"Number of bytes of results the slot uploaded to work and collection servers, including retries.",
+			[]string{"id"},
+			nil,
+		),
+		transferProgress: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "work_unit", "transfer_progress_ratio"),
+			"Progress of the download or upload of the work unit in progress, from 0 to 1.",
+			[]string{"id", "unit_id", "direction"},
+			nil,
+		),
+	}
+	c.restart()
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *logCounters) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.workUnitsCompleted
+	ch <- c.creditedPoints
+	ch <- c.downloadedBytes
+	ch <- c.uploadedBytes
+	ch <- c.transferProgress
+}
+
+// Collect implements prometheus.Collector.
+func (c *logCounters) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if err := c.follow(); err != nil {
+		level.Error(c.logger).Log("msg", "Failed to read FAHClient log", "err", err)
+	}
+
+	for slot, v := range c.completed {
+		ch <- prometheus.MustNewConstMetric(c.workUnitsCompleted, prometheus.CounterValue, v, slot)
+	}
+	for slot, v := range c.credited {
+		ch <- prometheus.MustNewConstMetric(c.creditedPoints, prometheus.CounterValue, v, slot)
+	}
+	for slot, v := range c.downloaded {
+		ch <- prometheus.MustNewConstMetric(c.downloadedBytes, prometheus.CounterValue, v, slot)
+	}
+	for slot, v := range c.uploaded {
+		ch <- prometheus.MustNewConstMetric(c.uploadedBytes, prometheus.CounterValue, v, slot)
+	}
+	for key, t := range c.transfers {
+		ch <- prometheus.MustNewConstMetric(c.transferProgress, prometheus.GaugeValue, t.progress, key.slot, key.unit, t.direction)
+	}
+}
+
+// backfill counts the events logged since the given time in the rotated logs
+// and the current log, and continues following the current log from its end.
+func (c *logCounters) backfill(since time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	rotated, err := filepath.Glob(filepath.Join(c.dir, "logs", "log-*.txt"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(rotated)
+
+	current := filepath.Join(c.dir, "log.txt")
+	for _, path := range append(rotated, current) {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if path != current && fi.ModTime().Before(since) {
+			// Nothing was logged to this file since then.
+			f.Close()
+			continue
+		}
+		c.restart()
+		n, err := c.consume(f, since)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		c.current, c.offset = fi, n
+	}
+
+	level.Info(c.logger).Log("msg", "Backfilled counters from FAHClient log", "since", since, "slots", len(c.completed))
+	return nil
+}
+
+// follow consumes the lines appended to log.txt since the last call, starting
+// over when the client has rotated the log.
+func (c *logCounters) follow() error {
+	f, err := os.Open(filepath.Join(c.dir, "log.txt"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if c.current == nil || !os.SameFile(c.current, fi) || fi.Size() < c.offset {
+		c.restart()
+		c.current, c.offset = fi, 0
+	}
+	if _, err := f.Seek(c.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := c.consume(f, time.Time{})
+	c.offset += n
+	return err
+}
+
+// consume counts the events of all complete lines read from r that happened
+// after since, and returns the number of bytes consumed.
+func (c *logCounters) consume(r io.Reader, since time.Time) (int64, error) {
+	var n int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int64(len(line))
+
+		event, ok := c.parser.parseLine(strings.TrimRight(line, "\r\n"))
+		if !ok {
+			continue
+		}
+		// The state is followed through the whole log, but only the
+		// events since then are counted.
+		c.track(event)
+		if event.time.Before(since) {
+			continue
+		}
+		switch event.kind {
+		case logEventCompleted:
+			c.completed[event.slot]++
+		case logEventCredited:
+			c.credited[event.slot] += event.credit
+		case logEventDownloaded:
+			c.downloaded[event.slot] += event.bytes
+		case logEventUploaded:
+			c.uploaded[event.slot] += event.bytes
+		}
+	}
+}
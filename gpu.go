@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+var (
+	gpuSlotRegexp    = regexp.MustCompile(`^gpu:(\d+):`)
+	pciAddressRegexp = regexp.MustCompile(`Bus:(\d+) Slot:(\d+) Func:(\d+)`)
+
+	// gpuTemperatureLabels are the hwmon labels of the sensor preferred as the
+	// GPU temperature, by driver: i915/xe report "pkg", amdgpu "edge".
+	gpuTemperatureLabels = map[string]bool{"pkg": true, "edge": true}
+)
+
+// slotGPUAddress returns the sysfs PCI address of the GPU assigned to a slot,
+// using the "Bus:N Slot:N Func:N" location FAHClient reports for it in info.
+func slotGPUAddress(info [][]interface{}, description string) (string, bool) {
+	m := gpuSlotRegexp.FindStringSubmatch(description)
+	if m == nil {
+		return "", false
+	}
+	gpu, ok := fahclient.InfoValue(info, "System", "GPU "+m[1])
+	if !ok {
+		return "", false
+	}
+	return pciAddress(gpu)
+}
+
+func pciAddress(gpu string) (string, bool) {
+	m := pciAddressRegexp.FindStringSubmatch(gpu)
+	if m == nil {
+		return "", false
+	}
+
+	var loc [3]int
+	for i := range loc {
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return "", false
+		}
+		loc[i] = n
+	}
+	return fmt.Sprintf("0000:%02x:%02x.%d", loc[0], loc[1], loc[2]), true
+}
+
+// readGPUTemperature returns the temperature reported by the hwmon sensors of
+// a PCI device, falling back to the first sensor when none is labeled.
+func readGPUTemperature(device string) (float64, error) {
+	inputs, err := filepath.Glob(filepath.Join(device, "hwmon", "hwmon*", "temp*_input"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(inputs)
+
+	paths := []string{}
+	for _, input := range inputs {
+		label, err := readSysfsString(input[:len(input)-len("input")] + "label")
+		if err == nil && gpuTemperatureLabels[label] {
+			paths = append([]string{input}, paths...)
+		} else {
+			paths = append(paths, input)
+		}
+	}
+
+	milli, err := readFirstSysfsInt(paths)
+	if err != nil {
+		return 0, err
+	}
+	return float64(milli) / 1000, nil
+}
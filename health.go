@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/log/level"
+)
+
+// healthyHandler reports that the exporter is running.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Folding@home Exporter is Healthy.\n")
+}
+
+// readyHandler reports whether the exporter is ready to be scraped. With
+// checkClients, it is only ready while all FAHClients can be reached, so that
+// scrapes aren't routed to an exporter that can't talk to its client yet.
+func (r *clientRegistries) readyHandler(checkClients bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if checkClients {
+			if err := r.reachable(); err != nil {
+				level.Debug(r.logger).Log("msg", "Not ready", "err", err)
+				http.Error(w, fmt.Sprintf("Folding@home Exporter is not ready: %s", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Folding@home Exporter is Ready.\n")
+	}
+}
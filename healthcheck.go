@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"gopkg.in/yaml.v2"
+)
+
+// healthcheckWebConfig is the part of the web configuration file of the
+// exporter that tells the health check how to reach it.
+type healthcheckWebConfig struct {
+	TLSServerConfig struct {
+		Cert       string `yaml:"cert"`
+		CertFile   string `yaml:"cert_file"`
+		ClientAuth string `yaml:"client_auth_type"`
+	} `yaml:"tls_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+// readHealthcheckWebConfig reads the web configuration file of the exporter,
+// if any.
+func readHealthcheckWebConfig(path string) (healthcheckWebConfig, error) {
+	var c healthcheckWebConfig
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// healthcheck checks a running exporter by requesting /-/healthy on its first
+// listen address, or with probeClient, checks that the FAHClient can be
+// reached like the liveness probe does. It is meant for container and service
+// manager health checks, which only look at the exit code. The exporter is
+// requested over HTTPS if its web configuration file enables TLS, and with
+// the given credentials if it requires basic authentication.
+func healthcheck(listenAddress, webConfigFile, username, passwordFile string, probeClient bool, client ClientConfig, timeout time.Duration, logger log.Logger) error {
+	if probeClient {
+		_, err := newLivenessCollector(client, timeout, logger).probe()
+		return err
+	}
+
+	webConfig, err := readHealthcheckWebConfig(webConfigFile)
+	if err != nil {
+		return err
+	}
+	var password string
+	switch {
+	case len(webConfig.BasicAuthUsers) > 0 && username == "":
+		return errors.New("the web configuration file requires basic authentication, pass --username and --password-file")
+	case username != "" && passwordFile == "":
+		return errors.New("--username requires --password-file")
+	case username != "":
+		password, err = readPasswordFile(passwordFile)
+		if err != nil {
+			return fmt.Errorf("reading --password-file: %w", err)
+		}
+	}
+
+	transport := &http.Transport{}
+	httpClient := &http.Client{Timeout: timeout, Transport: transport}
+	url := "http://"
+	if tlsConfig := webConfig.TLSServerConfig; tlsConfig.Cert != "" || tlsConfig.CertFile != "" {
+		switch tlsConfig.ClientAuth {
+		case "RequireAnyClientCert", "RequireAndVerifyClientCert":
+			return fmt.Errorf("the web configuration file requires client certificates (client_auth_type %s), which the health check can't present", tlsConfig.ClientAuth)
+		}
+		// The exporter's certificate is for the name it is reached by, not
+		// the address it listens on, and the check only needs to know it
+		// answers.
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		url = "https://"
+	}
+	if path, ok := strings.CutPrefix(listenAddress, unixScheme); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		url += "localhost"
+	} else {
+		host, port, err := net.SplitHostPort(listenAddress)
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		url += net.JoinHostPort(host, port)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url+"/-/healthy", nil)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// cpuSensorLabels lists, per hwmon driver, the sensor labels that report the
+// temperature of a whole CPU package rather than individual cores.
+var cpuSensorLabels = map[string][]string{
+	"coretemp": {"Package id"},
+	"k10temp":  {"Tdie", "Tctl"},
+	"zenpower": {"Tdie", "Tctl"},
+}
+
+type cpuSensor struct {
+	name  string
+	input string
+}
+
+type hwmonCollector struct {
+	sysfsPath string
+	logger    log.Logger
+
+	cpuTemperature *prometheus.Desc
+}
+
+func newHwmonCollector(sysfsPath string, logger log.Logger) *hwmonCollector {
+	return &hwmonCollector{
+		sysfsPath: sysfsPath,
+		logger:    logger,
+		cpuTemperature: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "cpu_temperature_celsius"),
+			"Temperature of the CPU package running the slot, as reported by hwmon.",
+			[]string{"id", "slot_description", "sensor"},
+			nil,
+		),
+	}
+}
+
+func (c *hwmonCollector) Name() string { return "hwmon" }
+
+func (c *hwmonCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuTemperature
+}
+
+func (c *hwmonCollector) Update(ctx context.Context, client collector.Client, ch chan<- prometheus.Metric) error {
+	slotInfo, err := client.SlotInfo()
+	if err != nil {
+		return err
+	}
+
+	var cpuSlots []fahclient.SlotInfo
+	for _, slot := range slotInfo {
+		if strings.HasPrefix(slot.Description, "cpu:") {
+			cpuSlots = append(cpuSlots, slot)
+		}
+	}
+	if len(cpuSlots) == 0 {
+		return nil
+	}
+
+	sensors, err := c.cpuSensors()
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Failed to list hwmon sensors", "err", err)
+		return nil
+	}
+
+	for _, sensor := range sensors {
+		milli, err := readSysfsInt(sensor.input)
+		if err != nil {
+			level.Debug(c.logger).Log("msg", "Failed to read hwmon sensor", "sensor", sensor.name, "err", err)
+			continue
+		}
+		for _, slot := range cpuSlots {
+			ch <- prometheus.MustNewConstMetric(c.cpuTemperature, prometheus.GaugeValue, float64(milli)/1000, slot.ID, slot.Description, sensor.name)
+		}
+	}
+	return nil
+}
+
+// cpuSensors returns the package temperature sensors of all CPUs, preferring
+// Tdie over Tctl on AMD CPUs since the latter may include an offset. Sensors
+// are named after their driver, chip and label, like k10temp/hwmon2/Tctl, as
+// each socket of a multi-socket system has a chip with the same driver and
+// labels.
+func (c *hwmonCollector) cpuSensors() ([]cpuSensor, error) {
+	chips, err := filepath.Glob(filepath.Join(c.sysfsPath, "class", "hwmon", "hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(chips)
+
+	var sensors []cpuSensor
+	for _, chip := range chips {
+		driver, err := readSysfsString(filepath.Join(chip, "name"))
+		if err != nil {
+			continue
+		}
+		wanted, ok := cpuSensorLabels[driver]
+		if !ok {
+			continue
+		}
+
+		labels, err := filepath.Glob(filepath.Join(chip, "temp*_label"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(labels)
+
+		found := map[string]string{}
+		for _, path := range labels {
+			label, err := readSysfsString(path)
+			if err != nil {
+				continue
+			}
+			found[label] = strings.TrimSuffix(path, "label") + "input"
+		}
+
+		for _, prefix := range wanted {
+			matched := false
+			for label, input := range found {
+				if strings.HasPrefix(label, prefix) {
+					sensors = append(sensors, cpuSensor{name: driver + "/" + filepath.Base(chip) + "/" + label, input: input})
+					matched = true
+				}
+			}
+			if matched {
+				break
+			}
+		}
+	}
+
+	return sensors, nil
+}
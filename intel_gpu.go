@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+)
+
+// Intel GPUs driven by i915 or xe do not have an NVML/ROCm SMI equivalent, so
+// telemetry is read from sysfs the same way intel_gpu_top does: hwmon for the
+// temperature, the GT frequency attributes for the clock, and the RC6 (idle)
+// residency counter for utilization.
+
+const intelPCIVendorID = 0x8086
+
+type idleSample struct {
+	time time.Time
+	idle time.Duration
+}
+
+type intelGPUCollector struct {
+	sysfsPath string
+	logger    log.Logger
+
+	mtx      sync.Mutex
+	lastIdle map[string]idleSample
+
+	temperature *prometheus.Desc
+	frequency   *prometheus.Desc
+	utilization *prometheus.Desc
+}
+
+func newIntelGPUCollector(sysfsPath string, logger log.Logger) *intelGPUCollector {
+	labels := []string{"id", "slot_description", "vendor"}
+
+	return &intelGPUCollector{
+		sysfsPath: sysfsPath,
+		logger:    logger,
+		lastIdle:  map[string]idleSample{},
+		temperature: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "gpu_temperature_celsius"),
+			"Temperature of the GPU assigned to the slot.",
+			labels,
+			nil,
+		),
+		frequency: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "gpu_frequency_hertz"),
+			"Current frequency of the GPU assigned to the slot.",
+			labels,
+			nil,
+		),
+		utilization: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "gpu_utilization_ratio"),
+			"Fraction of time the GPU assigned to the slot was busy since the previous scrape.",
+			labels,
+			nil,
+		),
+	}
+}
+
+func (c *intelGPUCollector) Name() string { return "intel-gpu" }
+
+func (c *intelGPUCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.temperature
+	ch <- c.frequency
+	ch <- c.utilization
+}
+
+func (c *intelGPUCollector) Update(ctx context.Context, client collector.Client, ch chan<- prometheus.Metric) error {
+	slotInfo, err := client.SlotInfo()
+	if err != nil {
+		return err
+	}
+	// The GPUs are looked up in info, without which there is nothing to
+	// export.
+	info, _ := client.Info()
+
+	for _, slot := range slotInfo {
+		addr, ok := slotGPUAddress(info, slot.Description)
+		if !ok {
+			continue
+		}
+
+		device := filepath.Join(c.sysfsPath, "bus", "pci", "devices", addr)
+		vendor, err := readSysfsInt(filepath.Join(device, "vendor"))
+		if err != nil {
+			level.Debug(c.logger).Log("msg", "Failed to read PCI vendor", "device", addr, "err", err)
+			continue
+		}
+		if vendor != intelPCIVendorID {
+			continue
+		}
+
+		labels := []string{slot.ID, slot.Description, "intel"}
+
+		if temp, err := readGPUTemperature(device); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, temp, labels...)
+		} else {
+			level.Debug(c.logger).Log("msg", "Failed to read GPU temperature", "device", addr, "err", err)
+		}
+
+		if freq, err := readFirstSysfsInt(c.frequencyPaths(device)); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.frequency, prometheus.GaugeValue, float64(freq)*1e6, labels...)
+		} else {
+			level.Debug(c.logger).Log("msg", "Failed to read GPU frequency", "device", addr, "err", err)
+		}
+
+		idle, err := readFirstSysfsInt(c.idlePaths(device))
+		if err != nil {
+			level.Debug(c.logger).Log("msg", "Failed to read GPU idle residency", "device", addr, "err", err)
+			continue
+		}
+		if util, ok := c.updateUtilization(addr, time.Duration(idle)*time.Millisecond); ok {
+			ch <- prometheus.MustNewConstMetric(c.utilization, prometheus.GaugeValue, util, labels...)
+		}
+	}
+	return nil
+}
+
+func (c *intelGPUCollector) frequencyPaths(device string) []string {
+	paths := []string{}
+	if cards, err := filepath.Glob(filepath.Join(device, "drm", "card[0-9]*")); err == nil {
+		for _, card := range cards {
+			paths = append(paths,
+				filepath.Join(card, "gt_act_freq_mhz"),
+				filepath.Join(card, "gt_cur_freq_mhz"),
+			)
+		}
+	}
+	// The xe driver exposes frequencies per tile and GT instead.
+	return append(paths, filepath.Join(device, "tile0", "gt0", "freq0", "act_freq"))
+}
+
+func (c *intelGPUCollector) idlePaths(device string) []string {
+	paths := []string{}
+	if cards, err := filepath.Glob(filepath.Join(device, "drm", "card[0-9]*")); err == nil {
+		for _, card := range cards {
+			paths = append(paths,
+				filepath.Join(card, "gt", "gt0", "rc6_residency_ms"),
+				filepath.Join(card, "power", "rc6_residency_ms"),
+			)
+		}
+	}
+	return append(paths, filepath.Join(device, "tile0", "gt0", "gtidle", "idle_residency_ms"))
+}
+
+// updateUtilization records the idle residency of a device and returns the
+// busy ratio since the previous sample, if there was one.
+func (c *intelGPUCollector) updateUtilization(addr string, idle time.Duration) (float64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	prev, ok := c.lastIdle[addr]
+	c.lastIdle[addr] = idleSample{time: now, idle: idle}
+	if !ok || idle < prev.idle {
+		return 0, false
+	}
+
+	elapsed := now.Sub(prev.time)
+	if elapsed <= 0 {
+		return 0, false
+	}
+	util := 1 - float64(idle-prev.idle)/float64(elapsed)
+	if util < 0 {
+		util = 0
+	}
+	return util, true
+}
@@ -0,0 +1,296 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+type uptimeCollector struct {
+	uptime *prometheus.Desc
+}
+
+func newUptimeCollector() *uptimeCollector {
+	return &uptimeCollector{
+		uptime: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "uptime_seconds"),
+			"Number of seconds since the FAHClient started.",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (c *uptimeCollector) Name() string { return "uptime" }
+
+func (c *uptimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.uptime
+}
+
+func (c *uptimeCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	uptime, err := client.Uptime()
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, uptime.Seconds())
+	return nil
+}
+
+type dateCollector struct {
+	time *prometheus.Desc
+}
+
+func newDateCollector() *dateCollector {
+	return &dateCollector{
+		time: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "time_seconds"),
+			"Current UNIX time according to the FAHClient.",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (c *dateCollector) Name() string { return "date" }
+
+func (c *dateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.time
+}
+
+func (c *dateCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	date, err := client.Date()
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.time, prometheus.GaugeValue, float64(t.Unix()))
+	return nil
+}
+
+// systemInfoLabels are the labels of foldingathome_system_info and the keys
+// of the System section of info they are set from.
+var systemInfoLabels = []struct{ label, key string }{
+	{"cpu", "CPU"},
+	{"cpus", "CPUs"},
+	{"memory", "Memory"},
+	{"os", "OS"},
+	{"os_version", "OS Version"},
+	{"os_arch", "OS Arch"},
+}
+
+var (
+	// gpuLocationRegexp matches the PCI location that precedes the
+	// description of a GPU in info, like "Bus:1 Slot:0 Func:0 ".
+	gpuLocationRegexp = regexp.MustCompile(`^Bus:\d+ Slot:\d+ Func:\d+ `)
+	// gpuComputeRegexp and gpuDriverRegexp match the compute capability and
+	// driver version of the CUDA and OpenCL devices in info.
+	gpuComputeRegexp = regexp.MustCompile(`Compute:(\S+)`)
+	gpuDriverRegexp  = regexp.MustCompile(`Driver:(\S+)`)
+)
+
+type infoCollector struct {
+	version    *prometheus.Desc
+	onBattery  *prometheus.Desc
+	systemInfo *prometheus.Desc
+	gpuInfo    *prometheus.Desc
+}
+
+func newInfoCollector() *infoCollector {
+	return &infoCollector{
+		version: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "version"),
+			"The version of this FAHClient.",
+			[]string{"version"},
+			nil,
+		),
+		onBattery: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "on_battery"),
+			"Whether the FAHClient believes the machine runs on battery power, which it doesn't fold on by default.",
+			nil,
+			nil,
+		),
+		systemInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "system_info"),
+			"The hardware and operating system of the machine the FAHClient runs on, with a constant value of 1.",
+			systemInfoLabelNames(),
+			nil,
+		),
+		gpuInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "gpu_info"),
+			"A GPU the FAHClient detected, whether or not a slot uses it, with its CUDA and OpenCL compute capability and driver version, with a constant value of 1.",
+			[]string{"gpu", "description", "cuda_compute", "cuda_driver", "opencl_compute", "opencl_driver"},
+			nil,
+		),
+	}
+}
+
+func systemInfoLabelNames() []string {
+	names := make([]string, 0, len(systemInfoLabels))
+	for _, l := range systemInfoLabels {
+		names = append(names, l.label)
+	}
+	return names
+}
+
+func (c *infoCollector) Name() string { return "info" }
+
+func (c *infoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.version
+	ch <- c.onBattery
+	ch <- c.systemInfo
+	ch <- c.gpuInfo
+}
+
+func (c *infoCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	info, err := client.Info()
+	if err != nil {
+		return err
+	}
+	version, ok := fahclient.InfoValue(info, "FAHClient", "Version")
+	if !ok {
+		return errors.New("Version not found in info response")
+	}
+	ch <- prometheus.MustNewConstMetric(c.version, prometheus.GaugeValue, 1, version)
+	// Only reported by clients that know about batteries.
+	if onBattery, ok := fahclient.InfoValue(info, "System", "On Battery"); ok {
+		b, err := strconv.ParseBool(onBattery)
+		if err != nil {
+			return fmt.Errorf("invalid On Battery value %q in info response", onBattery)
+		}
+		ch <- prometheus.MustNewConstMetric(c.onBattery, prometheus.GaugeValue, boolValue(b))
+	}
+	if hasInfoSection(info, "System") {
+		values := make([]string, 0, len(systemInfoLabels))
+		for _, l := range systemInfoLabels {
+			value, _ := fahclient.InfoValue(info, "System", l.key)
+			values = append(values, value)
+		}
+		ch <- prometheus.MustNewConstMetric(c.systemInfo, prometheus.GaugeValue, 1, values...)
+	}
+	// GPUs are numbered from 0, and their CUDA and OpenCL devices by the
+	// index of the GPU.
+	for i := 0; ; i++ {
+		gpu := strconv.Itoa(i)
+		description, ok := fahclient.InfoValue(info, "System", "GPU "+gpu)
+		if !ok {
+			break
+		}
+		cuda, _ := fahclient.InfoValue(info, "System", "CUDA Device "+gpu)
+		opencl, _ := fahclient.InfoValue(info, "System", "OpenCL Device "+gpu)
+		ch <- prometheus.MustNewConstMetric(c.gpuInfo, prometheus.GaugeValue, 1,
+			gpu,
+			gpuLocationRegexp.ReplaceAllString(description, ""),
+			submatch(gpuComputeRegexp, cuda),
+			submatch(gpuDriverRegexp, cuda),
+			submatch(gpuComputeRegexp, opencl),
+			submatch(gpuDriverRegexp, opencl),
+		)
+	}
+	return nil
+}
+
+// powerLevels are the power settings of a FAHClient.
+var powerLevels = []string{"light", "medium", "full"}
+
+type optionsCollector struct {
+	options *prometheus.Desc
+	power   *prometheus.Desc
+}
+
+func newOptionsCollector() *optionsCollector {
+	return &optionsCollector{
+		options: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "options_info"),
+			"The donor the FAHClient folds for, its power setting and the research cause it prefers, with a constant value of 1. The passkey itself is not exported.",
+			[]string{"user", "team", "passkey_configured", "power", "cause"},
+			nil,
+		),
+		power: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "power"),
+			"Whether the FAHClient is set to fold at the power level.",
+			[]string{"power"},
+			nil,
+		),
+	}
+}
+
+func (c *optionsCollector) Name() string { return "options" }
+
+func (c *optionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.options
+	ch <- c.power
+}
+
+func (c *optionsCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	options, err := client.Options()
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.options, prometheus.GaugeValue, 1, options.User, options.Team, strconv.FormatBool(options.Passkey != ""), options.Power, strings.ToUpper(options.Cause))
+	if options.Power != "" {
+		power := strings.ToLower(options.Power)
+		for _, level := range powerLevels {
+			ch <- prometheus.MustNewConstMetric(c.power, prometheus.GaugeValue, boolValue(level == power), level)
+		}
+	}
+	return nil
+}
+
+// submatch returns the first submatch of re in s, or the empty string.
+func submatch(re *regexp.Regexp, s string) string {
+	if m := re.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// hasInfoSection tells whether info has the named section.
+func hasInfoSection(info [][]interface{}, section string) bool {
+	for _, s := range info {
+		if len(s) > 0 && s[0] == section {
+			return true
+		}
+	}
+	return false
+}
+
+type ppdCollector struct {
+	ppd *prometheus.Desc
+}
+
+func newPPDCollector() *ppdCollector {
+	return &ppdCollector{
+		ppd: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "estimated_points_per_day"),
+			"Estimated points per day of all slots of the FAHClient.",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (c *ppdCollector) Name() string { return "ppd" }
+
+func (c *ppdCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.ppd
+}
+
+func (c *ppdCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	ppd, err := client.PPD()
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.ppd, prometheus.GaugeValue, ppd)
+	return nil
+}
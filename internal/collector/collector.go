@@ -0,0 +1,79 @@
+// Package collector exports the state of a FAHClient as Prometheus metrics.
+// Each metric source is a Collector; an exporter registers the collectors it
+// uses and updates them on every scrape from the state it fetched from the
+// client.
+package collector
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+const (
+	namespace         = "foldingathome"
+	subsystemSlot     = "slot"
+	subsystemWorkUnit = "work_unit"
+)
+
+// ErrNotSupported is returned by a Client for state the FAHClient does not
+// report, like the uptime of a v8 client. Collectors return it as is.
+var ErrNotSupported = errors.New("not supported by the client")
+
+// Client is the state of a FAHClient. Each method returns the output of the
+// command of the same name, or the error it failed with.
+type Client interface {
+	Uptime() (time.Duration, error)
+	// Date returns the current time according to the client, formatted as
+	// RFC 3339.
+	Date() (string, error)
+	Info() ([][]interface{}, error)
+	Options() (fahclient.Options, error)
+	SlotInfo() ([]fahclient.SlotInfo, error)
+	// SlotOptions returns the options of the slots by slot ID.
+	SlotOptions() (map[string]fahclient.SlotOptions, error)
+	QueueInfo() ([]fahclient.SlotQueueInfo, error)
+	// PPD returns the estimated points per day of the client as a whole.
+	PPD() (float64, error)
+}
+
+// Collector exports metrics from the state of a FAHClient.
+type Collector interface {
+	// Name identifies the collector in logs.
+	Name() string
+	// Describe sends the descriptors of all metrics the collector exports.
+	Describe(ch chan<- *prometheus.Desc)
+	// Update sends the metrics for the current state of client. An error
+	// means the metrics are incomplete.
+	Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error
+}
+
+// Default returns the collectors of the metrics reported for every client,
+// whose history is kept in frames under clientKey. The key must tell the
+// client apart from all others, which its address alone doesn't for clients
+// reached through a tunnel.
+func Default(clientKey string, frames *FrameHistory, logger log.Logger) []Collector {
+	return []Collector{
+		newUptimeCollector(),
+		newDateCollector(),
+		newInfoCollector(),
+		newOptionsCollector(),
+		newPPDCollector(),
+		newSlotCollector(clientKey, frames, logger),
+		newSlotOptionsCollector(),
+		newQueueCollector(clientKey, frames),
+	}
+}
+
+// boolValue returns the value of a metric for a flag.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,368 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// fakeClient is a Client returning canned state, or the error in errs for the
+// commands listed there.
+type fakeClient struct {
+	slotInfo    []fahclient.SlotInfo
+	slotOptions map[string]fahclient.SlotOptions
+	queueInfo   []fahclient.SlotQueueInfo
+	errs        map[string]error
+}
+
+func (c *fakeClient) Uptime() (time.Duration, error) { return 0, c.errs["uptime"] }
+func (c *fakeClient) Date() (string, error)          { return "", c.errs["date"] }
+func (c *fakeClient) Info() ([][]interface{}, error) { return nil, c.errs["info"] }
+func (c *fakeClient) Options() (fahclient.Options, error) {
+	return fahclient.Options{}, c.errs["options"]
+}
+func (c *fakeClient) PPD() (float64, error) { return 0, c.errs["ppd"] }
+
+func (c *fakeClient) SlotInfo() ([]fahclient.SlotInfo, error) {
+	if err := c.errs["slot-info"]; err != nil {
+		return nil, err
+	}
+	return c.slotInfo, nil
+}
+
+func (c *fakeClient) SlotOptions() (map[string]fahclient.SlotOptions, error) {
+	if err := c.errs["slot-options"]; err != nil {
+		return nil, err
+	}
+	return c.slotOptions, nil
+}
+
+func (c *fakeClient) QueueInfo() ([]fahclient.SlotQueueInfo, error) {
+	if err := c.errs["queue-info"]; err != nil {
+		return nil, err
+	}
+	return c.queueInfo, nil
+}
+
+// update runs c.Update against client through a registry, so that the
+// metrics are checked for consistency with c.Describe, and returns their
+// values by name and labels, like foldingathome_slots{state="running"}.
+// Histograms are returned by their sample count.
+func update(t *testing.T, c Collector, client Client) (map[string]float64, error) {
+	t.Helper()
+	adapter := &collectorAdapter{c: c, client: client}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(adapter)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering %s: %v", c.Name(), err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			values[seriesName(family.GetName(), m)] = metricValue(m)
+		}
+	}
+	return values, adapter.err
+}
+
+type collectorAdapter struct {
+	c      Collector
+	client Client
+	err    error
+}
+
+func (a *collectorAdapter) Describe(ch chan<- *prometheus.Desc) { a.c.Describe(ch) }
+
+func (a *collectorAdapter) Collect(ch chan<- prometheus.Metric) {
+	a.err = a.c.Update(context.Background(), a.client, ch)
+}
+
+func seriesName(name string, m *dto.Metric) string {
+	if len(m.GetLabel()) == 0 {
+		return name
+	}
+	labels := make([]string, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	case m.Histogram != nil:
+		return float64(m.GetHistogram().GetSampleCount())
+	}
+	return 0
+}
+
+func checkValues(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	for series, v := range want {
+		g, ok := got[series]
+		switch {
+		case !ok:
+			t.Errorf("%s missing", series)
+		case g != v:
+			t.Errorf("%s = %v, want %v", series, g, v)
+		}
+	}
+}
+
+func checkAbsent(t *testing.T, got map[string]float64, series ...string) {
+	t.Helper()
+	for _, s := range series {
+		if _, ok := got[s]; ok {
+			t.Errorf("%s exported, want absent", s)
+		}
+	}
+}
+
+func TestSlotCollector(t *testing.T) {
+	client := &fakeClient{slotInfo: []fahclient.SlotInfo{
+		{ID: "00", Status: "RUNNING", Description: "cpu:14"},
+		{ID: "01", Status: "PAUSED", Description: "gpu:0:TU104 [GeForce RTX 2080]", Idle: true},
+		{ID: "02", Status: "HIBERNATING", Description: "cpu:2"},
+	}}
+	c := newSlotCollector("localhost:36330", NewFrameHistory(), log.NewNopLogger())
+
+	got, err := update(t, c, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, got, map[string]float64{
+		`foldingathome_slot_info{device="",gpu_index="",id="00",slot_description="cpu:14",type="cpu"}`:                                          1,
+		`foldingathome_slot_info{device="GeForce RTX 2080",gpu_index="0",id="01",slot_description="gpu:0:TU104 [GeForce RTX 2080]",type="gpu"}`: 1,
+		`foldingathome_slot_status{id="00",slot_description="cpu:14"}`:                                                                          3,
+		`foldingathome_slot_status{id="01",slot_description="gpu:0:TU104 [GeForce RTX 2080]"}`:                                                  7,
+		`foldingathome_slot_status{id="02",slot_description="cpu:2"}`:                                                                           0,
+		`foldingathome_slot_idle{id="00",slot_description="cpu:14"}`:                                                                            0,
+		`foldingathome_slot_idle{id="01",slot_description="gpu:0:TU104 [GeForce RTX 2080]"}`:                                                    1,
+		`foldingathome_slots{state="running"}`:                                                                                                  1,
+		`foldingathome_slots{state="paused"}`:                                                                                                   1,
+		`foldingathome_slots{state="unknown"}`:                                                                                                  1,
+		`foldingathome_slots{state="ready"}`:                                                                                                    0,
+		`foldingathome_slots_configured`:                                                                                                        3,
+		`foldingathome_slot_unknown_status_total`:                                                                                               1,
+	})
+
+	// A second scrape sees the paused slot resumed and the unknown status
+	// again, which isn't counted again as the slot stayed in it.
+	client.slotInfo[1].Status = "READY"
+	got, err = update(t, c, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, got, map[string]float64{
+		`foldingathome_slot_status{id="01",slot_description="gpu:0:TU104 [GeForce RTX 2080]"}`: 1,
+		`foldingathome_slot_state_transitions_total{from="paused",id="01",to="ready"}`:         1,
+		`foldingathome_slot_unknown_status_total`:                                              1,
+	})
+	checkAbsent(t, got, `foldingathome_slot_state_transitions_total{from="running",id="00",to="running"}`)
+
+	// The count is kept in the history, so a collector created for the
+	// next probe carries on with it and counts the slot entering another
+	// unknown status.
+	client.slotInfo[2].Status = "SUSPENDED"
+	got, err = update(t, newSlotCollector("localhost:36330", c.frames, log.NewNopLogger()), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, got, map[string]float64{
+		`foldingathome_slot_unknown_status_total`: 2,
+	})
+	checkAbsent(t, got, `foldingathome_slot_state_transitions_total{from="unknown",id="02",to="unknown"}`)
+}
+
+func TestSlotStateCollector(t *testing.T) {
+	client := &fakeClient{slotInfo: []fahclient.SlotInfo{
+		{ID: "00", Status: "RUNNING", Description: "cpu:14"},
+	}}
+	got, err := update(t, NewSlotStateCollector(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{}
+	for _, state := range slotStates() {
+		want[fmt.Sprintf(`foldingathome_slot_state{id="00",slot_description="cpu:14",state=%q}`, state)] = boolValue(state == "running")
+	}
+	checkValues(t, got, want)
+	if len(got) != len(want) {
+		t.Errorf("got %d series, want %d", len(got), len(want))
+	}
+}
+
+func TestSlotOptionsCollector(t *testing.T) {
+	client := &fakeClient{
+		slotInfo: []fahclient.SlotInfo{
+			{ID: "00", Status: "RUNNING", Description: "cpu:14"},
+			{ID: "01", Status: "RUNNING", Description: "cpu:2"},
+		},
+		slotOptions: map[string]fahclient.SlotOptions{
+			"00": {CPUs: 14, Paused: true, ClientType: "advanced"},
+		},
+	}
+	got, err := update(t, newSlotOptionsCollector(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, got, map[string]float64{
+		`foldingathome_slot_option_cpus{id="00",slot_description="cpu:14"}`:                               14,
+		`foldingathome_slot_option_paused{id="00",slot_description="cpu:14"}`:                             1,
+		`foldingathome_slot_option_idle{id="00",slot_description="cpu:14"}`:                               0,
+		`foldingathome_slot_option_client_type{client_type="advanced",id="00",slot_description="cpu:14"}`: 1,
+	})
+	checkAbsent(t, got, `foldingathome_slot_option_cpus{id="01",slot_description="cpu:2"}`)
+}
+
+func TestQueueCollector(t *testing.T) {
+	assigned := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	client := &fakeClient{
+		slotInfo: []fahclient.SlotInfo{
+			{ID: "00", Status: "RUNNING", Description: "cpu:14"},
+			{ID: "01", Status: "DOWNLOAD", Description: "gpu:0:TU104 [GeForce RTX 2080]"},
+		},
+		queueInfo: []fahclient.SlotQueueInfo{
+			{
+				ID: "01", Slot: "00", State: "RUNNING", Error: "NO_ERROR",
+				Project: 13416, Run: 1, Clone: 2, Gen: 3, Core: "0xA8",
+				PercentDone: "42.50%", ETA: 3 * time.Hour, PPD: 250000,
+				CreditEstimate: 30000, BaseCredit: 5000,
+				TimeRemaining: 48 * time.Hour, Assigned: assigned,
+				WS: "128.252.203.10", CS: "0.0.0.0",
+			},
+			{
+				ID: "02", Slot: "01", State: "DOWNLOAD", Error: "NO_ERROR",
+				WaitingOn: "WS Assignment", Attempts: 3, NextAttempt: 90 * time.Second,
+			},
+		},
+	}
+	c := newQueueCollector("localhost:36330", NewFrameHistory())
+
+	got, err := update(t, c, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const cpu = `id="00",slot_description="cpu:14"`
+	const gpu = `id="01",slot_description="gpu:0:TU104 [GeForce RTX 2080]"`
+	checkValues(t, got, map[string]float64{
+		`foldingathome_slot_work_units{` + cpu + `}`:                            1,
+		`foldingathome_slot_work_units{` + gpu + `}`:                            1,
+		`foldingathome_slot_attempts{` + gpu + `}`:                              3,
+		`foldingathome_slot_next_attempt_seconds{` + gpu + `}`:                  90,
+		`foldingathome_slot_waiting_on{` + gpu + `,waiting_on="WS Assignment"}`: 1,
+		`foldingathome_slot_estimated_points_per_day{` + cpu + `}`:              250000,
+		`foldingathome_slot_work_units_completed_total{id="00"}`:                0,
+		`foldingathome_slot_work_units_completed_total{id="01"}`:                0,
+		`foldingathome_work_unit_info{core="0xa8",cs="",id="00",prcg="13416 (1, 2, 3)",slot_description="cpu:14",unit_id="01",ws="128.252.203.10"}`: 1,
+		`foldingathome_work_unit_progress_ratio{` + cpu + `,unit_id="01"}`:                                                                          0.425,
+		`foldingathome_work_unit_credit_estimate_points{` + cpu + `,unit_id="01"}`:                                                                  30000,
+		`foldingathome_work_unit_base_credit_points{` + cpu + `,unit_id="01"}`:                                                                      5000,
+		`foldingathome_work_unit_estimated_completion_seconds{` + cpu + `,unit_id="01"}`:                                                            3 * 3600,
+		`foldingathome_work_unit_time_remaining_seconds{` + cpu + `,unit_id="01"}`:                                                                  48 * 3600,
+		`foldingathome_work_unit_assigned_timestamp_seconds{` + cpu + `,unit_id="01"}`:                                                              float64(assigned.Unix()),
+	})
+	// The queue entry waiting for an assignment holds no work unit yet.
+	for series := range got {
+		if strings.HasPrefix(series, "foldingathome_work_unit_") && strings.Contains(series, `unit_id="02"`) {
+			t.Errorf("%s exported for an empty queue entry", series)
+		}
+	}
+	checkAbsent(t, got,
+		`foldingathome_slot_attempts{`+cpu+`}`,
+		`foldingathome_work_unit_timeout_timestamp_seconds{`+cpu+`,unit_id="01"}`,
+	)
+
+	// The work unit is seen finished and then gone from the queue, which
+	// completes it.
+	client.queueInfo[0].State = "SEND"
+	client.queueInfo[0].PercentDone = "100.00%"
+	if _, err := update(t, c, client); err != nil {
+		t.Fatal(err)
+	}
+	client.queueInfo = client.queueInfo[1:]
+	got, err = update(t, c, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, got, map[string]float64{
+		`foldingathome_slot_work_units{` + cpu + `}`:               0,
+		`foldingathome_slot_work_units_completed_total{id="00"}`:   1,
+		`foldingathome_slot_work_unit_turnaround_seconds{id="00"}`: 1,
+		`foldingathome_slot_work_units_completed_total{id="01"}`:   0,
+	})
+}
+
+func TestQueueCollectorWithoutSlotInfo(t *testing.T) {
+	client := &fakeClient{
+		queueInfo: []fahclient.SlotQueueInfo{
+			{ID: "01", Slot: "00", State: "RUNNING", Project: 13416, PercentDone: "10%"},
+		},
+		errs: map[string]error{"slot-info": ErrNotSupported},
+	}
+	got, err := update(t, newQueueCollector("localhost:36330", NewFrameHistory()), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without slot-info, work units are exported without the slot, but not
+	// counted under no slot.
+	checkValues(t, got, map[string]float64{
+		`foldingathome_work_unit_progress_ratio{id="",slot_description="",unit_id="01"}`: 0.1,
+	})
+	checkAbsent(t, got, `foldingathome_slot_work_units{id="",slot_description=""}`)
+}
+
+func TestNotSupported(t *testing.T) {
+	frames := NewFrameHistory()
+	for _, tt := range []struct {
+		c       Collector
+		command string
+	}{
+		{newSlotCollector("localhost:36330", frames, log.NewNopLogger()), "slot-info"},
+		{NewSlotStateCollector(), "slot-info"},
+		{newSlotOptionsCollector(), "slot-options"},
+		{newSlotOptionsCollector(), "slot-info"},
+		{newQueueCollector("localhost:36330", frames), "queue-info"},
+	} {
+		t.Run(tt.c.Name()+"/"+tt.command, func(t *testing.T) {
+			client := &fakeClient{
+				slotInfo:    []fahclient.SlotInfo{{ID: "00", Status: "RUNNING", Description: "cpu:14"}},
+				slotOptions: map[string]fahclient.SlotOptions{"00": {CPUs: 14}},
+				queueInfo:   []fahclient.SlotQueueInfo{{ID: "01", Slot: "00", State: "RUNNING", Project: 13416}},
+				errs:        map[string]error{tt.command: fmt.Errorf("%s: %w", tt.command, ErrNotSupported)},
+			}
+			got, err := update(t, tt.c, client)
+			if !errors.Is(err, ErrNotSupported) {
+				t.Errorf("got error %v, want ErrNotSupported", err)
+			}
+			if len(got) != 0 {
+				t.Errorf("got %d series, want none: %v", len(got), got)
+			}
+		})
+	}
+}
+
+func TestClientError(t *testing.T) {
+	want := errors.New("connection reset")
+	client := &fakeClient{errs: map[string]error{"slot-info": want}}
+	_, err := update(t, newSlotCollector("localhost:36330", NewFrameHistory(), log.NewNopLogger()), client)
+	if !errors.Is(err, want) {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+const (
+	// frameHistoryWindow is the number of frame completions used to compute
+	// the observed time per frame.
+	frameHistoryWindow = 10
+	// frameHistoryExpiry is how long the history of a work unit that is no
+	// longer reported by the client is kept.
+	frameHistoryExpiry = time.Hour
+	// clientHistoryExpiry is how long the counters and histograms of a
+	// client that is no longer scraped are kept, so that /probe targets
+	// that come and go don't accumulate.
+	clientHistoryExpiry = 24 * time.Hour
+)
+
+// frameTimeBuckets are the upper bounds in seconds of the buckets of the frame
+// time histograms, from the fastest GPUs to slow CPUs.
+var frameTimeBuckets = []float64{10, 20, 30, 45, 60, 90, 120, 180, 240, 300, 450, 600, 900, 1800, 3600}
+
+type frameObservation struct {
+	time   time.Time
+	frames int
+}
+
+type unitFrames struct {
+	frames       int
+	observations []frameObservation
+	lastSeen     time.Time
+}
+
+// FrameHistory records when the frame count of each work unit was seen to
+// increase. Unlike the client's ETA, which swings wildly early in a work
+// unit, the time per frame derived from it converges quickly. The times of
+// the frames are also kept in a histogram per slot. It also keeps
+// the queues and slots last seen, to count the work units completed and
+// failed and the changes of the states of the slots. It is
+// shared by the collectors of all exporters so that it survives across
+// exporters created per probe request.
+type FrameHistory struct {
+	mtx   sync.Mutex
+	units map[string]*unitFrames
+	// frameTimes holds the histograms of the times of the frames of each
+	// client by slot ID, by client key.
+	frameTimes map[string]map[string]*histogram
+	// queues holds the work units last seen in the queue of each client,
+	// and counts the work units counted as completed and failed, by client
+	// key.
+	queues map[string]map[string]unitSighting
+	counts map[string]queueCounts
+	// slotStates holds the statuses the slots of each client were last
+	// seen in, transitions the changes counted and unknownStatus the times
+	// slots entered a status the exporter doesn't know, by client key.
+	slotStates    map[string]map[string]string
+	transitions   map[string]map[transition]float64
+	unknownStatus map[string]float64
+	// clients holds when each client was last seen, by client key.
+	clients map[string]time.Time
+}
+
+// NewFrameHistory returns an empty FrameHistory.
+func NewFrameHistory() *FrameHistory {
+	return &FrameHistory{
+		units:         map[string]*unitFrames{},
+		frameTimes:    map[string]map[string]*histogram{},
+		queues:        map[string]map[string]unitSighting{},
+		counts:        map[string]queueCounts{},
+		slotStates:    map[string]map[string]string{},
+		transitions:   map[string]map[transition]float64{},
+		unknownStatus: map[string]float64{},
+		clients:       map[string]time.Time{},
+	}
+}
+
+// smoothedETA records the frames completed by the work unit identified by key,
+// of a slot of the client identified by clientKey, and returns the time
+// remaining extrapolated from the observed time per frame. No estimate is returned until
+// at least two frame boundaries have been observed. The time between two
+// frame boundaries is observed in the frame time histogram of the slot, once
+// for each frame completed in between. While the work unit isn't folding,
+// like while its slot is paused, the observations are dropped and no estimate
+// is returned, so that the pause counts neither towards the time per frame
+// nor the frame times.
+func (h *FrameHistory) smoothedETA(clientKey, slot, key string, now time.Time, folding bool, framesDone, totalFrames int) (time.Duration, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.expire(now)
+	h.seen(clientKey, now)
+
+	u, ok := h.units[key]
+	if !ok {
+		// The first sighting is somewhere in the middle of a frame, so only
+		// later changes in the frame count mark frame boundaries.
+		h.units[key] = &unitFrames{frames: framesDone, lastSeen: now}
+		return 0, false
+	}
+	u.lastSeen = now
+
+	switch {
+	case !folding:
+		// The frame in progress when folding resumes started before the
+		// pause, so only the frame boundaries after it count.
+		u.frames = framesDone
+		u.observations = nil
+		return 0, false
+	case framesDone < u.frames:
+		// The unit was restarted from a checkpoint; start over.
+		u.observations = nil
+	case framesDone > u.frames:
+		if n := len(u.observations); n > 0 {
+			last := u.observations[n-1]
+			frames := framesDone - last.frames
+			frameTime := now.Sub(last.time).Seconds() / float64(frames)
+			for i := 0; i < frames; i++ {
+				h.frameTimeHistogram(clientKey, slot).observe(frameTime)
+			}
+		}
+		u.observations = append(u.observations, frameObservation{time: now, frames: framesDone})
+		if len(u.observations) > frameHistoryWindow+1 {
+			u.observations = u.observations[len(u.observations)-frameHistoryWindow-1:]
+		}
+	}
+	u.frames = framesDone
+
+	n := len(u.observations)
+	if n < 2 || totalFrames <= 0 {
+		return 0, false
+	}
+	first, last := u.observations[0], u.observations[n-1]
+	timePerFrame := last.time.Sub(first.time) / time.Duration(last.frames-first.frames)
+
+	eta := time.Duration(totalFrames-last.frames)*timePerFrame - now.Sub(last.time)
+	if eta < 0 {
+		eta = 0
+	}
+	return eta, true
+}
+
+func (h *FrameHistory) frameTimeHistogram(clientKey, slot string) *histogram {
+	histograms, ok := h.frameTimes[clientKey]
+	if !ok {
+		histograms = map[string]*histogram{}
+		h.frameTimes[clientKey] = histograms
+	}
+	fh, ok := histograms[slot]
+	if !ok {
+		fh = newHistogram(frameTimeBuckets)
+		histograms[slot] = fh
+	}
+	return fh
+}
+
+// frameTimeHistograms returns a copy of the frame time histograms of the slots
+// of the client identified by clientKey, by slot ID.
+func (h *FrameHistory) frameTimeHistograms(clientKey string, slotInfo []fahclient.SlotInfo) map[string]*histogram {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return copyHistograms(h.frameTimes[clientKey], slotInfo, frameTimeBuckets)
+}
+
+func (h *FrameHistory) expire(now time.Time) {
+	for key, u := range h.units {
+		if now.Sub(u.lastSeen) > frameHistoryExpiry {
+			delete(h.units, key)
+		}
+	}
+}
+
+// seen records that the client identified by clientKey was seen at now, and
+// forgets the clients that weren't seen for clientHistoryExpiry.
+func (h *FrameHistory) seen(clientKey string, now time.Time) {
+	h.clients[clientKey] = now
+	for key, last := range h.clients {
+		if now.Sub(last) <= clientHistoryExpiry {
+			continue
+		}
+		delete(h.clients, key)
+		delete(h.frameTimes, key)
+		delete(h.queues, key)
+		delete(h.counts, key)
+		delete(h.slotStates, key)
+		delete(h.transitions, key)
+		delete(h.unknownStatus, key)
+	}
+}
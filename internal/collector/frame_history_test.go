@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+func TestSmoothedETA(t *testing.T) {
+	h := NewFrameHistory()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	eta := func(minutes int, folding bool, framesDone int) (time.Duration, bool) {
+		return h.smoothedETA("localhost:36330", "00", "unit", start.Add(time.Duration(minutes)*time.Minute), folding, framesDone, 100)
+	}
+
+	// The first sighting and the first frame boundary give no estimate.
+	for _, tt := range []struct {
+		minutes, frames int
+	}{{0, 10}, {5, 11}} {
+		if _, ok := eta(tt.minutes, true, tt.frames); ok {
+			t.Fatalf("estimate after %d minutes, want none", tt.minutes)
+		}
+	}
+	if got, ok := eta(15, true, 12); !ok || got != 88*10*time.Minute {
+		t.Fatalf("got %v, %v, want %v", got, ok, 88*10*time.Minute)
+	}
+
+	// A pause of an hour drops the observations rather than counting
+	// towards the time per frame.
+	if _, ok := eta(20, false, 12); ok {
+		t.Fatal("estimate while paused, want none")
+	}
+	if _, ok := eta(80, true, 12); ok {
+		t.Fatal("estimate right after the pause, want none")
+	}
+	if _, ok := eta(85, true, 13); ok {
+		t.Fatal("estimate after the first frame boundary since the pause, want none")
+	}
+	if got, ok := eta(95, true, 14); !ok || got != 86*10*time.Minute {
+		t.Errorf("got %v, %v, want %v", got, ok, 86*10*time.Minute)
+	}
+
+	// Only the frame completed before the pause and the one after the
+	// first boundary since then are in the histogram, not the one spanning
+	// the pause.
+	frameTimes := h.frameTimeHistograms("localhost:36330", nil)["00"]
+	if frameTimes == nil || frameTimes.count != 2 || frameTimes.sum != 2*600 {
+		t.Errorf("got frame times %+v, want 2 of 600s", frameTimes)
+	}
+}
+
+func TestIsFolding(t *testing.T) {
+	for _, tt := range []struct {
+		unitState, slotStatus string
+		known, want           bool
+	}{
+		{"RUNNING", "RUNNING", true, true},
+		{"RUNNING", "FINISHING", true, true},
+		{"FINISHING", "RUNNING", true, true},
+		{"RUNNING", "PAUSED", true, false},
+		{"READY", "PAUSED", true, false},
+		{"PAUSED", "", false, false},
+		{"RUNNING", "", false, true},
+	} {
+		got := isFolding(fahclient.SlotQueueInfo{State: tt.unitState}, fahclient.SlotInfo{Status: tt.slotStatus}, tt.known)
+		if got != tt.want {
+			t.Errorf("isFolding(%s, %s, %v) = %v, want %v", tt.unitState, tt.slotStatus, tt.known, got, tt.want)
+		}
+	}
+}
+
+func TestClientHistoryExpiry(t *testing.T) {
+	h := NewFrameHistory()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	slots := []fahclient.SlotInfo{{ID: "00", Status: "RUNNING"}}
+	h.observeSlots("probed:36330", start, slots)
+	h.observeSlots("localhost:36330", start, slots)
+
+	// Clients that are still seen are kept, those that aren't are forgotten
+	// once the expiry has passed.
+	h.observeSlots("localhost:36330", start.Add(clientHistoryExpiry), slots)
+	h.observeSlots("localhost:36330", start.Add(clientHistoryExpiry+time.Minute), slots)
+	if _, ok := h.slotStates["probed:36330"]; ok {
+		t.Error("slot states of a client not seen since the expiry are kept")
+	}
+	if _, ok := h.slotStates["localhost:36330"]; !ok {
+		t.Error("slot states of a client still seen are gone")
+	}
+}
@@ -0,0 +1,58 @@
+package collector
+
+import "github.com/jtai/foldingathome_exporter/internal/fahclient"
+
+// histogram is a histogram kept across scrapes, exported with
+// prometheus.MustNewConstHistogram.
+type histogram struct {
+	// upperBounds are the upper bounds of the buckets, and buckets their
+	// cumulative counts.
+	upperBounds []float64
+	buckets     []uint64
+	count       uint64
+	sum         float64
+}
+
+func newHistogram(upperBounds []float64) *histogram {
+	return &histogram{upperBounds: upperBounds, buckets: make([]uint64, len(upperBounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+	for i, upperBound := range h.upperBounds {
+		if v <= upperBound {
+			h.buckets[i]++
+		}
+	}
+}
+
+// bucketCounts returns the buckets in the form of prometheus.MustNewConstHistogram.
+func (h *histogram) bucketCounts() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(h.upperBounds))
+	for i, upperBound := range h.upperBounds {
+		buckets[upperBound] = h.buckets[i]
+	}
+	return buckets
+}
+
+func (h *histogram) copy() *histogram {
+	c := *h
+	c.buckets = append([]uint64(nil), h.buckets...)
+	return &c
+}
+
+// copyHistograms returns a copy of histograms by slot ID, adding empty ones
+// with upperBounds for the slots in slotInfo that have none.
+func copyHistograms(histograms map[string]*histogram, slotInfo []fahclient.SlotInfo, upperBounds []float64) map[string]*histogram {
+	c := make(map[string]*histogram, len(histograms))
+	for slot, h := range histograms {
+		c[slot] = h.copy()
+	}
+	for _, slot := range slotInfo {
+		if _, ok := c[slot.ID]; !ok {
+			c[slot.ID] = newHistogram(upperBounds)
+		}
+	}
+	return c
+}
@@ -0,0 +1,158 @@
+package collector
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// historyState is the part of a FrameHistory that is kept across restarts of
+// the exporter: the counters and histograms, by client key. The frames and the
+// queues and slots last seen are stale by the time the exporter restarts.
+type historyState struct {
+	Clients map[string]clientCounters `json:"clients"`
+}
+
+type clientCounters struct {
+	WorkUnitsCompleted map[string]float64        `json:"work_units_completed"`
+	WorkUnitsFailed    []failureCount            `json:"work_units_failed"`
+	StateTransitions   []transitionCount         `json:"state_transitions"`
+	WorkUnitTurnaround map[string]histogramState `json:"work_unit_turnaround"`
+	FrameTimes         map[string]histogramState `json:"frame_times"`
+	UnknownSlotStatus  float64                   `json:"unknown_slot_status"`
+}
+
+// histogramState is a histogram. Buckets are the cumulative counts of the
+// upper bounds in UpperBounds, so that histograms written with other buckets
+// are recognized and dropped.
+type histogramState struct {
+	Count       uint64    `json:"count"`
+	Sum         float64   `json:"sum"`
+	UpperBounds []float64 `json:"upper_bounds"`
+	Buckets     []uint64  `json:"buckets"`
+}
+
+type failureCount struct {
+	Slot   string  `json:"slot"`
+	Reason string  `json:"reason"`
+	Count  float64 `json:"count"`
+}
+
+type transitionCount struct {
+	Slot  string  `json:"slot"`
+	From  string  `json:"from"`
+	To    string  `json:"to"`
+	Count float64 `json:"count"`
+}
+
+// WriteState writes the counters and histograms of the history to w as JSON.
+func (h *FrameHistory) WriteState(w io.Writer) error {
+	h.mtx.Lock()
+	state := historyState{Clients: map[string]clientCounters{}}
+	for clientKey, counts := range h.counts {
+		c := state.Clients[clientKey]
+		c.WorkUnitsCompleted = counts.completed
+		for f, n := range counts.failed {
+			c.WorkUnitsFailed = append(c.WorkUnitsFailed, failureCount{f.slot, f.reason, n})
+		}
+		c.WorkUnitTurnaround = histogramStates(counts.turnaround)
+		state.Clients[clientKey] = c
+	}
+	for clientKey, frameTimes := range h.frameTimes {
+		c := state.Clients[clientKey]
+		c.FrameTimes = histogramStates(frameTimes)
+		state.Clients[clientKey] = c
+	}
+	for clientKey, transitions := range h.transitions {
+		c := state.Clients[clientKey]
+		for t, n := range transitions {
+			c.StateTransitions = append(c.StateTransitions, transitionCount{t.slot, t.from, t.to, n})
+		}
+		state.Clients[clientKey] = c
+	}
+	for clientKey, n := range h.unknownStatus {
+		c := state.Clients[clientKey]
+		c.UnknownSlotStatus = n
+		state.Clients[clientKey] = c
+	}
+	b, err := json.Marshal(state)
+	h.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadState restores the counters and histograms written by WriteState,
+// replacing those of the history.
+func (h *FrameHistory) ReadState(r io.Reader) error {
+	var state historyState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.counts = map[string]queueCounts{}
+	h.transitions = map[string]map[transition]float64{}
+	h.frameTimes = map[string]map[string]*histogram{}
+	h.unknownStatus = map[string]float64{}
+	h.clients = map[string]time.Time{}
+	now := time.Now()
+	for clientKey, c := range state.Clients {
+		h.clients[clientKey] = now
+		counts := newQueueCounts()
+		for slot, n := range c.WorkUnitsCompleted {
+			counts.completed[slot] = n
+		}
+		for _, f := range c.WorkUnitsFailed {
+			counts.failed[failure{f.Slot, f.Reason}] = f.Count
+		}
+		counts.turnaround = restoreHistograms(c.WorkUnitTurnaround, turnaroundBuckets)
+		h.counts[clientKey] = counts
+
+		transitions := map[transition]float64{}
+		for _, t := range c.StateTransitions {
+			transitions[transition{t.Slot, t.From, t.To}] = t.Count
+		}
+		h.transitions[clientKey] = transitions
+
+		h.frameTimes[clientKey] = restoreHistograms(c.FrameTimes, frameTimeBuckets)
+		h.unknownStatus[clientKey] = c.UnknownSlotStatus
+	}
+	return nil
+}
+
+func histogramStates(histograms map[string]*histogram) map[string]histogramState {
+	states := make(map[string]histogramState, len(histograms))
+	for slot, h := range histograms {
+		states[slot] = histogramState{h.count, h.sum, h.upperBounds, h.buckets}
+	}
+	return states
+}
+
+// restoreHistograms returns the histograms in states by slot ID, leaving out
+// those with buckets other than upperBounds.
+func restoreHistograms(states map[string]histogramState, upperBounds []float64) map[string]*histogram {
+	histograms := map[string]*histogram{}
+	for slot, s := range states {
+		if !sameBuckets(s.UpperBounds, upperBounds) || len(s.Buckets) != len(upperBounds) {
+			continue
+		}
+		histograms[slot] = &histogram{upperBounds: upperBounds, buckets: s.Buckets, count: s.Count, sum: s.Sum}
+	}
+	return histograms
+}
+
+func sameBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
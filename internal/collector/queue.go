@@ -0,0 +1,375 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+type queueCollector struct {
+	clientKey string
+	frames    *FrameHistory
+
+	slotWorkUnits                      *prometheus.Desc
+	slotAttempts                       *prometheus.Desc
+	slotNextAttempt                    *prometheus.Desc
+	slotWaitingOn                      *prometheus.Desc
+	slotEstimatedPointsPerDay          *prometheus.Desc
+	slotWorkUnitsCompleted             *prometheus.Desc
+	slotWorkUnitsFailed                *prometheus.Desc
+	slotWorkUnitTurnaround             *prometheus.Desc
+	slotFrameTime                      *prometheus.Desc
+	workUnitInfo                       *prometheus.Desc
+	workUnitProgressRatio              *prometheus.Desc
+	workUnitCreditEstimatePoints       *prometheus.Desc
+	workUnitBaseCreditPoints           *prometheus.Desc
+	workUnitEstimatedCompletionSeconds *prometheus.Desc
+	workUnitEstimatedCompletionTime    *prometheus.Desc
+	workUnitTimeRemainingSeconds       *prometheus.Desc
+	workUnitAssignedTimestamp          *prometheus.Desc
+	workUnitTimeoutTimestamp           *prometheus.Desc
+	workUnitDeadlineTimestamp          *prometheus.Desc
+	workUnitETASmoothedSeconds         *prometheus.Desc
+}
+
+func newQueueCollector(clientKey string, frames *FrameHistory) *queueCollector {
+	return &queueCollector{
+		clientKey: clientKey,
+		frames:    frames,
+		slotWorkUnits: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "work_units"),
+			"Number of work units in the queue of the slot, which is more than one while the next work unit is downloaded ahead of time.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		slotAttempts: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "attempts"),
+			"Number of attempts to download a work unit.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		slotNextAttempt: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "next_attempt_seconds"),
+			"Seconds until the next attempt to download a work unit.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		slotWaitingOn: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "waiting_on"),
+			"What the slot is waiting on to make progress with a work unit, like a work server assignment, with a constant value of 1.",
+			[]string{"id", "slot_description", "waiting_on"},
+			nil,
+		),
+		slotEstimatedPointsPerDay: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "estimated_points_per_day"),
+			"Estimated number of points the slot can produce in a day.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		slotWorkUnitsCompleted: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "work_units_completed_total"),
+			"Number of work units the slot completed and returned to a work server.",
+			[]string{"id"},
+			nil,
+		),
+		slotWorkUnitsFailed: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "work_units_failed_total"),
+			"Number of work units of the slot that failed, by reason: the error reported by the client, or dumped.",
+			[]string{"id", "reason"},
+			nil,
+		),
+		slotWorkUnitTurnaround: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "work_unit_turnaround_seconds"),
+			"Time the slot took to complete work units, from their assignment, or from when they were first seen if the client doesn't tell, until they were seen finished.",
+			[]string{"id"},
+			nil,
+		),
+		slotFrameTime: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "frame_time_seconds"),
+			"Time the slot took to fold a frame of its work units, from the frames seen completed between scrapes.",
+			[]string{"id"},
+			nil,
+		),
+		workUnitInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "info"),
+			"Information about the work unit, with a constant value of 1: its project, run, clone and gen, the type of the FahCore that runs it, and the work server it was assigned by and the collection server it is returned to otherwise.",
+			[]string{"id", "slot_description", "unit_id", "prcg", "core", "ws", "cs"},
+			nil,
+		),
+		workUnitProgressRatio: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "progress_ratio"),
+			"Work unit completion, from 0 to 1.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitCreditEstimatePoints: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "credit_estimate_points"),
+			"Estimated number of points that will be credited for the work unit.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitBaseCreditPoints: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "base_credit_points"),
+			"Number of points that will be credited for the work unit without the quick return bonus.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitEstimatedCompletionSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "estimated_completion_seconds"),
+			"Estimated seconds until the work unit is completed.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitEstimatedCompletionTime: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "estimated_completion_timestamp_seconds"),
+			"Estimated time the work unit will be completed since unix epoch in seconds.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitTimeRemainingSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "time_remaining_seconds"),
+			"Seconds until the work unit's deadline, after which the work unit is expired and will be discarded by the client.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitAssignedTimestamp: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "assigned_timestamp_seconds"),
+			"Time the work unit was assigned to the client since unix epoch in seconds.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitTimeoutTimestamp: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "timeout_timestamp_seconds"),
+			"Time of the work unit's preferred deadline since unix epoch in seconds, after which it is worth less points.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitDeadlineTimestamp: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "deadline_timestamp_seconds"),
+			"Time of the work unit's deadline since unix epoch in seconds, after which the work unit is expired and will be discarded by the client.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		workUnitETASmoothedSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "eta_smoothed_seconds"),
+			"Estimated seconds until the work unit is completed, extrapolated from the time per frame observed over the last frames.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+	}
+}
+
+func (c *queueCollector) Name() string { return "queue-info" }
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.slotWorkUnits
+	ch <- c.slotAttempts
+	ch <- c.slotNextAttempt
+	ch <- c.slotWaitingOn
+	ch <- c.slotEstimatedPointsPerDay
+	ch <- c.slotWorkUnitsCompleted
+	ch <- c.slotWorkUnitsFailed
+	ch <- c.slotWorkUnitTurnaround
+	ch <- c.slotFrameTime
+	ch <- c.workUnitInfo
+	ch <- c.workUnitProgressRatio
+	ch <- c.workUnitCreditEstimatePoints
+	ch <- c.workUnitBaseCreditPoints
+	ch <- c.workUnitEstimatedCompletionSeconds
+	ch <- c.workUnitEstimatedCompletionTime
+	ch <- c.workUnitTimeRemainingSeconds
+	ch <- c.workUnitAssignedTimestamp
+	ch <- c.workUnitTimeoutTimestamp
+	ch <- c.workUnitDeadlineTimestamp
+	ch <- c.workUnitETASmoothedSeconds
+}
+
+// Update exports the work units in the queue, labeled with the slots they are
+// assigned to and their ID in the queue. Which work unit it is, by project,
+// run, clone and gen, is only a label of foldingathome_work_unit_info, so that
+// the other metrics don't start new series for every work unit.
+func (c *queueCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	queueInfo, err := client.QueueInfo()
+	if err != nil {
+		return err
+	}
+	// Without slot-info, work units are exported without the slot.
+	slotInfo, _ := client.SlotInfo()
+
+	slotMap := map[string]fahclient.SlotInfo{}
+	workUnits := map[string]int{}
+	for _, sInfo := range slotInfo {
+		slotMap[sInfo.ID] = sInfo
+		workUnits[sInfo.ID] = 0
+	}
+	for _, qInfo := range queueInfo {
+		// Work units of slots slot-info didn't list, or of all slots if it
+		// failed, aren't counted rather than counted under no slot.
+		if _, ok := slotMap[qInfo.Slot]; ok {
+			workUnits[qInfo.Slot]++
+		}
+	}
+	for slot, n := range workUnits {
+		ch <- prometheus.MustNewConstMetric(c.slotWorkUnits, prometheus.GaugeValue, float64(n), slot, slotMap[slot].Description)
+	}
+	now := time.Now()
+	counts := c.frames.observeQueue(c.clientKey, now, slotInfo, queueInfo)
+	for slot, n := range counts.completed {
+		ch <- prometheus.MustNewConstMetric(c.slotWorkUnitsCompleted, prometheus.CounterValue, n, slot)
+	}
+	for f, n := range counts.failed {
+		ch <- prometheus.MustNewConstMetric(c.slotWorkUnitsFailed, prometheus.CounterValue, n, f.slot, f.reason)
+	}
+	for slot, t := range counts.turnaround {
+		ch <- prometheus.MustNewConstHistogram(c.slotWorkUnitTurnaround, t.count, t.sum, t.bucketCounts(), slot)
+	}
+
+	// waitingOn holds what the slots were seen waiting on, as work units of
+	// the same slot may be waiting on the same thing.
+	waitingOn := map[[2]string]bool{}
+	for _, qInfo := range queueInfo {
+		id := slotMap[qInfo.Slot].ID
+		desc := slotMap[qInfo.Slot].Description
+		prcg := fmt.Sprintf("%d (%d, %d, %d)", qInfo.Project, qInfo.Run, qInfo.Clone, qInfo.Gen)
+		state := strings.ToLower(qInfo.State)
+
+		if state == "download" {
+			ch <- prometheus.MustNewConstMetric(c.slotAttempts, prometheus.GaugeValue, float64(qInfo.Attempts), id, desc)
+			ch <- prometheus.MustNewConstMetric(c.slotNextAttempt, prometheus.GaugeValue, qInfo.NextAttempt.Seconds(), id, desc)
+		}
+
+		if qInfo.WaitingOn != "" && !waitingOn[[2]string{id, qInfo.WaitingOn}] {
+			waitingOn[[2]string{id, qInfo.WaitingOn}] = true
+			ch <- prometheus.MustNewConstMetric(c.slotWaitingOn, prometheus.GaugeValue, 1, id, desc, qInfo.WaitingOn)
+		}
+
+		if state == "running" || state == "finishing" {
+			ch <- prometheus.MustNewConstMetric(c.slotEstimatedPointsPerDay, prometheus.GaugeValue, float64(qInfo.PPD), id, desc)
+		}
+
+		if isWorkUnit(qInfo) {
+			// FAHClient reports a work unit without a collection server with
+			// a cs of 0.0.0.0.
+			cs := qInfo.CS
+			if cs == "0.0.0.0" {
+				cs = ""
+			}
+			ch <- prometheus.MustNewConstMetric(c.workUnitInfo, prometheus.GaugeValue, 1, id, desc, qInfo.ID, prcg, strings.ToLower(qInfo.Core), qInfo.WS, cs)
+
+			if percentDone, ok := parsePercentDone(qInfo); ok {
+				ch <- prometheus.MustNewConstMetric(c.workUnitProgressRatio, prometheus.GaugeValue, percentDone/100, id, desc, qInfo.ID)
+			}
+
+			ch <- prometheus.MustNewConstMetric(c.workUnitCreditEstimatePoints, prometheus.GaugeValue, float64(qInfo.CreditEstimate), id, desc, qInfo.ID)
+			ch <- prometheus.MustNewConstMetric(c.workUnitBaseCreditPoints, prometheus.GaugeValue, float64(qInfo.BaseCredit), id, desc, qInfo.ID)
+			ch <- prometheus.MustNewConstMetric(c.workUnitEstimatedCompletionSeconds, prometheus.GaugeValue, qInfo.ETA.Seconds(), id, desc, qInfo.ID)
+			// A work unit that isn't being folded has no ETA.
+			if qInfo.ETA > 0 {
+				ch <- prometheus.MustNewConstMetric(c.workUnitEstimatedCompletionTime, prometheus.GaugeValue, float64(now.Add(qInfo.ETA).Unix()), id, desc, qInfo.ID)
+			}
+			ch <- prometheus.MustNewConstMetric(c.workUnitTimeRemainingSeconds, prometheus.GaugeValue, qInfo.TimeRemaining.Seconds(), id, desc, qInfo.ID)
+			if !qInfo.Assigned.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.workUnitAssignedTimestamp, prometheus.GaugeValue, float64(qInfo.Assigned.Unix()), id, desc, qInfo.ID)
+			}
+			if !qInfo.Timeout.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.workUnitTimeoutTimestamp, prometheus.GaugeValue, float64(qInfo.Timeout.Unix()), id, desc, qInfo.ID)
+			}
+			if !qInfo.Deadline.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.workUnitDeadlineTimestamp, prometheus.GaugeValue, float64(qInfo.Deadline.Unix()), id, desc, qInfo.ID)
+			}
+
+			slot, known := slotMap[qInfo.Slot]
+			if eta, ok := c.frames.smoothedETA(c.clientKey, qInfo.Slot, c.clientKey+"/"+qInfo.Slot+"/"+qInfo.ID+"/"+prcg, now, isFolding(qInfo, slot, known), qInfo.FramesDone, qInfo.TotalFrames); ok {
+				ch <- prometheus.MustNewConstMetric(c.workUnitETASmoothedSeconds, prometheus.GaugeValue, eta.Seconds(), id, desc, qInfo.ID)
+			}
+		}
+	}
+	for slot, h := range c.frames.frameTimeHistograms(c.clientKey, slotInfo) {
+		ch <- prometheus.MustNewConstHistogram(c.slotFrameTime, h.count, h.sum, h.bucketCounts(), slot)
+	}
+	return nil
+}
+
+// isFolding returns whether a work unit is being folded: it is running or
+// finishing, and so is its slot, if known.
+func isFolding(qInfo fahclient.SlotQueueInfo, slot fahclient.SlotInfo, known bool) bool {
+	switch strings.ToLower(qInfo.State) {
+	case "running", "finishing":
+	default:
+		return false
+	}
+	if !known {
+		return true
+	}
+	switch slotState(slot.Status) {
+	case "running", "finishing":
+		return true
+	}
+	return false
+}
+
+// isWorkUnit returns whether a queue entry holds a work unit, rather than
+// being empty while one is requested.
+func isWorkUnit(qInfo fahclient.SlotQueueInfo) bool {
+	return !(qInfo.Project == 0 && qInfo.Run == 0 && qInfo.Clone == 0 && qInfo.Gen == 0)
+}
+
+// parsePercentDone returns the completion percentage of a work unit.
+func parsePercentDone(qInfo fahclient.SlotQueueInfo) (float64, bool) {
+	percentDone, err := strconv.ParseFloat(strings.TrimSuffix(qInfo.PercentDone, "%"), 64)
+	return percentDone, err == nil
+}
+
+// stepsCompletedPercentCollector exports the completion of work units as a
+// percentage, as the exporter did before foldingathome_work_unit_progress_ratio,
+// so that existing dashboards keep working while they are migrated.
+type stepsCompletedPercentCollector struct {
+	percent *prometheus.Desc
+}
+
+// NewStepsCompletedPercentCollector returns a collector exporting the
+// completion of work units as a percentage.
+func NewStepsCompletedPercentCollector() Collector {
+	return &stepsCompletedPercentCollector{
+		percent: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemWorkUnit, "steps_completed_percent"),
+			"Work unit completion percentage. Superseded by foldingathome_work_unit_progress_ratio.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+	}
+}
+
+func (c *stepsCompletedPercentCollector) Name() string { return "steps-completed-percent" }
+
+func (c *stepsCompletedPercentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.percent
+}
+
+func (c *stepsCompletedPercentCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	queueInfo, err := client.QueueInfo()
+	if err != nil {
+		return err
+	}
+	slotInfo, _ := client.SlotInfo()
+
+	slotMap := map[string]fahclient.SlotInfo{}
+	for _, sInfo := range slotInfo {
+		slotMap[sInfo.ID] = sInfo
+	}
+	for _, qInfo := range queueInfo {
+		if !isWorkUnit(qInfo) {
+			continue
+		}
+		if percentDone, ok := parsePercentDone(qInfo); ok {
+			ch <- prometheus.MustNewConstMetric(c.percent, prometheus.GaugeValue, percentDone, slotMap[qInfo.Slot].ID, slotMap[qInfo.Slot].Description, qInfo.ID)
+		}
+	}
+	return nil
+}
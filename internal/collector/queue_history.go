@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// unitSighting is the last sighting of a work unit in the queue of a slot.
+type unitSighting struct {
+	slot string
+	// done is whether the work unit was seen finished, on its way back to
+	// the work server, and failed whether it was seen dumped or faulty.
+	done   bool
+	failed bool
+	// start is when the work unit was assigned, or first seen if the client
+	// doesn't tell, and finished when it was first seen finished. start is
+	// zero if neither is known, for a work unit already in the queue on the
+	// first call for the client.
+	start    time.Time
+	finished time.Time
+}
+
+// turnaroundBuckets are the upper bounds in seconds of the buckets of the
+// turnaround histograms, from an hour to the deadlines of most projects.
+var turnaroundBuckets = []float64{
+	1 * 3600, 2 * 3600, 4 * 3600, 8 * 3600, 12 * 3600,
+	1 * 86400, 2 * 86400, 3 * 86400, 5 * 86400, 7 * 86400, 10 * 86400,
+}
+
+// failure identifies the work units of a slot that failed for a reason.
+type failure struct {
+	slot, reason string
+}
+
+// queueCounts are the work units counted by observeQueue for a client.
+type queueCounts struct {
+	// completed counts the work units completed by slot ID.
+	completed map[string]float64
+	// failed counts the work units that failed by slot ID and reason.
+	failed map[failure]float64
+	// turnaround holds the turnaround of the completed work units by slot ID.
+	turnaround map[string]*histogram
+}
+
+func newQueueCounts() queueCounts {
+	return queueCounts{
+		completed:  map[string]float64{},
+		failed:     map[failure]float64{},
+		turnaround: map[string]*histogram{},
+	}
+}
+
+// observeQueue records the work units in the queue of the client identified by
+// clientKey and returns the counts of work units completed and failed so far. Work
+// units that left the queue since the last call are counted as completed if
+// they were seen finished; those that finished and left the queue between two
+// calls are missed. Work units are counted as failed when they are first seen
+// dumped or with an error, except on the first call for the client, which
+// only tells the state they were already in. The turnaround of a completed
+// work unit runs from its assignment, or from when it was first seen if the
+// client doesn't tell, to when it was first seen finished.
+func (h *FrameHistory) observeQueue(clientKey string, now time.Time, slotInfo []fahclient.SlotInfo, queueInfo []fahclient.SlotQueueInfo) queueCounts {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.seen(clientKey, now)
+
+	counts, ok := h.counts[clientKey]
+	if !ok {
+		counts = newQueueCounts()
+		h.counts[clientKey] = counts
+	}
+	for _, slot := range slotInfo {
+		if _, ok := counts.completed[slot.ID]; !ok {
+			counts.completed[slot.ID] = 0
+		}
+	}
+
+	previous, seen := h.queues[clientKey]
+	queue := map[string]unitSighting{}
+	for _, q := range queueInfo {
+		if !isWorkUnit(q) {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s/%d (%d, %d, %d)", q.Slot, q.ID, q.Project, q.Run, q.Clone, q.Gen)
+		reason := failureReason(q)
+		last, ok := previous[key]
+		u := unitSighting{slot: q.Slot, done: isFinished(q), failed: reason != ""}
+		if u.failed && seen && !last.failed {
+			counts.failed[failure{q.Slot, reason}]++
+		}
+		switch {
+		case ok:
+			u.start, u.finished = last.start, last.finished
+		case !q.Assigned.IsZero():
+			u.start = q.Assigned
+		case seen:
+			u.start = now
+		}
+		if u.done && u.finished.IsZero() {
+			u.finished = now
+		}
+		queue[key] = u
+	}
+	for key, u := range previous {
+		if _, ok := queue[key]; ok || !u.done {
+			continue
+		}
+		counts.completed[u.slot]++
+		if !u.start.IsZero() {
+			t, ok := counts.turnaround[u.slot]
+			if !ok {
+				t = newHistogram(turnaroundBuckets)
+				counts.turnaround[u.slot] = t
+			}
+			t.observe(u.finished.Sub(u.start).Seconds())
+		}
+	}
+	h.queues[clientKey] = queue
+
+	snapshot := newQueueCounts()
+	for slot, n := range counts.completed {
+		snapshot.completed[slot] = n
+	}
+	for f, n := range counts.failed {
+		snapshot.failed[f] = n
+	}
+	snapshot.turnaround = copyHistograms(counts.turnaround, slotInfo, turnaroundBuckets)
+	return snapshot
+}
+
+// isFinished returns whether a work unit is done folding and not dumped.
+func isFinished(q fahclient.SlotQueueInfo) bool {
+	if failureReason(q) != "" {
+		return false
+	}
+	switch strings.ToLower(q.State) {
+	case "finishing", "send", "done":
+		return true
+	}
+	percentDone, ok := parsePercentDone(q)
+	return ok && percentDone >= 100
+}
+
+// failureReason returns why a work unit failed, the error reported by the
+// client, like faulty or bad_work_unit, or dumped for a work unit dumped
+// without one. It returns the empty string for a work unit that didn't fail.
+func failureReason(q fahclient.SlotQueueInfo) string {
+	if err := workUnitError(q); err != "" {
+		return strings.ToLower(err)
+	}
+	if strings.ToLower(q.State) == "dump" {
+		return "dumped"
+	}
+	return ""
+}
+
+// workUnitError returns the error of a work unit, or the empty string if it
+// has none, which v7 clients report as NO_ERROR.
+func workUnitError(q fahclient.SlotQueueInfo) string {
+	if q.Error == "NO_ERROR" {
+		return ""
+	}
+	return q.Error
+}
@@ -0,0 +1,304 @@
+package collector
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slotStatuses encodes the status of a slot numerically.
+var slotStatuses = map[string]float64{
+	"ready":     1,
+	"download":  2,
+	"running":   3,
+	"upload":    4,
+	"finishing": 5,
+	"stopping":  6,
+	"paused":    7,
+	"failed":    8,
+	"offline":   9,
+}
+
+// gpuSlotDescriptionRegexp matches the description of a GPU slot, like
+// "gpu:0:TU104 [GeForce RTX 2080]", capturing the GPU index and the device.
+var gpuSlotDescriptionRegexp = regexp.MustCompile(`^gpu:(\d+):(.*)$`)
+
+// gpuModelRegexp matches the marketing name of a GPU in brackets, which
+// follows the name of its chip.
+var gpuModelRegexp = regexp.MustCompile(`\[(.+)\]`)
+
+// parseSlotDescription returns the type of a slot, cpu or gpu, and for a GPU
+// slot the index and model of its GPU, from its description. Parts that can't
+// be determined are empty.
+func parseSlotDescription(description string) (slotType, gpuIndex, device string) {
+	if m := gpuSlotDescriptionRegexp.FindStringSubmatch(description); m != nil {
+		device = strings.TrimSpace(m[2])
+		if model := gpuModelRegexp.FindStringSubmatch(device); model != nil {
+			device = model[1]
+		}
+		return "gpu", m[1], device
+	}
+	// v8 describes the CPUs and GPUs of a resource group together, like
+	// "cpu:8 gpu:01:00:00:...", which is a GPU slot for the purpose of
+	// aggregating by type.
+	switch {
+	case strings.HasPrefix(description, "gpu:") || strings.Contains(description, " gpu:"):
+		return "gpu", "", ""
+	case strings.HasPrefix(description, "cpu:"):
+		return "cpu", "", ""
+	}
+	return "", "", ""
+}
+
+// slotExtraStates are the states slots are reported in by state, in addition
+// to those of slotStatuses.
+var slotExtraStates = []string{"unknown"}
+
+// slotState returns the state a slot with the given status is reported in by
+// state: the status, or unknown for a status the exporter doesn't know.
+func slotState(status string) string {
+	status = strings.ToLower(status)
+	if _, ok := slotStatuses[status]; ok {
+		return status
+	}
+	for _, state := range slotExtraStates {
+		if status == state {
+			return status
+		}
+	}
+	return "unknown"
+}
+
+// slotStates returns all states slots are reported in by state.
+func slotStates() []string {
+	states := make([]string, 0, len(slotStatuses)+len(slotExtraStates))
+	for state := range slotStatuses {
+		states = append(states, state)
+	}
+	return append(states, slotExtraStates...)
+}
+
+type slotCollector struct {
+	clientKey string
+	frames    *FrameHistory
+
+	info          *prometheus.Desc
+	status        *prometheus.Desc
+	idle          *prometheus.Desc
+	slots         *prometheus.Desc
+	total         *prometheus.Desc
+	unknownStatus *prometheus.Desc
+	transitions   *prometheus.Desc
+	logger        log.Logger
+}
+
+func newSlotCollector(clientKey string, frames *FrameHistory, logger log.Logger) *slotCollector {
+	return &slotCollector{
+		clientKey: clientKey,
+		frames:    frames,
+		info: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "info"),
+			"Information about the slot parsed from its description, with a constant value of 1: its type, and the index and model of its GPU.",
+			[]string{"id", "slot_description", "type", "gpu_index", "device"},
+			nil,
+		),
+		status: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "status"),
+			"The status of the slot, encoded numerically: 0 => unknown, 1 => ready, 2 => download, 3 => running, 4 => upload, 5 => finishing, 6 => stopping, 7 => paused, 8 => failed, 9 => offline.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		idle: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "idle"),
+			"Whether the slot is in idle-only folding mode, in which it only folds while the machine is idle.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		slots: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "slots"),
+			"Number of slots by status.",
+			[]string{"state"},
+			nil,
+		),
+		total: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "slots_configured"),
+			"Number of slots configured in the FAHClient.",
+			nil,
+			nil,
+		),
+		unknownStatus: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "unknown_status_total"),
+			"Number of times a slot entered a status the exporter doesn't know, which is exported as 0.",
+			nil,
+			nil,
+		),
+		transitions: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "state_transitions_total"),
+			"Number of times the slot was seen changing from one state to another.",
+			[]string{"id", "from", "to"},
+			nil,
+		),
+		logger: logger,
+	}
+}
+
+func (c *slotCollector) Name() string { return "slot-info" }
+
+func (c *slotCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.status
+	ch <- c.idle
+	ch <- c.slots
+	ch <- c.total
+	ch <- c.unknownStatus
+	ch <- c.transitions
+}
+
+func (c *slotCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	slotInfo, err := client.SlotInfo()
+	if err != nil {
+		return err
+	}
+	counts := map[string]int{}
+	for _, info := range slotInfo {
+		slotType, gpuIndex, device := parseSlotDescription(info.Description)
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, info.ID, info.Description, slotType, gpuIndex, device)
+
+		status := slotStatuses[strings.ToLower(info.Status)]
+		ch <- prometheus.MustNewConstMetric(c.status, prometheus.GaugeValue, status, info.ID, info.Description)
+		ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, boolValue(info.Idle), info.ID, info.Description)
+		counts[slotState(info.Status)]++
+	}
+	for _, state := range slotStates() {
+		ch <- prometheus.MustNewConstMetric(c.slots, prometheus.GaugeValue, float64(counts[state]), state)
+	}
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(len(slotInfo)))
+
+	slotCounts := c.frames.observeSlots(c.clientKey, time.Now(), slotInfo)
+	// Slots entering an unknown status are logged, so that statuses of new
+	// client versions get noticed rather than silently exported as 0.
+	for _, slot := range slotCounts.entered {
+		level.Warn(c.logger).Log("msg", "Unknown slot status", "slot", slot.ID, "status", slot.Status)
+	}
+	ch <- prometheus.MustNewConstMetric(c.unknownStatus, prometheus.CounterValue, slotCounts.unknownStatus)
+	for t, n := range slotCounts.transitions {
+		ch <- prometheus.MustNewConstMetric(c.transitions, prometheus.CounterValue, n, t.slot, t.from, t.to)
+	}
+	return nil
+}
+
+// slotOptionsCollector exports the configuration of each slot, so that it can
+// be monitored alongside the state of the slot.
+type slotOptionsCollector struct {
+	cpus       *prometheus.Desc
+	paused     *prometheus.Desc
+	idle       *prometheus.Desc
+	clientType *prometheus.Desc
+}
+
+func newSlotOptionsCollector() *slotOptionsCollector {
+	return &slotOptionsCollector{
+		cpus: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "option_cpus"),
+			"Number of CPU threads the slot is configured to use.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		paused: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "option_paused"),
+			"Whether the slot is configured to be paused.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		idle: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "option_idle"),
+			"Whether the slot is configured to only fold while the machine is idle.",
+			[]string{"id", "slot_description"},
+			nil,
+		),
+		clientType: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "option_client_type"),
+			"The client type the slot is configured with, which selects the work units it is assigned, with a constant value of 1.",
+			[]string{"id", "slot_description", "client_type"},
+			nil,
+		),
+	}
+}
+
+func (c *slotOptionsCollector) Name() string { return "slot-options" }
+
+func (c *slotOptionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpus
+	ch <- c.paused
+	ch <- c.idle
+	ch <- c.clientType
+}
+
+func (c *slotOptionsCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	slotOptions, err := client.SlotOptions()
+	if err != nil {
+		return err
+	}
+	slotInfo, err := client.SlotInfo()
+	if err != nil {
+		return err
+	}
+	for _, info := range slotInfo {
+		options, ok := slotOptions[info.ID]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.cpus, prometheus.GaugeValue, float64(options.CPUs), info.ID, info.Description)
+		ch <- prometheus.MustNewConstMetric(c.paused, prometheus.GaugeValue, boolValue(options.Paused), info.ID, info.Description)
+		ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, boolValue(options.Idle), info.ID, info.Description)
+		if options.ClientType != "" {
+			ch <- prometheus.MustNewConstMetric(c.clientType, prometheus.GaugeValue, 1, info.ID, info.Description, options.ClientType)
+		}
+	}
+	return nil
+}
+
+// slotStateCollector exports the status of each slot as one series per state,
+// set to 1 for the current state and 0 for the others, which is easier to use
+// in PromQL than the numeric encoding of foldingathome_slot_status.
+type slotStateCollector struct {
+	state *prometheus.Desc
+}
+
+// NewSlotStateCollector returns a collector exporting the status of each slot
+// as a state set.
+func NewSlotStateCollector() Collector {
+	return &slotStateCollector{
+		state: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystemSlot, "state"),
+			"Whether the slot is in the state.",
+			[]string{"id", "slot_description", "state"},
+			nil,
+		),
+	}
+}
+
+func (c *slotStateCollector) Name() string { return "slot-state" }
+
+func (c *slotStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+}
+
+func (c *slotStateCollector) Update(ctx context.Context, client Client, ch chan<- prometheus.Metric) error {
+	slotInfo, err := client.SlotInfo()
+	if err != nil {
+		return err
+	}
+	for _, info := range slotInfo {
+		current := slotState(info.Status)
+		for _, state := range slotStates() {
+			ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, boolValue(state == current), info.ID, info.Description, state)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package collector
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// transition identifies the changes of the state of a slot from one state to
+// another.
+type transition struct {
+	slot, from, to string
+}
+
+// slotCounts are the changes of the slots of a client counted by observeSlots.
+type slotCounts struct {
+	// transitions counts the changes from one state to another.
+	transitions map[transition]float64
+	// unknownStatus counts the times a slot entered a status the exporter
+	// doesn't know.
+	unknownStatus float64
+	// entered holds the slots that entered a status the exporter doesn't
+	// know since the last call.
+	entered []fahclient.SlotInfo
+}
+
+// observeSlots records the statuses of the slots of the client identified by
+// clientKey and returns the number of times each slot was seen changing from
+// one state to another, and entering a status the exporter doesn't know.
+// Changes between two calls that end in the status the slot started in are
+// missed.
+func (h *FrameHistory) observeSlots(clientKey string, now time.Time, slotInfo []fahclient.SlotInfo) slotCounts {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.seen(clientKey, now)
+
+	transitions, ok := h.transitions[clientKey]
+	if !ok {
+		transitions = map[transition]float64{}
+		h.transitions[clientKey] = transitions
+	}
+	previous, ok := h.slotStates[clientKey]
+	if !ok {
+		previous = map[string]string{}
+	}
+	var entered []fahclient.SlotInfo
+	statuses := make(map[string]string, len(slotInfo))
+	for _, slot := range slotInfo {
+		status := strings.ToLower(slot.Status)
+		last, seen := previous[slot.ID]
+		if seen && slotState(last) != slotState(status) {
+			transitions[transition{slot.ID, slotState(last), slotState(status)}]++
+		}
+		if _, known := slotStatuses[status]; !known && (!seen || last != status) {
+			h.unknownStatus[clientKey]++
+			entered = append(entered, slot)
+		}
+		statuses[slot.ID] = status
+	}
+	h.slotStates[clientKey] = statuses
+
+	snapshot := slotCounts{
+		transitions:   make(map[transition]float64, len(transitions)),
+		unknownStatus: h.unknownStatus[clientKey],
+		entered:       entered,
+	}
+	for t, n := range transitions {
+		snapshot.transitions[t] = n
+	}
+	return snapshot
+}
@@ -0,0 +1,411 @@
+// Package fahclient implements the command protocol of Folding@home v7
+// clients (FAHClient), which answer commands on a telnet port with text and
+// PyON messages.
+package fahclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Banner is the greeting FAHClient sends on every new command connection.
+const Banner = "Welcome to the Folding@home Client command server."
+
+// prompt ends the output of every command.
+var prompt = []byte("\n> ")
+
+// Client is a connection to the command port of a FAHClient.
+type Client struct {
+	conn        net.Conn
+	r           *bufio.Reader
+	readTimeout time.Duration
+	deadline    time.Time
+}
+
+// Dial connects to the FAHClient at address and reads its greeting. The
+// greeting and the output of every command must arrive within readTimeout.
+// Zero timeouts mean no timeout. The deadline of ctx, if any, applies until
+// it is replaced with SetDeadline.
+func Dial(ctx context.Context, address string, dialTimeout, readTimeout time.Duration) (*Client, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(ctx, conn, readTimeout)
+}
+
+// NewClient reads the greeting of the FAHClient on conn, which was connected
+// by other means than Dial, like through a tunnel. Like Dial, it closes conn
+// if it fails.
+func NewClient(ctx context.Context, conn net.Conn, readTimeout time.Duration) (*Client, error) {
+	c := &Client{conn: conn, r: bufio.NewReader(conn), readTimeout: readTimeout}
+	if d, ok := ctx.Deadline(); ok {
+		c.deadline = d
+	}
+
+	if err := c.conn.SetDeadline(c.commandDeadline()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	greeting, err := c.readOutput()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.Contains(greeting, Banner) {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting from FAHClient: %q", strings.TrimSpace(greeting))
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Stale reports whether the connection was closed by the client, or has
+// output pending that no command asked for, since the last command.
+func (c *Client) Stale() bool {
+	if c.r.Buffered() > 0 {
+		return true
+	}
+	// A deadline in the past would fail the read without looking at the
+	// connection.
+	if err := c.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return true
+	}
+	_, err := c.r.Peek(1)
+	if err := c.conn.SetReadDeadline(c.deadline); err != nil {
+		return true
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
+
+// SetDeadline sets the deadline for all following commands and updates,
+// which applies in addition to the read timeout of each command.
+func (c *Client) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.conn.SetDeadline(t)
+}
+
+// commandDeadline returns the deadline for a command started now.
+func (c *Client) commandDeadline() time.Time {
+	if c.readTimeout <= 0 {
+		return c.deadline
+	}
+	t := time.Now().Add(c.readTimeout)
+	if !c.deadline.IsZero() && c.deadline.Before(t) {
+		return c.deadline
+	}
+	return t
+}
+
+// Exec runs a command and returns its output, without the trailing prompt.
+func (c *Client) Exec(command string) (string, error) {
+	if strings.ContainsAny(command, "\r\n") {
+		return "", fmt.Errorf("command %q contains a newline", command)
+	}
+	if err := c.conn.SetDeadline(c.commandDeadline()); err != nil {
+		return "", err
+	}
+	if _, err := c.conn.Write([]byte(command + "\n")); err != nil {
+		return "", err
+	}
+	return c.readOutput()
+}
+
+// Eval evaluates an expression such as "$(date)" and returns the result.
+func (c *Client) Eval(expr string) (string, error) {
+	out, err := c.Exec(`eval "` + expr + `\n"`)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// readOutput reads up to and including the next prompt.
+func (c *Client) readOutput() (string, error) {
+	var out []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		out = append(out, b)
+		if bytes.HasSuffix(out, prompt) {
+			return string(out[:len(out)-len(prompt)+1]), nil
+		}
+	}
+}
+
+// pyon runs a command and decodes the PyON message it responds with, which
+// must have the given name.
+func (c *Client) pyon(command, name string) (interface{}, error) {
+	out, err := c.Exec(command)
+	if err != nil {
+		return nil, err
+	}
+	msgName, v, err := ParseMessage(out)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", command, err)
+	}
+	if msgName != name {
+		return nil, fmt.Errorf("%s: unexpected PyON message %q", command, msgName)
+	}
+	return v, nil
+}
+
+// Info returns the sections of the info command. Each section is a list
+// starting with its name, followed by [key, value] pairs.
+func (c *Client) Info() ([][]interface{}, error) {
+	v, err := c.pyon("info", "info")
+	if err != nil {
+		return nil, err
+	}
+	return toInfo(v)
+}
+
+func toInfo(v interface{}) ([][]interface{}, error) {
+	sections, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("info: expected list, got %T", v)
+	}
+
+	info := make([][]interface{}, 0, len(sections))
+	for _, s := range sections {
+		section, ok := s.([]interface{})
+		if !ok || len(section) == 0 {
+			return nil, fmt.Errorf("info: malformed section %v", s)
+		}
+		if _, ok := section[0].(string); !ok {
+			return nil, fmt.Errorf("info: malformed section name %v", section[0])
+		}
+		info = append(info, section)
+	}
+	return info, nil
+}
+
+// InfoValue looks up a key in the named section of an info response.
+func InfoValue(info [][]interface{}, section, key string) (string, bool) {
+	for _, s := range info {
+		if len(s) == 0 || s[0] != section {
+			continue
+		}
+		for _, pairs := range s[1:] {
+			typedPairs, ok := pairs.([]interface{})
+			if !ok || len(typedPairs) < 2 || typedPairs[0] != key {
+				continue
+			}
+			value, ok := typedPairs[1].(string)
+			return value, ok
+		}
+	}
+	return "", false
+}
+
+// Uptime returns the time since the client started.
+func (c *Client) Uptime() (time.Duration, error) {
+	out, err := c.Eval("$(uptime)")
+	if err != nil {
+		return 0, err
+	}
+	return ParseDuration(out)
+}
+
+// SlotInfo returns the slots of the client.
+func (c *Client) SlotInfo() ([]SlotInfo, error) {
+	v, err := c.pyon("slot-info", "slots")
+	if err != nil {
+		return nil, err
+	}
+	return toSlotInfo(v)
+}
+
+func toSlotInfo(v interface{}) ([]SlotInfo, error) {
+	slots, err := dicts(v)
+	if err != nil {
+		return nil, fmt.Errorf("slot-info: %w", err)
+	}
+
+	slotInfo := make([]SlotInfo, 0, len(slots))
+	for _, slot := range slots {
+		f := fields(slot)
+		s := SlotInfo{
+			ID:          f.string("id"),
+			Status:      f.string("status"),
+			Description: f.string("description"),
+			Reason:      f.string("reason"),
+			Idle:        f.bool("idle"),
+		}
+		if f.err != nil {
+			return nil, fmt.Errorf("slot-info: %w", f.err)
+		}
+		slotInfo = append(slotInfo, s)
+	}
+	return slotInfo, nil
+}
+
+// optionNames are the options queried by Options.
+var optionNames = []string{"user", "team", "passkey", "power", "cause"}
+
+// Options returns the options of the client.
+func (c *Client) Options() (Options, error) {
+	v, err := c.pyon("options "+strings.Join(optionNames, " "), "options")
+	if err != nil {
+		return Options{}, err
+	}
+	return toOptions(v)
+}
+
+func toOptions(v interface{}) (Options, error) {
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return Options{}, fmt.Errorf("options: expected dict, got %T", v)
+	}
+	f := fields(d)
+	o := Options{
+		User:    f.string("user"),
+		Team:    f.string("team"),
+		Passkey: f.string("passkey"),
+		Power:   f.string("power"),
+		Cause:   f.string("cause"),
+	}
+	if f.err != nil {
+		return Options{}, fmt.Errorf("options: %w", f.err)
+	}
+	return o, nil
+}
+
+// slotOptionNames are the slot options queried by SlotOptions.
+var slotOptionNames = []string{"cpus", "client-type", "idle", "paused"}
+
+// SlotOptions returns the options of the slot with the given id.
+func (c *Client) SlotOptions(id string) (SlotOptions, error) {
+	if strings.ContainsAny(id, " \t") {
+		return SlotOptions{}, fmt.Errorf("invalid slot id %q", id)
+	}
+	v, err := c.pyon("slot-options "+id+" "+strings.Join(slotOptionNames, " "), "slot-options")
+	if err != nil {
+		return SlotOptions{}, err
+	}
+	return toSlotOptions(v)
+}
+
+func toSlotOptions(v interface{}) (SlotOptions, error) {
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return SlotOptions{}, fmt.Errorf("slot-options: expected dict, got %T", v)
+	}
+	f := fields(d)
+	o := SlotOptions{
+		CPUs:       f.int("cpus"),
+		ClientType: f.string("client-type"),
+		Idle:       f.bool("idle"),
+		Paused:     f.bool("paused"),
+	}
+	if f.err != nil {
+		return SlotOptions{}, fmt.Errorf("slot-options: %w", f.err)
+	}
+	return o, nil
+}
+
+// QueueInfo returns the work units queued by the client.
+func (c *Client) QueueInfo() ([]SlotQueueInfo, error) {
+	v, err := c.pyon("queue-info", "units")
+	if err != nil {
+		return nil, err
+	}
+	return toQueueInfo(v)
+}
+
+func toQueueInfo(v interface{}) ([]SlotQueueInfo, error) {
+	units, err := dicts(v)
+	if err != nil {
+		return nil, fmt.Errorf("queue-info: %w", err)
+	}
+
+	queueInfo := make([]SlotQueueInfo, 0, len(units))
+	for _, unit := range units {
+		f := fields(unit)
+		q := SlotQueueInfo{
+			ID:             f.string("id"),
+			Slot:           f.string("slot"),
+			State:          f.string("state"),
+			Error:          f.string("error"),
+			Project:        f.int("project"),
+			Run:            f.int("run"),
+			Clone:          f.int("clone"),
+			Gen:            f.int("gen"),
+			Core:           f.string("core"),
+			Unit:           f.string("unit"),
+			PercentDone:    f.string("percentdone"),
+			ETA:            f.duration("eta"),
+			PPD:            f.int("ppd"),
+			CreditEstimate: f.int("creditestimate"),
+			BaseCredit:     f.int("basecredit"),
+			WaitingOn:      f.string("waitingon"),
+			Attempts:       f.int("attempts"),
+			NextAttempt:    f.duration("nextattempt"),
+			TimeRemaining:  f.duration("timeremaining"),
+			TotalFrames:    f.int("totalframes"),
+			FramesDone:     f.int("framesdone"),
+			TPF:            f.duration("tpf"),
+			Assigned:       f.time("assigned"),
+			Timeout:        f.time("timeout"),
+			Deadline:       f.time("deadline"),
+			WS:             f.string("ws"),
+			CS:             f.string("cs"),
+		}
+		if f.err != nil {
+			return nil, fmt.Errorf("queue-info: %w", f.err)
+		}
+		queueInfo = append(queueInfo, q)
+	}
+	return queueInfo, nil
+}
+
+// PPD returns the estimated points per day of the client as a whole, the sum
+// of those of the work units it is running.
+func (c *Client) PPD() (float64, error) {
+	v, err := c.pyon("ppd", "ppd")
+	if err != nil {
+		return 0, err
+	}
+	return toPPD(v)
+}
+
+func toPPD(v interface{}) (float64, error) {
+	switch ppd := v.(type) {
+	case float64:
+		return ppd, nil
+	case string:
+		f, err := strconv.ParseFloat(ppd, 64)
+		if err != nil {
+			return 0, fmt.Errorf("ppd: %w", err)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("ppd: expected number, got %T", v)
+}
+
+// PauseSlot pauses the slot with the given id.
+func (c *Client) PauseSlot(id int) error {
+	_, err := c.Exec(fmt.Sprintf("pause %d", id))
+	return err
+}
+
+// UnpauseSlot unpauses the slot with the given id.
+func (c *Client) UnpauseSlot(id int) error {
+	_, err := c.Exec(fmt.Sprintf("unpause %d", id))
+	return err
+}
@@ -0,0 +1,103 @@
+package fahclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Lengths of the calendar units, which FAHClient counts as fixed numbers of
+// days.
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+	year  = 365 * day
+)
+
+// durationUnits maps the units FAHClient uses in durations to their length.
+var durationUnits = map[string]time.Duration{
+	"y":       year,
+	"year":    year,
+	"years":   year,
+	"mo":      month,
+	"month":   month,
+	"months":  month,
+	"w":       week,
+	"week":    week,
+	"weeks":   week,
+	"d":       day,
+	"day":     day,
+	"days":    day,
+	"h":       time.Hour,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"m":       time.Minute,
+	"min":     time.Minute,
+	"mins":    time.Minute,
+	"minute":  time.Minute,
+	"minutes": time.Minute,
+	"s":       time.Second,
+	"sec":     time.Second,
+	"secs":    time.Second,
+	"second":  time.Second,
+	"seconds": time.Second,
+	"ms":      time.Millisecond,
+}
+
+// ParseDuration parses a duration as printed by FAHClient, such as
+// "1 hours 08 mins", "1.99 days", "3d 14h 31m", "2 weeks 3 days" or
+// "unknowntime", which is returned as zero. The parts of the duration may be
+// separated by spaces or commas, or not at all, like "3d14h31m". Weeks,
+// months and years count 7, 30 and 365 days, so that clients running for that
+// long report their uptime.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "unknowntime" {
+		return 0, nil
+	}
+
+	var d time.Duration
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	})
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		for field != "" {
+			n := strings.IndexFunc(field, func(r rune) bool {
+				return (r < '0' || r > '9') && r != '.'
+			})
+			number, unit := field, ""
+			if n >= 0 {
+				number, field = field[:n], field[n:]
+				// The unit runs until the number of the next part.
+				n = strings.IndexFunc(field, func(r rune) bool {
+					return (r >= '0' && r <= '9') || r == '.'
+				})
+				if n < 0 {
+					n = len(field)
+				}
+				unit, field = field[:n], field[n:]
+			} else {
+				field = ""
+				if i+1 < len(fields) {
+					i++
+					unit = fields[i]
+				}
+			}
+
+			v, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			length, ok := durationUnits[strings.ToLower(unit)]
+			if !ok {
+				return 0, fmt.Errorf("invalid duration %q: unknown unit %q", s, unit)
+			}
+			d += time.Duration(v * float64(length))
+		}
+	}
+	return d, nil
+}
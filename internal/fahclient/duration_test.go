@@ -0,0 +1,50 @@
+package fahclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"unknowntime", 0},
+		{"0.00 secs", 0},
+		{"2 mins 21 secs", 2*time.Minute + 21*time.Second},
+		{"1 hours 08 mins", time.Hour + 8*time.Minute},
+		{"4.5 hours", 4*time.Hour + 30*time.Minute},
+		{"1.99 days", time.Duration(1.99 * float64(day))},
+		{"3d 14h 31m", 3*day + 14*time.Hour + 31*time.Minute},
+		{"3d14h31m", 3*day + 14*time.Hour + 31*time.Minute},
+		{"3d 14h 31m 5s", 3*day + 14*time.Hour + 31*time.Minute + 5*time.Second},
+		{"3 days, 2 hours", 3*day + 2*time.Hour},
+		{"500ms", 500 * time.Millisecond},
+		{"2 weeks 3 days", 17 * day},
+		{"1 month 2 weeks", 44 * day},
+		{"1y 2mo 3w 4d 5h 6m 7s", 365*day + 60*day + 21*day + 4*day + 5*time.Hour + 6*time.Minute + 7*time.Second},
+		{"2 Days", 2 * day},
+		{"  1 day  ", day},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if err != nil {
+			t.Errorf("ParseDuration(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseDurationErrors(t *testing.T) {
+	for _, in := range []string{"abc", "12 fortnights", "3x", "days", "1..5 hours", "3 hours -"} {
+		if d, err := ParseDuration(in); err == nil {
+			t.Errorf("ParseDuration(%q) = %v, want error", in, d)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package fahclient
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDepth limits the nesting of decoded values, so that a malformed response
+// can't exhaust the stack.
+const maxDepth = 64
+
+// ParseMessage extracts the first PyON message from the output of a command
+// and returns its name and decoded value. FAHClient frames structured output
+// as
+//
+//	PyON 1 <name>
+//	<value>
+//	---
+func ParseMessage(s string) (string, interface{}, error) {
+	start := strings.Index(s, "PyON ")
+	if start < 0 {
+		return "", nil, fmt.Errorf("no PyON message in response %q", strings.TrimSpace(s))
+	}
+	s = s[start:]
+
+	nl := strings.IndexByte(s, '\n')
+	if nl < 0 {
+		return "", nil, errors.New("incomplete PyON message")
+	}
+	header := strings.Fields(s[:nl])
+	if len(header) != 3 {
+		return "", nil, fmt.Errorf("malformed PyON header %q", strings.TrimSpace(s[:nl]))
+	}
+	if header[1] != "1" {
+		return "", nil, fmt.Errorf("unsupported PyON version %q", header[1])
+	}
+
+	body := s[nl+1:]
+	end := strings.Index(body, "\n---")
+	if end < 0 {
+		return "", nil, errors.New("incomplete PyON message")
+	}
+	v, err := Decode(body[:end])
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding PyON message %q: %w", header[2], err)
+	}
+	return header[2], v, nil
+}
+
+// Decode parses a PyON value: the Python literal syntax FAHClient uses for
+// structured output, which is JSON with None, True and False, tolerating
+// trailing commas. Values decode to nil, bool, float64, string,
+// []interface{} and map[string]interface{}.
+func Decode(s string) (interface{}, error) {
+	d := &decoder{s: s}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	d.skipSpace()
+	if d.pos < len(d.s) {
+		return nil, d.errorf("unexpected %q after value", d.s[d.pos])
+	}
+	return v, nil
+}
+
+type decoder struct {
+	s   string
+	pos int
+}
+
+func (d *decoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", d.pos, fmt.Sprintf(format, args...))
+}
+
+func (d *decoder) skipSpace() {
+	for d.pos < len(d.s) {
+		switch d.s[d.pos] {
+		case ' ', '\t', '\r', '\n':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (d *decoder) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, d.errorf("values nested too deeply")
+	}
+	d.skipSpace()
+	if d.pos >= len(d.s) {
+		return nil, d.errorf("unexpected end of input")
+	}
+
+	switch c := d.s[d.pos]; c {
+	case '{':
+		return d.dict(depth)
+	case '[':
+		return d.list(depth, ']')
+	case '(':
+		return d.list(depth, ')')
+	case '"', '\'':
+		return d.string()
+	default:
+		return d.literal()
+	}
+}
+
+func (d *decoder) dict(depth int) (interface{}, error) {
+	d.pos++
+	m := map[string]interface{}{}
+	for {
+		d.skipSpace()
+		if d.pos < len(d.s) && d.s[d.pos] == '}' {
+			d.pos++
+			return m, nil
+		}
+
+		if d.pos >= len(d.s) || (d.s[d.pos] != '"' && d.s[d.pos] != '\'') {
+			return nil, d.errorf("expected string key")
+		}
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		d.skipSpace()
+		if d.pos >= len(d.s) || d.s[d.pos] != ':' {
+			return nil, d.errorf("expected ':' after key %q", key)
+		}
+		d.pos++
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+
+		if err := d.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *decoder) list(depth int, end byte) (interface{}, error) {
+	d.pos++
+	l := []interface{}{}
+	for {
+		d.skipSpace()
+		if d.pos < len(d.s) && d.s[d.pos] == end {
+			d.pos++
+			return l, nil
+		}
+
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+
+		if err := d.separator(end); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// separator consumes the comma following an element, leaving the closing
+// bracket to the caller.
+func (d *decoder) separator(end byte) error {
+	d.skipSpace()
+	if d.pos >= len(d.s) {
+		return d.errorf("unexpected end of input")
+	}
+	switch d.s[d.pos] {
+	case ',':
+		d.pos++
+		return nil
+	case end:
+		return nil
+	default:
+		return d.errorf("expected ',' or %q, found %q", end, d.s[d.pos])
+	}
+}
+
+func (d *decoder) string() (string, error) {
+	quote := d.s[d.pos]
+	d.pos++
+
+	var b strings.Builder
+	for d.pos < len(d.s) {
+		c := d.s[d.pos]
+		d.pos++
+		switch c {
+		case quote:
+			return b.String(), nil
+		case '\\':
+			if err := d.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", d.errorf("unterminated string")
+}
+
+func (d *decoder) escape(b *strings.Builder) error {
+	if d.pos >= len(d.s) {
+		return d.errorf("unterminated string")
+	}
+	c := d.s[d.pos]
+	d.pos++
+	switch c {
+	case '"', '\'', '\\', '/':
+		b.WriteByte(c)
+	case 'b':
+		b.WriteByte('\b')
+	case 'f':
+		b.WriteByte('\f')
+	case 'n':
+		b.WriteByte('\n')
+	case 'r':
+		b.WriteByte('\r')
+	case 't':
+		b.WriteByte('\t')
+	case 'x':
+		r, err := d.hex(2)
+		if err != nil {
+			return err
+		}
+		b.WriteByte(byte(r))
+	case 'u':
+		r, err := d.hex(4)
+		if err != nil {
+			return err
+		}
+		if !utf8.ValidRune(r) {
+			r = utf8.RuneError
+		}
+		b.WriteRune(r)
+	default:
+		return d.errorf("invalid escape '\\%c'", c)
+	}
+	return nil
+}
+
+func (d *decoder) hex(n int) (rune, error) {
+	if d.pos+n > len(d.s) {
+		return 0, d.errorf("unterminated string")
+	}
+	v, err := strconv.ParseUint(d.s[d.pos:d.pos+n], 16, 32)
+	if err != nil {
+		return 0, d.errorf("invalid escape %q", d.s[d.pos:d.pos+n])
+	}
+	d.pos += n
+	return rune(v), nil
+}
+
+// literal parses None, True, False or a number.
+func (d *decoder) literal() (interface{}, error) {
+	start := d.pos
+	for d.pos < len(d.s) && isLiteralByte(d.s[d.pos]) {
+		d.pos++
+	}
+	token := d.s[start:d.pos]
+
+	switch token {
+	case "":
+		return nil, d.errorf("unexpected %q", d.s[d.pos])
+	case "None":
+		return nil, nil
+	case "True":
+		return true, nil
+	case "False":
+		return false, nil
+	}
+
+	f, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, fmt.Errorf("offset %d: invalid literal %q", start, token)
+	}
+	return f, nil
+}
+
+func isLiteralByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '+' || c == '-' || c == '_'
+}
@@ -0,0 +1,221 @@
+package fahclient
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// samples are the outputs of FAHClient 7.6 commands in testdata, by file.
+var samples = []string{"slot-info.txt", "queue-info.txt", "info.txt"}
+
+func readSample(t testing.TB, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// messageBody returns the value of the PyON message in a sample.
+func messageBody(s string) string {
+	s = s[strings.Index(s, "\n[")+1:]
+	return s[:strings.Index(s, "\n---")]
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{`None`, nil},
+		{`True`, true},
+		{`False`, false},
+		{`(1, 'two')`, []interface{}{1.0, "two"}},
+		{`-1.5e3`, -1500.0},
+		{`"a\"b\\c\né\x41"`, "a\"b\\c\néA"},
+		{`[]`, []interface{}{}},
+		{`[1, "two", None,]`, []interface{}{1.0, "two", nil}},
+		{`{"a": {"b": [True]},}`, map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{true}}}},
+		{" \n\t{ } \n", map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		got, err := Decode(tt.in)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, in := range []string{
+		``,
+		`[`,
+		`[1 2]`,
+		`{"a" 1}`,
+		`{1: 2}`,
+		`"unterminated`,
+		`"\q"`,
+		`"\u12"`,
+		`Nope`,
+		`[] []`,
+		`true`,
+		strings.Repeat("[", maxDepth+2) + strings.Repeat("]", maxDepth+2),
+	} {
+		if v, err := Decode(in); err == nil {
+			t.Errorf("Decode(%q) = %#v, want error", in, v)
+		}
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, tt := range []struct {
+		sample, name string
+	}{
+		{"slot-info.txt", "slots"},
+		{"queue-info.txt", "units"},
+		{"info.txt", "info"},
+	} {
+		name, v, err := ParseMessage(readSample(t, tt.sample))
+		if err != nil {
+			t.Errorf("%s: %v", tt.sample, err)
+			continue
+		}
+		if name != tt.name {
+			t.Errorf("%s: name = %q, want %q", tt.sample, name, tt.name)
+		}
+		if _, ok := v.([]interface{}); !ok {
+			t.Errorf("%s: value is %T, want list", tt.sample, v)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, in := range []string{
+		"> ",
+		"PyON 1 slots",
+		"PyON 1\n[]\n---\n",
+		"PyON 2 slots\n[]\n---\n",
+		"PyON 1 slots\n[]\n",
+		"PyON 1 slots\n[\n---\n",
+	} {
+		if name, v, err := ParseMessage(in); err == nil {
+			t.Errorf("ParseMessage(%q) = %q, %#v, want error", in, name, v)
+		}
+	}
+}
+
+func TestSamples(t *testing.T) {
+	_, v, err := ParseMessage(readSample(t, "slot-info.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots, err := toSlotInfo(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSlots := []SlotInfo{
+		{ID: "00", Status: "RUNNING", Description: "cpu:14"},
+		{ID: "01", Status: "PAUSED", Description: "gpu:9:0 TU106 [GeForce RTX 2070] 6497", Reason: "paused"},
+	}
+	if !reflect.DeepEqual(slots, wantSlots) {
+		t.Errorf("slot-info = %+v, want %+v", slots, wantSlots)
+	}
+
+	_, v, err = ParseMessage(readSample(t, "queue-info.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	units, err := toQueueInfo(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 2 {
+		t.Fatalf("queue-info has %d units, want 2", len(units))
+	}
+	u := units[0]
+	if u.Project != 13424 || u.PPD != 2039645 || u.FramesDone != 46 || u.ETA != 2*time.Hour+7*time.Minute || u.TPF != 2*time.Minute+21*time.Second {
+		t.Errorf("queue-info unit = %+v", u)
+	}
+	if want := time.Date(2020, 5, 12, 16, 42, 20, 0, time.UTC); !u.Deadline.Equal(want) {
+		t.Errorf("deadline = %v, want %v", u.Deadline, want)
+	}
+	if u := units[1]; !u.Assigned.IsZero() || u.ETA != 0 || u.WaitingOn != "WS Assignment" || u.Attempts != 4 {
+		t.Errorf("queue-info unit = %+v", u)
+	}
+
+	_, v, err = ParseMessage(readSample(t, "info.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := toInfo(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, ok := InfoValue(info, "Build", "Version"); !ok || version != "7.6.21" {
+		t.Errorf("Build Version = %q, %v", version, ok)
+	}
+	if _, ok := InfoValue(info, "System", "Has Battery"); ok {
+		t.Error("Has Battery is not a string but was found")
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, name := range samples {
+		f.Add(messageBody(readSample(f, name)))
+	}
+	f.Add(`{"a": [None, True, False, 1.5, "é\x41"],}`)
+	f.Fuzz(func(t *testing.T, s string) {
+		v, err := Decode(s)
+		if err != nil {
+			return
+		}
+		checkValue(t, v, 0)
+	})
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, name := range samples {
+		f.Add(readSample(f, name))
+	}
+	f.Add("PyON 1 options\n{\"user\": \"Anonymous\", \"team\": \"0\"}\n---\n> ")
+	f.Fuzz(func(t *testing.T, s string) {
+		name, v, err := ParseMessage(s)
+		if err != nil {
+			return
+		}
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			t.Errorf("ParseMessage(%q) returned name %q", s, name)
+		}
+		checkValue(t, v, 0)
+	})
+}
+
+// checkValue checks that v only holds the types Decode documents, with
+// containers nested no deeper than maxDepth.
+func checkValue(t *testing.T, v interface{}, depth int) {
+	if depth > maxDepth+1 {
+		t.Fatalf("value nested deeper than %d", maxDepth)
+	}
+	switch v := v.(type) {
+	case nil, bool, float64, string:
+	case []interface{}:
+		for _, e := range v {
+			checkValue(t, e, depth+1)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			checkValue(t, e, depth+1)
+		}
+	default:
+		t.Fatalf("unexpected type %T", v)
+	}
+}
@@ -0,0 +1,194 @@
+package fahclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlotInfo is a slot as reported by the slot-info command.
+type SlotInfo struct {
+	ID          string
+	Status      string
+	Description string
+	Reason      string
+	Idle        bool
+}
+
+// SlotOptions are the options of a slot as reported by the slot-options
+// command, as far as the exporter uses them.
+type SlotOptions struct {
+	CPUs       int
+	ClientType string
+	Idle       bool
+	Paused     bool
+}
+
+// Options are the options of the client as reported by the options command,
+// as far as the exporter uses them.
+type Options struct {
+	User    string
+	Team    string
+	Passkey string
+	Power   string
+	Cause   string
+}
+
+// SlotQueueInfo is a work unit as reported by the queue-info command.
+type SlotQueueInfo struct {
+	ID             string
+	Slot           string
+	State          string
+	Error          string
+	Project        int
+	Run            int
+	Clone          int
+	Gen            int
+	Core           string
+	Unit           string
+	PercentDone    string
+	ETA            time.Duration
+	PPD            int
+	CreditEstimate int
+	BaseCredit     int
+	WaitingOn      string
+	Attempts       int
+	NextAttempt    time.Duration
+	TimeRemaining  time.Duration
+	TotalFrames    int
+	FramesDone     int
+	TPF            time.Duration
+	Assigned       time.Time
+	Timeout        time.Time
+	Deadline       time.Time
+	WS             string
+	CS             string
+}
+
+// dicts asserts that v is a list of dicts.
+func dicts(v interface{}) ([]map[string]interface{}, error) {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected list, got %T", v)
+	}
+	ds := make([]map[string]interface{}, 0, len(l))
+	for _, e := range l {
+		d, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected dict, got %T", e)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// fieldReader converts the fields of a dict, remembering the first error.
+// FAHClient is inconsistent about quoting numbers, so numbers are accepted
+// as strings too. Missing fields and fields unknown to the reader are
+// ignored.
+type fieldReader struct {
+	d   map[string]interface{}
+	err error
+}
+
+func fields(d map[string]interface{}) *fieldReader {
+	return &fieldReader{d: d}
+}
+
+func (f *fieldReader) fail(key string, v interface{}) {
+	if f.err == nil {
+		f.err = fmt.Errorf("invalid value %v for %q", v, key)
+	}
+}
+
+func (f *fieldReader) string(key string) string {
+	switch v := f.d[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		f.fail(key, v)
+		return ""
+	}
+}
+
+func (f *fieldReader) bool(key string) bool {
+	switch v := f.d[key].(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			f.fail(key, v)
+		}
+		return b
+	default:
+		f.fail(key, v)
+		return false
+	}
+}
+
+func (f *fieldReader) int(key string) int {
+	switch v := f.d[key].(type) {
+	case nil:
+		return 0
+	case float64:
+		return int(v)
+	case string:
+		if v == "" {
+			return 0
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			f.fail(key, v)
+		}
+		return int(n)
+	default:
+		f.fail(key, v)
+		return 0
+	}
+}
+
+func (f *fieldReader) duration(key string) time.Duration {
+	switch v := f.d[key].(type) {
+	case nil:
+		return 0
+	case float64:
+		return time.Duration(v * float64(time.Second))
+	case string:
+		d, err := ParseDuration(v)
+		if err != nil {
+			f.fail(key, v)
+		}
+		return d
+	default:
+		f.fail(key, v)
+		return 0
+	}
+}
+
+// time parses a timestamp, which FAHClient reports as "<invalid>" when unset.
+func (f *fieldReader) time(key string) time.Time {
+	switch v := f.d[key].(type) {
+	case nil:
+		return time.Time{}
+	case string:
+		if v == "" || strings.HasPrefix(v, "<") {
+			return time.Time{}
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			f.fail(key, v)
+		}
+		return t
+	default:
+		f.fail(key, v)
+		return time.Time{}
+	}
+}
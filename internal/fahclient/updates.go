@@ -0,0 +1,98 @@
+package fahclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Update is the output of a command pushed by the client for a subscription.
+// Exactly one of its fields is set.
+type Update struct {
+	Info      [][]interface{}
+	SlotInfo  []SlotInfo
+	QueueInfo []SlotQueueInfo
+	// Log is the text appended to the log since the last update, which
+	// may end in the middle of a line.
+	Log string
+}
+
+// Subscribe asks the client to push the output of the info, slot-info and
+// queue-info commands every interval. Afterwards the pushed output is read
+// with ReadUpdate; no more commands should be run on the connection. The
+// prompts answering the subscriptions are left to ReadUpdate too, as the
+// first updates may be pushed before them.
+func (c *Client) Subscribe(interval time.Duration) error {
+	seconds := int(interval.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	for id, command := range []string{"info", "slot-info", "queue-info"} {
+		if _, err := fmt.Fprintf(c.conn, "updates add %d %d $%s\n", id, seconds, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubscribeLog asks the client to push the lines appended to its log from now
+// on. Afterwards the pushed lines are read with ReadUpdate, as for Subscribe.
+func (c *Client) SubscribeLog() error {
+	_, err := fmt.Fprintf(c.conn, "log-updates start\n")
+	return err
+}
+
+// ReadUpdate reads the next update pushed by the client, skipping messages
+// of other kinds.
+func (c *Client) ReadUpdate() (Update, error) {
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return Update{}, err
+		}
+		// A pushed message may follow the prompt of the last command.
+		if !strings.HasPrefix(strings.TrimLeft(line, "> "), "PyON ") {
+			continue
+		}
+
+		var msg strings.Builder
+		msg.WriteString(strings.TrimLeft(line, "> "))
+		for {
+			line, err := c.r.ReadString('\n')
+			if err != nil {
+				return Update{}, err
+			}
+			msg.WriteString(line)
+			if strings.TrimRight(line, "\r\n") == "---" {
+				break
+			}
+		}
+
+		name, v, err := ParseMessage(msg.String())
+		if err != nil {
+			return Update{}, err
+		}
+		var u Update
+		switch name {
+		case "info":
+			u.Info, err = toInfo(v)
+		case "slots":
+			u.SlotInfo, err = toSlotInfo(v)
+		case "units":
+			u.QueueInfo, err = toQueueInfo(v)
+		case "log-update":
+			// The whole log, pushed as log-restart, is skipped.
+			s, ok := v.(string)
+			if !ok {
+				return Update{}, fmt.Errorf("log-update: expected string, got %T", v)
+			}
+			if s == "" {
+				continue
+			}
+			u.Log = s
+		default:
+			continue
+		}
+		return u, err
+	}
+}
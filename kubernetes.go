@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// kubernetesServiceAccountDir holds the credentials of the service account
+// of a pod.
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesTimeout bounds listing the pods.
+const kubernetesTimeout = 10 * time.Second
+
+// kubernetesDiscovery is a discoverer listing the running pods annotated to
+// be scraped, like fah.exporter/scrape: "true", from the API server of the
+// cluster the exporter runs in, with the credentials of its service account.
+// The clients are reached at the IP of their pod, on the port given by the
+// port annotation or 36330, and labeled with their pod and namespace.
+type kubernetesDiscovery struct {
+	resolvedTargets
+	apiServer      string
+	namespace      string
+	annotation     string
+	portAnnotation string
+	client         *http.Client
+	logger         log.Logger
+}
+
+// kubernetesPodList is the part of a list of pods used for discovery.
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// newKubernetesDiscovery returns a discoverer for the pods of namespace, or of
+// all namespaces if empty. It fails outside of a cluster.
+func newKubernetesDiscovery(namespace, annotation, portAnnotation string, logger log.Logger) (*kubernetesDiscovery, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	}
+
+	return &kubernetesDiscovery{
+		apiServer:      "https://" + net.JoinHostPort(host, port),
+		namespace:      namespace,
+		annotation:     annotation,
+		portAnnotation: portAnnotation,
+		client: &http.Client{
+			Timeout: kubernetesTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		logger: logger,
+	}, nil
+}
+
+// refresh lists the pods and reports whether the targets changed. The targets
+// are kept if the API server fails.
+func (d *kubernetesDiscovery) refresh() bool {
+	pods, err := d.pods()
+	if err != nil {
+		level.Error(d.logger).Log("msg", "Failed to list pods", "err", err)
+		return false
+	}
+
+	var targets []discoveredTarget
+	for _, pod := range pods.Items {
+		if pod.Metadata.Annotations[d.annotation] != "true" || pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		port := strconv.Itoa(defaultFAHClientPort)
+		if p, ok := pod.Metadata.Annotations[d.portAnnotation]; ok {
+			if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+				level.Warn(d.logger).Log("msg", "Invalid port annotation", "pod", pod.Metadata.Namespace+"/"+pod.Metadata.Name, "port", p)
+				continue
+			}
+			port = p
+		}
+		targets = append(targets, discoveredTarget{
+			address: net.JoinHostPort(pod.Status.PodIP, port),
+			labels: map[string]string{
+				"pod":       pod.Metadata.Name,
+				"namespace": pod.Metadata.Namespace,
+			},
+		})
+	}
+	return d.set(targets)
+}
+
+func (d *kubernetesDiscovery) pods() (*kubernetesPodList, error) {
+	path := "/api/v1/pods"
+	if d.namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(d.namespace) + "/pods"
+	}
+	req, err := http.NewRequest(http.MethodGet, d.apiServer+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The token is read for every request, as it is rotated.
+	token, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	var pods kubernetesPodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("GET %s: %w", path, err)
+	}
+	return &pods, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// constLabelsGatherer adds constant labels, like the rig or location of the
+// exporter, to all metrics, so that fleets of exporters can be told apart
+// without relabeling them in Prometheus. Labels a metric already has are left
+// alone.
+type constLabelsGatherer struct {
+	prometheus.Gatherer
+	labels map[string]string
+}
+
+func (g constLabelsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+
+	names := make([]string, 0, len(g.labels))
+	for name := range g.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			added := false
+			for _, name := range names {
+				if !hasLabel(m, name) {
+					m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(g.labels[name])})
+					added = true
+				}
+			}
+			if added {
+				sortLabels(m)
+			}
+		}
+	}
+	return mfs, err
+}
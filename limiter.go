@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// scrapeLimiter caps the number of scrapes querying a FAHClient at the same
+// time, so that Prometheus servers scraping together don't each open a
+// session with the client. Further scrapes wait for their turn.
+type scrapeLimiter struct {
+	slots chan struct{}
+
+	mtx    sync.Mutex
+	queued int
+}
+
+func newScrapeLimiter(max int) *scrapeLimiter {
+	return &scrapeLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire waits for a turn to query the client, unless ctx expires first.
+// Turns are handed back with release.
+func (l *scrapeLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mtx.Lock()
+	l.queued++
+	l.mtx.Unlock()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *scrapeLimiter) release() {
+	<-l.slots
+}
+
+// queuedTotal returns the number of scrapes that had to wait for their turn.
+func (l *scrapeLimiter) queuedTotal() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.queued
+}
+
+// scrapeLimiterSet holds the scrape limiters of probe targets, which outlive
+// the exporters created per probe request.
+type scrapeLimiterSet struct {
+	max int
+
+	mtx      sync.Mutex
+	limiters map[string]*scrapeLimiter
+}
+
+func newScrapeLimiterSet(max int) *scrapeLimiterSet {
+	return &scrapeLimiterSet{max: max, limiters: map[string]*scrapeLimiter{}}
+}
+
+// get returns the scrape limiter of target.
+func (s *scrapeLimiterSet) get(target string) *scrapeLimiter {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	l, ok := s.limiters[target]
+	if !ok {
+		l = newScrapeLimiter(s.max)
+		s.limiters[target] = l
+	}
+	return l
+}
+
+// forget discards the scrape limiter of target.
+func (s *scrapeLimiterSet) forget(target string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.limiters, target)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// unixScheme prefixes listen addresses that name a Unix domain socket.
+const unixScheme = "unix://"
+
+// listenAndServe serves HTTP like web.ListenAndServe, but also accepts listen
+// addresses of the form unix:///path/to/socket, for setups where a local
+// proxy or agent scrapes the exporter and no TCP port should be opened.
+func listenAndServe(server *http.Server, flags *web.FlagConfig, logger log.Logger) error {
+	if *flags.WebSystemdSocket || !hasUnixAddress(*flags.WebListenAddresses) {
+		return web.ListenAndServe(server, flags, logger)
+	}
+
+	listeners := make([]net.Listener, 0, len(*flags.WebListenAddresses))
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for _, address := range *flags.WebListenAddresses {
+		l, err := listen(address)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	return web.ServeMultiple(listeners, server, flags, logger)
+}
+
+func hasUnixAddress(addresses []string) bool {
+	for _, address := range addresses {
+		if strings.HasPrefix(address, unixScheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen listens on a TCP address or a Unix domain socket. A socket left
+// behind by a previous run is removed first; the socket is removed again when
+// the listener is closed.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixScheme)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// livenessCollector only connects to the FAHClient command port and reads its
+// greeting. It is cheap enough to be scraped much more frequently than the
+// full Exporter, which issues several commands per scrape.
+type livenessCollector struct {
+	address  string
+	protocol string
+	timeout  time.Duration
+	dial     contextDialer
+	logger   log.Logger
+
+	reachable       *prometheus.Desc
+	connectDuration *prometheus.Desc
+}
+
+func newLivenessCollector(client ClientConfig, timeout time.Duration, logger log.Logger) *livenessCollector {
+	return &livenessCollector{
+		address:  client.Address,
+		protocol: client.Protocol,
+		timeout:  timeout,
+		dial:     client.dialer(timeout),
+		logger:   logger,
+		reachable: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "client", "reachable"),
+			"Whether the FAHClient command port accepted a connection and sent its greeting.",
+			nil,
+			nil,
+		),
+		connectDuration: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "client", "connect_duration_seconds"),
+			"Time taken to connect to the FAHClient command port.",
+			nil,
+			nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *livenessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.reachable
+	ch <- c.connectDuration
+}
+
+// Collect implements prometheus.Collector.
+func (c *livenessCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.protocol == protocolLog {
+		// The command port of a client read from its log isn't used.
+		return
+	}
+	connectDuration, err := c.probe()
+	if err != nil {
+		level.Error(c.logger).Log("msg", "FAHClient liveness probe failed", "err", err)
+		ch <- prometheus.MustNewConstMetric(c.reachable, prometheus.GaugeValue, 0)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.reachable, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(c.connectDuration, prometheus.GaugeValue, connectDuration.Seconds())
+}
+
+func (c *livenessCollector) probe() (time.Duration, error) {
+	switch c.protocol {
+	case protocolV7:
+		return c.probeV7()
+	case protocolV8:
+		return c.probeV8()
+	case protocolLog:
+		return 0, errors.New("the FAHClient is read from its log")
+	}
+
+	// See detectProtocol for why v8 is tried first.
+	if connectDuration, err := c.probeV8(); err == nil {
+		return connectDuration, nil
+	}
+	return c.probeV7()
+}
+
+// probeV7 connects to the command port of a v7 client and reads its greeting.
+func (c *livenessCollector) probeV7() (time.Duration, error) {
+	start := time.Now()
+	conn, err := c.dial(context.Background(), "tcp", c.address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	connectDuration := time.Since(start)
+
+	if err := conn.SetReadDeadline(start.Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	if err := readBanner(bufio.NewReader(conn)); err != nil {
+		return 0, err
+	}
+	return connectDuration, nil
+}
+
+// readBanner reads the greeting of a v7 client, skipping blank lines.
+func readBanner(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, fahclient.Banner) {
+			return errors.New("unexpected greeting from FAHClient: " + line)
+		}
+		return nil
+	}
+}
+
+// probeV8 completes the WebSocket handshake with a v8 client, which has no
+// greeting.
+func (c *livenessCollector) probeV8() (time.Duration, error) {
+	start := time.Now()
+	conn, err := dialV8(context.Background(), c.dial, c.address, c.timeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// protocolLog reads the state of a client from its log instead of asking the
+// client, for installs where the command port is disabled. Only the slots and
+// their work units can be told from the log.
+const protocolLog = "log"
+
+// logUnitKey identifies a work unit of a slot in the log.
+type logUnitKey struct {
+	slot, unit string
+}
+
+type logTransfer struct {
+	direction string
+	progress  float64
+}
+
+// restart forgets the state followed through the log, when a new log starts.
+func (c *logCounters) restart() {
+	c.parser = logParser{}
+	c.slots = map[string]*fahclient.SlotInfo{}
+	c.units = map[logUnitKey]*fahclient.SlotQueueInfo{}
+	c.transfers = map[logUnitKey]logTransfer{}
+}
+
+// track follows the state of the slots and their work units through an event.
+func (c *logCounters) track(event logEvent) {
+	key := logUnitKey{event.slot, event.unit}
+	switch event.kind {
+	case logEventSlot:
+		c.slots[event.slot] = &fahclient.SlotInfo{ID: event.slot, Status: event.status, Description: event.description}
+	case logEventSlotStatus:
+		c.slot(event.slot).Status = event.status
+	case logEventUnit:
+		unit := c.unit(key)
+		if event.status != "" {
+			unit.State = event.status
+		}
+		unit.Project, unit.Run, unit.Clone, unit.Gen = event.project, event.run, event.clone, event.gen
+		unit.Core = event.core
+	case logEventUnitState:
+		c.unit(key).State = event.status
+		if event.status == "RUNNING" {
+			c.slot(event.slot).Status = "RUNNING"
+		}
+	case logEventSteps:
+		unit := c.unit(key)
+		unit.State = "RUNNING"
+		unit.PercentDone = fmt.Sprintf("%.2f%%", event.progress*100)
+		// Percents take the place of frames, which the log doesn't count.
+		unit.FramesDone, unit.TotalFrames = int(event.progress*100), 100
+		c.slot(event.slot).Status = "RUNNING"
+	case logEventDownloaded:
+		c.transfers[key] = logTransfer{direction: "download"}
+		c.slot(event.slot).Status = "DOWNLOAD"
+	case logEventUploaded:
+		c.transfers[key] = logTransfer{direction: "upload"}
+		c.slot(event.slot).Status = "UPLOAD"
+	case logEventTransferProgress:
+		c.transfers[key] = logTransfer{direction: event.direction, progress: event.progress}
+	case logEventTransferComplete, logEventCompleted:
+		delete(c.transfers, key)
+	case logEventCleanedUp:
+		delete(c.units, key)
+		delete(c.transfers, key)
+		if slot := c.slot(event.slot); slot.Status != "PAUSED" {
+			slot.Status = "READY"
+		}
+	}
+}
+
+// slot returns the slot with the given ID, adding it if it wasn't seen yet.
+func (c *logCounters) slot(id string) *fahclient.SlotInfo {
+	slot, ok := c.slots[id]
+	if !ok {
+		slot = &fahclient.SlotInfo{ID: id}
+		c.slots[id] = slot
+	}
+	return slot
+}
+
+// unit returns the work unit with the given key, adding it if it wasn't seen
+// yet.
+func (c *logCounters) unit(key logUnitKey) *fahclient.SlotQueueInfo {
+	unit, ok := c.units[key]
+	if !ok {
+		unit = &fahclient.SlotQueueInfo{ID: key.unit, Slot: key.slot}
+		c.units[key] = unit
+		c.slot(key.slot)
+	}
+	return unit
+}
+
+// clientState returns the state of the client followed through its log. The
+// client reports nothing else than its slots and work units in the log.
+func (c *logCounters) clientState() (*clientState, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if err := c.follow(); err != nil {
+		return nil, err
+	}
+
+	state := &clientState{}
+	for _, slot := range c.slots {
+		state.slotInfo = append(state.slotInfo, *slot)
+	}
+	sort.Slice(state.slotInfo, func(i, j int) bool {
+		return state.slotInfo[i].ID < state.slotInfo[j].ID
+	})
+	for _, unit := range c.units {
+		state.queueInfo = append(state.queueInfo, *unit)
+	}
+	sort.Slice(state.queueInfo, func(i, j int) bool {
+		return state.queueInfo[i].ID < state.queueInfo[j].ID
+	})
+	for _, command := range []string{"uptime", "date", "info", "options", "slot-options", "ppd"} {
+		state.fail(command, collector.ErrNotSupported)
+	}
+	return state, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logUpdatesRetryInterval is how long to wait before subscribing to the log
+// again after the session was lost.
+const logUpdatesRetryInterval = 30 * time.Second
+
+// The log lines of a v7 client that report a problem start with the level
+// after the time of day, like
+// 12:34:56:WARNING:WU01:FS01:Failed to get assignment from '...': ...
+var logProblemRegexp = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}:(ERROR|WARNING):(.*)$`)
+
+// logCategories tells the category of a problem from its message. The first
+// matching category wins; problems that match none are counted as other.
+var logCategories = []struct {
+	name   string
+	regexp *regexp.Regexp
+}{
+	{"assignment", regexp.MustCompile(`(?i)assignment|no wus available`)},
+	{"upload", regexp.MustCompile(`(?i)send|upload|results`)},
+	{"download", regexp.MustCompile(`(?i)download`)},
+	{"core", regexp.MustCompile(`(?i)\bcore\b|fahcore|bad_work_unit|unstable_machine|faulty`)},
+	{"gpu", regexp.MustCompile(`(?i)\b(gpu|cuda|opencl)\b`)},
+	{"network", regexp.MustCompile(`(?i)connect|timed out|timeout|resolve`)},
+}
+
+// logProblem identifies the problems of a level and category.
+type logProblem struct {
+	level, category string
+}
+
+// parseLogProblem returns the problem reported by a log line, if any.
+func parseLogProblem(line string) (logProblem, bool) {
+	m := logProblemRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return logProblem{}, false
+	}
+	problem := logProblem{level: strings.ToLower(m[1]), category: "other"}
+	for _, c := range logCategories {
+		if c.regexp.MatchString(m[2]) {
+			problem.category = c.name
+			break
+		}
+	}
+	return problem, true
+}
+
+// clientLog keeps a session with a v7 FAHClient subscribed to the lines it
+// appends to its log, and counts the errors and warnings among them. Lines
+// logged while the session is down are missed.
+type clientLog struct {
+	client ClientConfig
+	logger log.Logger
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	done      chan struct{}
+
+	mtx      sync.Mutex
+	partial  string
+	problems map[logProblem]float64
+
+	messages *prometheus.Desc
+}
+
+func newClientLog(client ClientConfig, logger log.Logger) *clientLog {
+	return &clientLog{
+		client:   client,
+		logger:   logger,
+		done:     make(chan struct{}),
+		problems: map[logProblem]float64{},
+		messages: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "log", "messages_total"),
+			"Number of errors and warnings the FAHClient logged, by level and category of the problem: assignment, upload, download, core, gpu, network or other.",
+			[]string{"level", "category"},
+			nil,
+		),
+	}
+}
+
+// collect sends the counters, starting the subscription on first use.
+func (l *clientLog) collect(ch chan<- prometheus.Metric) {
+	l.startOnce.Do(func() {
+		go l.run()
+	})
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for p, n := range l.problems {
+		ch <- prometheus.MustNewConstMetric(l.messages, prometheus.CounterValue, n, p.level, p.category)
+	}
+}
+
+// stop ends the subscription.
+func (l *clientLog) stop() {
+	l.stopOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+func (l *clientLog) run() {
+	for {
+		err := l.subscribe()
+
+		l.mtx.Lock()
+		l.partial = ""
+		l.mtx.Unlock()
+
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		level.Error(l.logger).Log("msg", "Lost log session with FAHClient", "err", err)
+
+		select {
+		case <-l.done:
+			return
+		case <-time.After(logUpdatesRetryInterval):
+		}
+	}
+}
+
+// subscribe establishes a session and counts the problems logged until it
+// fails or the subscription is stopped.
+func (l *clientLog) subscribe() error {
+	api, err := dialFAHClient(context.Background(), l.client)
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-l.done:
+		case <-closed:
+		}
+		api.Close()
+	}()
+
+	if l.client.Password != "" {
+		if err := authenticate(api, l.client.Password); err != nil {
+			return err
+		}
+	}
+	if err := api.SubscribeLog(); err != nil {
+		return err
+	}
+	// The client is silent for as long as it logs nothing.
+	if err := api.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	level.Debug(l.logger).Log("msg", "Subscribed to FAHClient log")
+
+	for {
+		update, err := api.ReadUpdate()
+		if err != nil {
+			return err
+		}
+		if update.Log != "" {
+			l.count(update.Log)
+		}
+	}
+}
+
+// count counts the problems in the text appended to the log, keeping a line
+// that isn't complete yet for the next call.
+func (l *clientLog) count(text string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	lines := strings.Split(l.partial+text, "\n")
+	l.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if p, ok := parseLogProblem(strings.TrimRight(line, "\r")); ok {
+			l.problems[p]++
+		}
+	}
+}
@@ -1,311 +1,1079 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/pprof"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/MakotoE/go-fahapi"
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
-	"gopkg.in/alecthomas/kingpin.v2"
+	"github.com/prometheus/exporter-toolkit/web/kingpinflag"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
 )
 
 const (
-	namespace         = "foldingathome"
-	subsystemSlot     = "slot"
-	subsystemWorkUnit = "work_unit"
+	namespace     = "foldingathome"
+	subsystemSlot = "slot"
 )
 
 type Exporter struct {
-	address string
-	logger  log.Logger
-
-	up                                 *prometheus.Desc
-	uptime                             *prometheus.Desc
-	time                               *prometheus.Desc
-	version                            *prometheus.Desc
-	slotStatus                         *prometheus.Desc
-	slotAttempts                       *prometheus.Desc
-	slotNextAttempt                    *prometheus.Desc
-	slotEstimatedPointsPerDay          *prometheus.Desc
-	workUnitStepsCompletedPercent      *prometheus.Desc
-	workUnitCreditEstimatePoints       *prometheus.Desc
-	workUnitEstimatedCompletionSeconds *prometheus.Desc
-	workUnitTimeRemainingSeconds       *prometheus.Desc
+	client     ClientConfig
+	logger     log.Logger
+	collectors []collector.Collector
+	session    *clientSession
+	updates    *clientUpdates
+	log        *clientLog
+	logFile    *logCounters
+	cache      *pollCache
+	recent     *recentScrape
+	breaker    *circuitBreaker
+	limiter    *scrapeLimiter
+	detected   *detectedProtocol
+
+	up               *prometheus.Desc
+	collectorSuccess *prometheus.Desc
+	commandDuration  *prometheus.Desc
+	lastPoll         *prometheus.Desc
+	breakerOpen      *prometheus.Desc
+	scrapesQueued    *prometheus.Desc
+	commandErrors    *prometheus.Desc
+	errorCounts      *commandErrors
 }
 
-func NewExporter(address string, logger log.Logger) *Exporter {
-	return &Exporter{
-		address: address,
-		logger:  logger,
+// NewExporter returns an Exporter for the given FAHClient, which runs the
+// default collectors followed by the given ones. The frame history is shared
+// by all exporters so that it survives across exporters created per probe
+// request.
+func NewExporter(client ClientConfig, frames *collector.FrameHistory, logger log.Logger, collectors ...collector.Collector) *Exporter {
+	var updates *clientUpdates
+	if client.UpdatesInterval > 0 {
+		updates = newClientUpdates(client, logger)
+	}
+	var clientLog *clientLog
+	if client.LogUpdates {
+		clientLog = newClientLog(client, logger)
+	}
+	var logFile *logCounters
+	if client.Protocol == protocolLog || client.LogCounters {
+		logFile = newLogCounters(client.LogDir, logger)
+	}
+	if client.LogCounters {
+		if err := logFile.backfill(time.Now().Add(-client.LogBackfill)); err != nil {
+			level.Error(logger).Log("msg", "Failed to backfill counters from FAHClient log", "err", err)
+		}
+	}
+	var breaker *circuitBreaker
+	if client.BreakerFailures > 0 {
+		breaker = newCircuitBreaker(client.BreakerFailures, client.BreakerCooldown)
+	}
+	e := &Exporter{
+		client:     client,
+		logger:     logger,
+		collectors: append(collector.Default(client.clientKey(), frames, logger), collectors...),
+		session:    newClientSession(client),
+		updates:    updates,
+		log:        clientLog,
+		logFile:    logFile,
+		breaker:    breaker,
+		limiter:    newScrapeLimiter(client.MaxConcurrentScrapes),
+		recent:     &recentScrape{},
+		detected:   &detectedProtocol{},
 		up: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "up"),
 			"Could the FAHClient be reached.",
 			nil,
 			nil,
 		),
-		uptime: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "uptime_seconds"),
-			"Number of seconds since the FAHClient started.",
-			nil,
-			nil,
-		),
-		time: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "time_seconds"),
-			"Current UNIX time according to the FAHClient.",
-			nil,
+		collectorSuccess: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "scrape", "collector_success"),
+			"Whether the output of a command could be collected from the FAHClient and parsed.",
+			[]string{"collector"},
 			nil,
 		),
-		version: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "version"),
-			"The version of this FAHClient.",
-			[]string{"version"},
+		commandDuration: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "scrape_duration_seconds"),
+			"Time the FAHClient took to answer a command in the last scrape.",
+			[]string{"command"},
 			nil,
 		),
-		slotStatus: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlot, "status"),
-			"The status of the slot, encoded numerically: 0 => uknown, 1 => ready, 2 => download, 3 => running, 4 => upload, 5 => finishing, 6 => stopping, 7 => paused.",
-			[]string{"id", "slot_description"},
+		lastPoll: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "last_poll_timestamp_seconds"),
+			"Timestamp of the last background poll of the FAHClient.",
 			nil,
-		),
-		slotAttempts: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlot, "attempts"),
-			"Number of attempts to download a work unit.",
-			[]string{"id", "slot_description"},
 			nil,
 		),
-		slotNextAttempt: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlot, "next_attempt_seconds"),
-			"Seconds until the next attempt to download a work unit.",
-			[]string{"id", "slot_description"},
+		breakerOpen: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "circuit_breaker_open"),
+			"Whether the FAHClient is no longer queried after consecutive failures to reach it, until the cool-down has passed.",
 			nil,
-		),
-		slotEstimatedPointsPerDay: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlot, "estimated_points_per_day"),
-			"Estimated number of points the slot can produce in a day.",
-			[]string{"id", "slot_description"},
 			nil,
 		),
-		workUnitStepsCompletedPercent: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemWorkUnit, "steps_completed_percent"),
-			"Work unit completion percentage.",
-			[]string{"id", "slot_description", "prcg"},
+		scrapesQueued: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "scrapes_queued_total"),
+			"Number of scrapes that waited for other scrapes of the FAHClient to finish before querying it.",
 			nil,
-		),
-		workUnitCreditEstimatePoints: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemWorkUnit, "credit_estimate_points"),
-			"Estimated number of points that will be credited for the work unit.",
-			[]string{"id", "slot_description", "prcg"},
 			nil,
 		),
-		workUnitEstimatedCompletionSeconds: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemWorkUnit, "estimated_completion_seconds"),
-			"Estimated seconds until the work unit is completed.",
-			[]string{"id", "slot_description", "prcg"},
-			nil,
-		),
-		workUnitTimeRemainingSeconds: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemWorkUnit, "time_remaining_seconds"),
-			"Seconds until the work unit's deadline, after which the work unit is expired and will be discarded by the client.",
-			[]string{"id", "slot_description", "prcg"},
+		commandErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "scrape_errors_total"),
+			"Number of commands to the FAHClient that failed, including those retried.",
+			[]string{"command"},
 			nil,
 		),
+		errorCounts: newCommandErrors(),
+	}
+	if client.CollectInterval > 0 {
+		e.cache = &pollCache{done: make(chan struct{})}
+		go e.poll()
 	}
+	return e
 }
 
 // Describe describes all the metrics exported by the foldingathome exporter. It
 // implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.up
-	ch <- e.uptime
-	ch <- e.time
-	ch <- e.version
-	ch <- e.slotStatus
-	ch <- e.slotAttempts
-	ch <- e.slotNextAttempt
-	ch <- e.workUnitStepsCompletedPercent
-	ch <- e.workUnitCreditEstimatePoints
-	ch <- e.workUnitEstimatedCompletionSeconds
-	ch <- e.workUnitTimeRemainingSeconds
+	ch <- e.collectorSuccess
+	ch <- e.commandDuration
+	ch <- e.commandErrors
+	if e.cache != nil {
+		ch <- e.lastPoll
+	}
+	if e.breaker != nil {
+		ch <- e.breakerOpen
+	}
+	ch <- e.scrapesQueued
+	if e.log != nil {
+		ch <- e.log.messages
+	}
+	if e.client.LogCounters {
+		e.logFile.Describe(ch)
+	}
+	for _, c := range e.collectors {
+		c.Describe(ch)
+	}
+}
+
+// Close closes the sessions kept open with the FAHClient.
+func (e *Exporter) Close() {
+	e.session.close()
+	if e.updates != nil {
+		e.updates.stop()
+	}
+	if e.log != nil {
+		e.log.stop()
+	}
+	if e.cache != nil {
+		close(e.cache.done)
+	}
 }
 
 // Collect fetches the statistics from the configured foldingathome server, and
 // delivers them as Prometheus metrics. It implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	api, err := fahapi.NewAPI(e.address)
-	if err != nil {
-		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
-		level.Error(e.logger).Log("msg", "Failed to connect to FAHClient", "err", err)
+	e.collectContext(context.Background(), ch)
+}
+
+// collectContext collects the metrics, giving up on the FAHClient once ctx
+// expires or the timeout of the client has passed. Scrapes beyond the
+// concurrency limit of the client wait for their turn within that time, and
+// are served the metrics of a scrape less than MinInterval ago, if any.
+func (e *Exporter) collectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.client.LogCounters {
+		// The log is on the exporter's host, so it is read on every
+		// scrape rather than polled.
+		e.logFile.Collect(ch)
+	}
+	if e.cache != nil {
+		e.collectCached(ch)
 		return
 	}
-	defer api.Close()
-
-	up := float64(1)
-	uptime, err := api.Uptime()
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Failed to collect uptime from FAHClient", "err", err)
-		up = 0
+	if e.client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.client.Timeout)
+		defer cancel()
 	}
-	date, err := api.ExecEval("date")
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Failed to collect date from FAHClient", "err", err)
-		up = 0
+	err := e.limiter.acquire(ctx)
+	if err == nil {
+		if e.client.MinInterval > 0 {
+			e.collectRecent(ctx, ch)
+		} else {
+			e.collect(ctx, ch)
+		}
+		e.limiter.release()
+	} else {
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		level.Error(e.logger).Log("msg", "Gave up waiting for other scrapes of the FAHClient", "err", err)
 	}
-	info, err := api.Info()
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Failed to collect info from FAHClient", "err", err)
-		up = 0
+	ch <- prometheus.MustNewConstMetric(e.scrapesQueued, prometheus.CounterValue, float64(e.limiter.queuedTotal()))
+}
+
+// collect queries the FAHClient for its metrics, unless the circuit breaker
+// is open, and returns the state the metrics were collected from, which is nil
+// if the client could not be reached.
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) *clientState {
+	var state *clientState
+	switch {
+	case e.breaker == nil:
+		state, _ = e.collectClient(ctx, ch)
+	case e.breaker.allow():
+		var up bool
+		state, up = e.collectClient(ctx, ch)
+		e.breaker.record(up)
+	default:
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
 	}
-	slotInfo, err := api.SlotInfo()
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Failed to collect slot-info from FAHClient", "err", err)
-		up = 0
+
+	if e.breaker != nil {
+		open := float64(0)
+		if e.breaker.open() {
+			open = 1
+		}
+		ch <- prometheus.MustNewConstMetric(e.breakerOpen, prometheus.GaugeValue, open)
 	}
-	queueInfo, err := api.QueueInfo()
+	e.errorCounts.collect(e.commandErrors, ch)
+	return state
+}
+
+// collectClient queries the FAHClient for its metrics, returning the state
+// they were collected from, and reports whether it could be reached.
+func (e *Exporter) collectClient(ctx context.Context, ch chan<- prometheus.Metric) (*clientState, bool) {
+	protocol, err := e.protocol(ctx)
 	if err != nil {
-		level.Error(e.logger).Log("msg", "Failed to collect queue-info from FAHClient", "err", err)
-		up = 0
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		level.Error(e.logger).Log("msg", "Failed to detect FAHClient protocol", "err", err)
+		return nil, false
 	}
 
-	e.parseUptime(ch, uptime)
-	if err := e.parseDate(ch, date); err != nil {
-		up = 0
+	if protocol == protocolLog {
+		state := e.collectLog(ctx, ch)
+		return state, state != nil
+	}
+	if protocol == protocolV8 {
+		state := e.collectV8(ctx, ch)
+		return state, state != nil
+	}
+	if e.log != nil {
+		e.log.collect(ch)
 	}
-	if err := e.parseInfo(ch, info); err != nil {
-		up = 0
+	if e.updates != nil {
+		// The subscription reconnects on its own schedule.
+		return e.collectUpdates(ctx, ch), true
 	}
-	e.parseSlotInfo(ch, slotInfo)
-	e.parseQueueInfo(ch, slotInfo, queueInfo)
+	state := e.collectV7(ctx, ch)
+	return state, state != nil
+}
 
-	ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, up)
+// collectV7 collects the metrics of a v7 client from its command port and
+// returns the state they were collected from, or nil if the client could not
+// be reached.
+func (e *Exporter) collectV7(ctx context.Context, ch chan<- prometheus.Metric) *clientState {
+	state, err := e.fetchV7(ctx)
+	if state == nil {
+		e.forgetProtocol()
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		level.Error(e.logger).Log("msg", "Failed to connect to FAHClient", "err", err)
+		return nil
+	}
+
+	for _, command := range v7Commands {
+		if d, ok := state.durations[command]; ok {
+			ch <- prometheus.MustNewConstMetric(e.commandDuration, prometheus.GaugeValue, d.Seconds(), command)
+		}
+	}
+	return e.update(ctx, ch, state)
 }
 
-func (e *Exporter) parseUptime(ch chan<- prometheus.Metric, uptime time.Duration) {
-	ch <- prometheus.MustNewConstMetric(e.uptime, prometheus.GaugeValue, uptime.Seconds())
+// fetchV7 queries a v7 client, retrying transient failures. As with queryV7,
+// the state holds the errors of the commands that failed in the last attempt;
+// it is nil if the client could not be reached.
+func (e *Exporter) fetchV7(ctx context.Context) (*clientState, error) {
+	var state *clientState
+	err := e.retry(ctx, func() error {
+		var err error
+		state, err = e.queryV7(ctx)
+		if err == nil {
+			err = state.err()
+		}
+		return err
+	})
+	return state, err
 }
 
-func (e *Exporter) parseDate(ch chan<- prometheus.Metric, date string) error {
-	t, err := time.Parse(time.RFC3339, date)
+// queryV7 runs the commands for a scrape on the session with a v7 client. The
+// state holds the output of the commands that succeeded and the errors of the
+// others; an error means the session could not be established.
+func (e *Exporter) queryV7(ctx context.Context) (*clientState, error) {
+	api, err := e.session.get(ctx)
 	if err != nil {
-		level.Error(e.logger).Log("msg", "Failed to parse date", "err", err)
-		return err
+		return nil, err
 	}
 
-	ch <- prometheus.MustNewConstMetric(e.time, prometheus.GaugeValue, float64(t.Unix()))
-
-	return nil
-}
-
-func (e *Exporter) parseInfo(ch chan<- prometheus.Metric, info [][]interface{}) error {
-	for _, section := range info {
-		if section[0].(string) == "FAHClient" {
-			for _, pairs := range section[1:] {
-				typedPairs := pairs.([]interface{})
-				if typedPairs[0].(string) == "Version" {
-					ch <- prometheus.MustNewConstMetric(e.version, prometheus.GaugeValue, 1, typedPairs[1].(string))
-					return nil
-				}
+	state := &clientState{}
+	state.run("uptime", func() (err error) {
+		state.uptime, err = api.Uptime()
+		return err
+	})
+	state.run("date", func() (err error) {
+		state.date, err = api.Eval("$(date)")
+		return err
+	})
+	state.run("info", func() (err error) {
+		state.info, err = api.Info()
+		return err
+	})
+	state.run("options", func() (err error) {
+		state.options, err = api.Options()
+		return err
+	})
+	state.run("slot-info", func() (err error) {
+		state.slotInfo, err = api.SlotInfo()
+		return err
+	})
+	state.run("slot-options", func() error {
+		if err := state.errs["slot-info"]; err != nil {
+			return err
+		}
+		state.slotOptions = make(map[string]fahclient.SlotOptions, len(state.slotInfo))
+		for _, slot := range state.slotInfo {
+			options, err := api.SlotOptions(slot.ID)
+			if err != nil {
+				return err
 			}
+			state.slotOptions[slot.ID] = options
+		}
+		return nil
+	})
+	state.run("queue-info", func() (err error) {
+		state.queueInfo, err = api.QueueInfo()
+		return err
+	})
+	state.run("ppd", func() (err error) {
+		state.ppd, err = api.PPD()
+		return err
+	})
+	e.session.put(state.err() == nil)
+	for command := range state.errs {
+		if _, ok := state.durations[command]; ok {
+			// Commands skipped after the session broke aren't counted.
+			e.errorCounts.inc(command)
 		}
 	}
 
-	err := errors.New("Version not found in info response")
-	level.Error(e.logger).Log("msg", "Failed to parse version", "err", err)
-
-	return err
+	return state, nil
 }
 
-func (e *Exporter) parseSlotInfo(ch chan<- prometheus.Metric, slotInfo []fahapi.SlotInfo) {
-	statusMap := map[string]float64{
-		"ready":     1,
-		"download":  2,
-		"running":   3,
-		"upload":    4,
-		"finishing": 5,
-		"stopping":  6,
-		"paused":    7,
+// collectLog collects the metrics of a client from its log and returns the
+// state they were collected from, or nil if the log could not be read.
+func (e *Exporter) collectLog(ctx context.Context, ch chan<- prometheus.Metric) *clientState {
+	state, err := e.logFile.clientState()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		level.Error(e.logger).Log("msg", "Failed to read FAHClient log", "err", err)
+		return nil
 	}
 
-	for _, info := range slotInfo {
-		ch <- prometheus.MustNewConstMetric(e.slotStatus, prometheus.GaugeValue, statusMap[strings.ToLower(info.Status)], info.ID, info.Description)
-	}
+	return e.update(ctx, ch, state)
 }
 
-func (e *Exporter) parseQueueInfo(ch chan<- prometheus.Metric, slotInfo []fahapi.SlotInfo, queueInfo []fahapi.SlotQueueInfo) {
-	slotMap := map[string]fahapi.SlotInfo{}
-	for _, sInfo := range slotInfo {
-		slotMap[sInfo.ID] = sInfo
+// collectUpdates collects the metrics of a v7 client from the updates it
+// pushed and returns the state they were collected from, or nil if there were
+// none yet.
+func (e *Exporter) collectUpdates(ctx context.Context, ch chan<- prometheus.Metric) *clientState {
+	state, ok := e.updates.state()
+	if !ok {
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		level.Debug(e.logger).Log("msg", "No updates received from FAHClient yet")
+		return nil
 	}
 
-	for _, qInfo := range queueInfo {
-		id := slotMap[qInfo.Slot].ID
-		desc := slotMap[qInfo.Slot].Description
-		prcg := fmt.Sprintf("%d (%d, %d, %d)", qInfo.Project, qInfo.Run, qInfo.Clone, qInfo.Gen)
-		state := strings.ToLower(qInfo.State)
+	return e.update(ctx, ch, state.clientState())
+}
 
-		if state == "download" {
-			ch <- prometheus.MustNewConstMetric(e.slotAttempts, prometheus.GaugeValue, float64(qInfo.Attempts), id, desc)
-			ch <- prometheus.MustNewConstMetric(e.slotNextAttempt, prometheus.GaugeValue, qInfo.NextAttempt.Seconds(), id, desc)
+// update runs the collectors on the state of a client that could be reached,
+// reporting the success of each collector that the client supports, and
+// returns the state without the slots that aren't exported.
+func (e *Exporter) update(ctx context.Context, ch chan<- prometheus.Metric, state *clientState) *clientState {
+	client := e.filterSlots(state)
+	for _, c := range e.collectors {
+		success := float64(1)
+		err := c.Update(ctx, client, ch)
+		if errors.Is(err, collector.ErrNotSupported) {
+			continue
 		}
-
-		if state == "running" || state == "finishing" {
-			ch <- prometheus.MustNewConstMetric(e.slotEstimatedPointsPerDay, prometheus.GaugeValue, float64(qInfo.PPD), id, desc)
+		if err != nil {
+			level.Error(e.logger).Log("msg", "Collector failed", "collector", c.Name(), "err", err)
+			success = 0
 		}
+		ch <- prometheus.MustNewConstMetric(e.collectorSuccess, prometheus.GaugeValue, success, c.Name())
+	}
+	ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 1)
+	return client
+}
 
-		if !(qInfo.Project == 0 && qInfo.Run == 0 && qInfo.Clone == 0 && qInfo.Gen == 0) {
-			percentDone, err := strconv.ParseFloat(strings.TrimSuffix(qInfo.PercentDone, "%"), 64)
-			if err == nil {
-				ch <- prometheus.MustNewConstMetric(e.workUnitStepsCompletedPercent, prometheus.GaugeValue, percentDone, id, desc, prcg)
-			}
+// filterSlots leaves the slots that aren't exported out of the state.
+func (e *Exporter) filterSlots(state *clientState) *clientState {
+	if !e.client.filtersSlots() {
+		return state
+	}
+	return state.filterSlots(e.client.includeSlot)
+}
 
-			ch <- prometheus.MustNewConstMetric(e.workUnitCreditEstimatePoints, prometheus.GaugeValue, float64(qInfo.CreditEstimate), id, desc, prcg)
-			ch <- prometheus.MustNewConstMetric(e.workUnitEstimatedCompletionSeconds, prometheus.GaugeValue, qInfo.ETA.Seconds(), id, desc, prcg)
-			ch <- prometheus.MustNewConstMetric(e.workUnitTimeRemainingSeconds, prometheus.GaugeValue, qInfo.TimeRemaining.Seconds(), id, desc, prcg)
-		}
+// authenticate issues the auth command, which FAHClient requires for
+// connections from hosts not in its command-allow-no-pass list.
+func authenticate(api *fahclient.Client, password string) error {
+	out, err := api.Exec("auth " + password)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(out, "OK") {
+		return fmt.Errorf("authentication failed: %s", strings.TrimSpace(out))
 	}
+	return nil
 }
 
 func main() {
+	kingpin.Command("serve", "Run the exporter.").Default()
 	var (
-		address       = kingpin.Flag("fahclient.address", "Folding@home client telnet API address.").Default("localhost:36330").String()
-		listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9737").String()
-		metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		healthcheckCmd    = kingpin.Command("healthcheck", "Check the health of a running exporter and exit with status 0 if it is healthy, or 1 otherwise.")
+		scrapeCmd         = kingpin.Command("scrape", "Scrape the FAHClients once, print the metrics in the Prometheus text format to stdout, and exit.")
+		scrapeTimeout     = scrapeCmd.Flag("timeout", "Time after which the FAHClients are given up on.").Default("10s").Duration()
+		checkClient       = healthcheckCmd.Flag("client", "Instead of requesting /-/healthy from the exporter, check that the FAHClient can be reached.").Default("false").Bool()
+		checkUsername     = healthcheckCmd.Flag("username", "Username to request /-/healthy with, when the web configuration file requires basic authentication.").String()
+		checkPasswordFile = healthcheckCmd.Flag("password-file", "File containing the password for --username.").String()
 	)
+	var (
+		addresses           = kingpin.Flag("fahclient.address", "Folding@home client telnet API address. May be repeated to scrape several clients, whose metrics are then labeled with their address in client.").Default("localhost:36330").Strings()
+		password            = kingpin.Flag("fahclient.password", "Password for the FAHClient command port, required when connecting from a host not allowed to connect without a password.").String()
+		passwordFile        = kingpin.Flag("fahclient.password-file", "File containing the password for the FAHClient command port.").String()
+		updatesInterval     = kingpin.Flag("fahclient.updates-interval", "Subscribe to the state the FAHClient pushes at this interval and serve scrapes from it, instead of querying the client on every scrape. 0 disables.").Default("0s").Duration()
+		logUpdates          = kingpin.Flag("fahclient.log-updates", "Subscribe to the log the FAHClient pushes and count the errors and warnings it logs by category. v7 only.").Default("false").Bool()
+		collectInterval     = kingpin.Flag("collect.interval", "Poll the FAHClient in the background at this interval and serve scrapes from the last poll. 0 queries the client on every scrape.").Default("0s").Duration()
+		minInterval         = kingpin.Flag("collect.min-interval", "Serve scrapes arriving less than this interval after the last scrape that queried the FAHClient the metrics of that scrape, instead of querying the client again. 0 disables.").Default("0s").Duration()
+		dialTimeout         = kingpin.Flag("fahclient.dial-timeout", "Timeout for connecting to the FAHClient.").Default(defaultDialTimeout.String()).Duration()
+		readTimeout         = kingpin.Flag("fahclient.read-timeout", "Timeout for the FAHClient to answer a single command.").Default(defaultReadTimeout.String()).Duration()
+		proxyURL            = kingpin.Flag("fahclient.proxy-url", "SOCKS5 or HTTP proxy to connect to the FAHClient through, like socks5://bastion:1080 or http://bastion:3128.").String()
+		maxScrapes          = kingpin.Flag("fahclient.max-concurrent-scrapes", "Maximum number of scrapes querying a FAHClient at the same time, so that several Prometheus servers don't each open a session with it. Further scrapes wait for their turn.").Default("1").Int()
+		clientTimeout       = kingpin.Flag("fahclient.timeout", "Timeout for all commands of a scrape of a FAHClient together, so that slow clients give up before the scrape times out. 0 leaves them to the scrape timeout.").Default("0").Duration()
+		maxConcurrency      = kingpin.Flag("collect.max-concurrency", "Maximum number of FAHClients scraped at the same time. 0 scrapes all of them at once.").Default("0").Int()
+		retries             = kingpin.Flag("fahclient.retries", "Number of times to retry a scrape after a transient failure, like a connection reset.").Default("0").Int()
+		retryDelay          = kingpin.Flag("fahclient.retry-delay", "Delay before the first retry, doubled for each further retry.").Default(defaultRetryDelay.String()).Duration()
+		retryJitter         = kingpin.Flag("fahclient.retry-jitter", "Fraction by which retry delays are randomized in either direction.").Default("0.2").Float64()
+		breakerFailures     = kingpin.Flag("breaker.failures", "Stop querying a FAHClient after this many consecutive failures to reach it, until --breaker.cooldown has passed. Applies to the client given on the command line and to /probe targets. 0 disables.").Default("0").Int()
+		breakerCooldown     = kingpin.Flag("breaker.cooldown", "Time after which a FAHClient is queried again once the circuit breaker stopped querying it.").Default(defaultBreakerCooldown.String()).Duration()
+		probeExpiry         = kingpin.Flag("probe.target-expiry", "Time after which the circuit breaker, scrape limiter, last scrape, command error counts and detected protocol of a /probe target that wasn't probed are discarded.").Default("1h").Duration()
+		protocol            = kingpin.Flag("fahclient.protocol", "API of the FAHClient: v7 for the telnet command port, v8 for the WebSocket API of fah-client 8, auto to detect it, or log to read the state of a v7 client from the log in --fahclient.log-dir instead.").Default(protocolAuto).Enum(protocolAuto, protocolV7, protocolV8, protocolLog)
+		configFile          = kingpin.Flag("config.file", "Path to a YAML file listing the FAHClients to scrape. Overrides --fahclient.address.").String()
+		targetFiles         = kingpin.Flag("discovery.file", "Path to a JSON or YAML file listing FAHClients to scrape in the format of the file-based service discovery of Prometheus, watched for changes. Overrides --fahclient.address. May be repeated.").Strings()
+		targetFileInterval  = kingpin.Flag("discovery.file-interval", "Interval at which the files given by --discovery.file are checked for changes.").Default("30s").Duration()
+		srvNames            = kingpin.Flag("discovery.dns-srv", "DNS SRV record listing FAHClients to scrape, like _fahclient._tcp.example.lan, resolved periodically. Overrides --fahclient.address. May be repeated.").Strings()
+		srvInterval         = kingpin.Flag("discovery.dns-interval", "Interval at which the records given by --discovery.dns-srv are resolved.").Default("30s").Duration()
+		mdns                = kingpin.Flag("discovery.mdns", "Scrape the FAHClients advertised on the local network with multicast DNS as instances of --discovery.mdns-service. Overrides --fahclient.address.").Default("false").Bool()
+		mdnsService         = kingpin.Flag("discovery.mdns-service", "mDNS service the FAHClients are advertised as.").Default("_fahclient._tcp").String()
+		mdnsHosts           = kingpin.Flag("discovery.mdns-host", "Name of a host on the local network, resolved with multicast DNS in .local, to scrape the FAHClient of if its port, 36330 unless given as name:port, accepts connections. Overrides --fahclient.address. May be repeated.").Strings()
+		mdnsInterval        = kingpin.Flag("discovery.mdns-interval", "Interval at which the local network is searched for FAHClients with multicast DNS.").Default("1m").Duration()
+		kubernetes          = kingpin.Flag("discovery.kubernetes", "Scrape the FAHClients of the running pods with the --discovery.kubernetes-annotation annotation set to true, listed from the API server of the cluster the exporter runs in. Overrides --fahclient.address.").Default("false").Bool()
+		kubernetesNamespace = kingpin.Flag("discovery.kubernetes-namespace", "Namespace to list the pods of, instead of all namespaces.").String()
+		kubernetesScrape    = kingpin.Flag("discovery.kubernetes-annotation", "Annotation of the pods to scrape.").Default("fah.exporter/scrape").String()
+		kubernetesPort      = kingpin.Flag("discovery.kubernetes-port-annotation", "Annotation of the pods giving the FAHClient port, 36330 if not set.").Default("fah.exporter/port").String()
+		kubernetesInterval  = kingpin.Flag("discovery.kubernetes-interval", "Interval at which the pods are listed.").Default("30s").Duration()
+		metricsPath         = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		livenessPath        = kingpin.Flag("web.liveness-path", "Path under which to expose the lightweight liveness probe of the FAHClient.").Default("/liveness").String()
+		enablePprof         = kingpin.Flag("web.enable-pprof", "Expose the profiling endpoints of net/http/pprof under /debug/pprof.").Default("false").Bool()
+		readyCheckClient    = kingpin.Flag("web.ready-check-client", "Only report ready on /-/ready while the FAHClients can be reached.").Default("false").Bool()
+		scrapeTimeoutOffset = kingpin.Flag("scrape.timeout-offset", "Time subtracted from the scrape timeout Prometheus announces, leaving room to deliver the metrics collected until then.").Default("500ms").Duration()
+		shutdownTimeout     = kingpin.Flag("web.shutdown-timeout", "Time to wait for in-flight scrapes to finish when shutting down.").Default("30s").Duration()
+		pushGatewayURL      = kingpin.Flag("push.gateway-url", "URL of a Prometheus Pushgateway to push the metrics to, for machines that can't be scraped.").String()
+		pushInterval        = kingpin.Flag("push.interval", "Interval at which the metrics are pushed to the Pushgateway.").Default("1m").Duration()
+		pushJob             = kingpin.Flag("push.job", "Job label of the metrics pushed to the Pushgateway or remote-write endpoint.").Default("foldingathome").String()
+		pushInstance        = kingpin.Flag("push.instance", "Instance label of the metrics pushed to the Pushgateway or remote-write endpoint. Defaults to the hostname.").String()
+		remoteWriteURL      = kingpin.Flag("remote-write.url", "URL of a Prometheus remote-write endpoint to send the metrics to, for machines that can't be reached inbound.").String()
+		remoteWriteInterval = kingpin.Flag("remote-write.interval", "Interval at which the metrics are sampled and sent to the remote-write endpoint.").Default("1m").Duration()
+		bearerTokenFile     = kingpin.Flag("remote-write.bearer-token-file", "File containing the bearer token to authenticate to the remote-write endpoint.").String()
+		mqttBroker          = kingpin.Flag("mqtt.broker", "URL of an MQTT broker to publish the status of the FAHClients to, like tcp://localhost:1883.").String()
+		mqttTopicPrefix     = kingpin.Flag("mqtt.topic-prefix", "Prefix of the MQTT topics the status is published to.").Default("foldingathome").String()
+		mqttInterval        = kingpin.Flag("mqtt.interval", "Interval at which the status is published to the MQTT broker.").Default("1m").Duration()
+		mqttClientID        = kingpin.Flag("mqtt.client-id", "MQTT client ID. Defaults to foldingathome_exporter and the hostname.").String()
+		mqttUsername        = kingpin.Flag("mqtt.username", "Username for the MQTT broker.").String()
+		mqttPasswordFile    = kingpin.Flag("mqtt.password-file", "File containing the password for the MQTT broker.").String()
+		mqttDiscovery       = kingpin.Flag("mqtt.homeassistant-discovery", "Announce the slots to Home Assistant as sensors by MQTT discovery.").Default("false").Bool()
+		mqttDiscoveryPrefix = kingpin.Flag("mqtt.homeassistant-prefix", "Discovery prefix of Home Assistant.").Default("homeassistant").String()
+		webhookURL          = kingpin.Flag("webhook.url", "URL of a webhook to send alerts about dumped work units, failed slots and work units at risk of missing their deadline to.").String()
+		webhookFormat       = kingpin.Flag("webhook.format", "Format of the webhook payload: generic, slack or discord.").Default(webhookGeneric).Enum(webhookGeneric, webhookSlack, webhookDiscord)
+		webhookInterval     = kingpin.Flag("webhook.interval", "Interval at which the FAHClients are checked for problems to alert about.").Default("1m").Duration()
+		corsOrigins         = kingpin.Flag("web.cors-origin", "Origin allowed to read /api/v1/status, /events and /ws from a browser, or * for any origin. May be repeated.").Strings()
+		eventsInterval      = kingpin.Flag("web.events-interval", "Interval at which the FAHClients are polled while anyone is subscribed to /events or /ws.").Default("10s").Duration()
+		livenessTimeout     = kingpin.Flag("liveness.timeout", "Timeout for connecting to the FAHClient and reading its greeting in the liveness probe.").Default("5s").Duration()
+		sysfsPath           = kingpin.Flag("path.sysfs", "sysfs mountpoint, used by collectors that read local hardware telemetry.").Default("/sys").String()
+		percentProgress     = kingpin.Flag("collector.steps-completed-percent", "Also export the completion of work units as foldingathome_work_unit_steps_completed_percent, which is superseded by foldingathome_work_unit_progress_ratio and kept for existing dashboards.").Default("true").Bool()
+		stateFilePath       = kingpin.Flag("state.file", "File the counters derived from the changes seen between scrapes, like the work units completed, are kept in across restarts.").String()
+		stateFileInterval   = kingpin.Flag("state.interval", "Interval at which the counters are saved to the state file.").Default("1m").Duration()
+		workUnitsDisabled   = kingpin.Flag("collector.workunit.disabled", "Leave out the foldingathome_work_unit_* metrics, keeping only those of slots.").Default("false").Bool()
+		slotInclude         = kingpin.Flag("slot.include", "Only export the slots whose ID or description matches this regular expression.").String()
+		slotExclude         = kingpin.Flag("slot.exclude", "Don't export the slots whose ID or description matches this regular expression.").String()
+		slotStateSet        = kingpin.Flag("collector.slot-state", "Also export the status of each slot as one series per state, set to 1 for the current state.").Default("false").Bool()
+		constLabels         = kingpin.Flag("label", "Constant label to add to all metrics, as name=value. May be repeated.").PlaceHolder("NAME=VALUE").StringMap()
+		metricsNamespace    = kingpin.Flag("metrics.namespace", "Namespace the names of the metrics are prefixed with, instead of foldingathome.").Default(namespace).String()
+		donorLabels         = kingpin.Flag("collector.donor-labels", "Add the user and team the FAHClient folds for to all of its metrics.").Default("false").Bool()
+		prcgLabels          = kingpin.Flag("collector.prcg-labels", "How foldingathome_work_unit_info labels the work unit: prcg for the project, run, clone and gen together in prcg, split for separate project, run, clone and gen labels instead, or project for a project label in addition to prcg.").Default(prcgLabelsCombined).Enum(prcgLabelsCombined, prcgLabelsSplit, prcgLabelsProject)
+		intelGPU            = kingpin.Flag("collector.intel-gpu", "Export temperature, frequency and utilization of Intel GPUs assigned to GPU slots. Requires the exporter to run on the FAHClient host.").Default("false").Bool()
+		logDir              = kingpin.Flag("fahclient.log-dir", "FAHClient data directory containing log.txt. When set, completed work units, credited points and bytes transferred are counted from the log.").String()
+		backfillMaxAge      = kingpin.Flag("backfill.max-age", "On startup, count the work units completed within this period from the existing FAHClient logs.").Default("24h").Duration()
+		configXML           = kingpin.Flag("collector.config-xml", "Path of the config.xml of the FAHClient to export the configured slots and donor from, to compare them with those the client runs with. Requires the exporter to run on the FAHClient host.").String()
+		hwmon               = kingpin.Flag("collector.hwmon", "Export the CPU package temperature read from hwmon for CPU slots. Requires the exporter to run on the FAHClient host.").Default("false").Bool()
+		projectInfo         = kingpin.Flag("collector.project-info", "Export the cause, manager, institution and description of the projects of the work units in the queue, looked up in the Folding@home stats API.").Default("false").Bool()
+		qrb                 = kingpin.Flag("collector.qrb", "Export the quick return bonus of the work units in the queue estimated from the k-factor of their project, looked up in the Folding@home stats API.").Default("false").Bool()
+		statsUser           = kingpin.Flag("stats.user", "Donor to export the points, work units and rank of from the Folding@home stats API.").String()
+		statsTeams          = kingpin.Flag("stats.team", "Number of a team to export the points, work units, rank and members of from the Folding@home stats API. May be repeated.").Ints()
+		statsURL            = kingpin.Flag("stats.url", "Base URL of the Folding@home stats API.").Default("https://api.foldingathome.org").String()
+		statsTimeout        = kingpin.Flag("stats.timeout", "Timeout for requests to the Folding@home stats API.").Default("10s").Duration()
+		statsInterval       = kingpin.Flag("stats.interval", "Interval at which the stats are refreshed from the Folding@home stats API, which only updates them hourly, however often the exporter is scraped.").Default("1h").Duration()
+		statsCacheFile      = kingpin.Flag("stats.cache-file", "File the responses of the Folding@home stats API, and the donor points counter derived from them, are kept in across restarts.").String()
+
+		disableExporterMetrics = kingpin.Flag("web.disable-exporter-metrics", "Exclude the metrics about the exporter itself (promhttp_*, process_*, go_*).").Default("false").Bool()
+
+		guardMaxTemperature    = kingpin.Flag("thermal-guard.max-temperature", "Pause a GPU slot when its GPU reaches this temperature in degrees Celsius. 0 disables the thermal guard. Requires the exporter to run on the FAHClient host.").Default("0").Float64()
+		guardResumeTemperature = kingpin.Flag("thermal-guard.resume-temperature", "Unpause a slot paused by the thermal guard once its GPU has cooled down to this temperature in degrees Celsius.").Default("0").Float64()
+		guardInterval          = kingpin.Flag("thermal-guard.interval", "How often the thermal guard checks GPU temperatures.").Default("30s").Duration()
+	)
+	addServiceCommands(kingpin.CommandLine)
+	webConfig := kingpinflag.AddFlags(kingpin.CommandLine, ":9737")
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 	logger := promlog.New(promlogConfig)
 
+	if serviceCommand(command, logger) {
+		return
+	}
+	if command == healthcheckCmd.FullCommand() {
+		client := ClientConfig{Address: (*addresses)[0], Protocol: *protocol}
+		if err := healthcheck((*webConfig.WebListenAddresses)[0], *webConfig.WebConfigFile, *checkUsername, *checkPasswordFile, *checkClient, client, *livenessTimeout, logger); err != nil {
+			level.Error(logger).Log("msg", "Health check failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	level.Info(logger).Log("msg", "Starting foldingathome_exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
 
-	prometheus.MustRegister(NewExporter(*address, logger))
+	if !model.IsValidMetricName(model.LabelValue(*metricsNamespace + "_up")) {
+		level.Error(logger).Log("msg", "--metrics.namespace is not a valid metric name prefix", "namespace", *metricsNamespace)
+		os.Exit(1)
+	}
+
+	for name := range *constLabels {
+		if !model.LabelName(name).IsValid() {
+			level.Error(logger).Log("msg", "--label has an invalid label name", "name", name)
+			os.Exit(1)
+		}
+	}
+
+	var stats *statsAPI
+	if *statsUser != "" || len(*statsTeams) > 0 || *projectInfo || *qrb {
+		stats = newStatsAPI(*statsURL, *statsTimeout, *statsInterval, *statsCacheFile, logger)
+		if err := stats.load(); err != nil {
+			level.Error(logger).Log("msg", "Error loading stats cache", "path", *statsCacheFile, "err", err)
+			os.Exit(1)
+		}
+		if command == scrapeCmd.FullCommand() {
+			stats.onDemand = true
+		} else {
+			go stats.run()
+		}
+	}
+
+	var clientCollectors []collector.Collector
+	if *slotStateSet {
+		clientCollectors = append(clientCollectors, collector.NewSlotStateCollector())
+	}
+	if *percentProgress && !*workUnitsDisabled {
+		clientCollectors = append(clientCollectors, collector.NewStepsCompletedPercentCollector())
+	}
+	if *projectInfo {
+		clientCollectors = append(clientCollectors, newProjectInfoCollector(stats, logger))
+	}
+	if *qrb && !*workUnitsDisabled {
+		clientCollectors = append(clientCollectors, newQRBCollector(stats, logger))
+	}
+	var localCollectors []collector.Collector
+	if *intelGPU {
+		localCollectors = append(localCollectors, newIntelGPUCollector(*sysfsPath, logger))
+	}
+	if *hwmon {
+		localCollectors = append(localCollectors, newHwmonCollector(*sysfsPath, logger))
+	}
+	if *configXML != "" {
+		localCollectors = append(localCollectors, newConfigXMLCollector(*configXML))
+	}
+
+	if *passwordFile != "" {
+		if *password != "" {
+			level.Error(logger).Log("msg", "At most one of --fahclient.password and --fahclient.password-file must be set")
+			os.Exit(1)
+		}
+		p, err := readPasswordFile(*passwordFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error reading password file", "err", err)
+			os.Exit(1)
+		}
+		*password = p
+	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	if *retries < 0 {
+		level.Error(logger).Log("msg", "--fahclient.retries must not be negative")
+		os.Exit(1)
+	}
+	if *retryJitter < 0 || *retryJitter > 1 {
+		level.Error(logger).Log("msg", "--fahclient.retry-jitter must be between 0 and 1")
+		os.Exit(1)
+	}
+	if *breakerFailures < 0 {
+		level.Error(logger).Log("msg", "--breaker.failures must not be negative")
+		os.Exit(1)
+	}
+	if *eventsInterval <= 0 {
+		level.Error(logger).Log("msg", "--web.events-interval must be positive")
+		os.Exit(1)
+	}
+	if *clientTimeout < 0 {
+		level.Error(logger).Log("msg", "--fahclient.timeout must not be negative")
+		os.Exit(1)
+	}
+	if *maxConcurrency < 0 {
+		level.Error(logger).Log("msg", "--collect.max-concurrency must not be negative")
+		os.Exit(1)
+	}
+	if *minInterval < 0 {
+		level.Error(logger).Log("msg", "--collect.min-interval must not be negative")
+		os.Exit(1)
+	}
+	if *maxScrapes <= 0 {
+		level.Error(logger).Log("msg", "--fahclient.max-concurrent-scrapes must be positive")
+		os.Exit(1)
+	}
+
+	if *protocol != protocolLog {
+		for _, address := range *addresses {
+			if err := validateAddress(address); err != nil {
+				level.Error(logger).Log("msg", "Invalid --fahclient.address", "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	defaultClient := ClientConfig{
+		Address:              (*addresses)[0],
+		Password:             *password,
+		Protocol:             *protocol,
+		LogDir:               *logDir,
+		LogCounters:          *logDir != "",
+		LogBackfill:          *backfillMaxAge,
+		Timeout:              *clientTimeout,
+		DialTimeout:          *dialTimeout,
+		ReadTimeout:          *readTimeout,
+		Retries:              *retries,
+		RetryDelay:           *retryDelay,
+		RetryJitter:          *retryJitter,
+		BreakerFailures:      *breakerFailures,
+		BreakerCooldown:      *breakerCooldown,
+		UpdatesInterval:      *updatesInterval,
+		LogUpdates:           *logUpdates,
+		CollectInterval:      *collectInterval,
+		MinInterval:          *minInterval,
+		MaxConcurrentScrapes: *maxScrapes,
+	}
+	if *protocol == protocolLog && *logDir == "" {
+		level.Error(logger).Log("msg", "--fahclient.protocol=log requires --fahclient.log-dir")
+		os.Exit(1)
+	}
+	if *protocol == protocolLog && len(*addresses) > 1 {
+		level.Error(logger).Log("msg", "--fahclient.protocol=log reads a single client from --fahclient.log-dir and can't be used with several --fahclient.address")
+		os.Exit(1)
+	}
+	if *logDir != "" && len(*addresses) > 1 {
+		level.Error(logger).Log("msg", "--fahclient.log-dir belongs to a single client and can't be used with several --fahclient.address")
+		os.Exit(1)
+	}
+	if *slotInclude != "" {
+		re, err := NewRegexp(*slotInclude)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid --slot.include", "err", err)
+			os.Exit(1)
+		}
+		defaultClient.SlotInclude = re
+	}
+	if *slotExclude != "" {
+		re, err := NewRegexp(*slotExclude)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid --slot.exclude", "err", err)
+			os.Exit(1)
+		}
+		defaultClient.SlotExclude = re
+	}
+	if *proxyURL != "" {
+		u, err := ParseProxyURL(*proxyURL)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid --fahclient.proxy-url", "err", err)
+			os.Exit(1)
+		}
+		defaultClient.ProxyURL = u
+	}
+	frames := collector.NewFrameHistory()
+	var state *stateFile
+	if *stateFilePath != "" {
+		if *stateFileInterval <= 0 {
+			level.Error(logger).Log("msg", "--state.interval must be positive")
+			os.Exit(1)
+		}
+		state = newStateFile(*stateFilePath, *stateFileInterval, frames, logger)
+		if err := state.load(); err != nil {
+			level.Error(logger).Log("msg", "Error loading state file", "path", *stateFilePath, "err", err)
+			os.Exit(1)
+		}
+		go state.run()
+	}
+	probes := newProbeTargets(*probeExpiry, newBreakerSet(*breakerFailures, *breakerCooldown), newScrapeLimiterSet(*maxScrapes))
+	// Several clients given on the command line are labeled by their address,
+	// like the clients of the configuration file by their name.
+	defaultClients := []ClientConfig{defaultClient}
+	if len(*addresses) > 1 {
+		defaultClients = defaultClients[:0]
+		seen := map[string]bool{}
+		for _, address := range *addresses {
+			if seen[address] {
+				level.Error(logger).Log("msg", "Duplicate --fahclient.address", "address", address)
+				os.Exit(1)
+			}
+			seen[address] = true
+			client := defaultClient
+			client.Name = address
+			client.Address = address
+			defaultClients = append(defaultClients, client)
+		}
+	}
+	var discoverers []discoverer
+	for _, path := range *targetFiles {
+		discoverers = append(discoverers, targetFile(path))
+	}
+	var srv *srvDiscovery
+	if len(*srvNames) > 0 {
+		if *srvInterval <= 0 {
+			level.Error(logger).Log("msg", "--discovery.dns-interval must be positive")
+			os.Exit(1)
+		}
+		srv = newSRVDiscovery(*srvNames, *dialTimeout, logger)
+		srv.refresh()
+		discoverers = append(discoverers, srv)
+	}
+	var mdnsClients *mdnsDiscovery
+	if *mdns || len(*mdnsHosts) > 0 {
+		if *mdnsInterval <= 0 {
+			level.Error(logger).Log("msg", "--discovery.mdns-interval must be positive")
+			os.Exit(1)
+		}
+		service := ""
+		if *mdns {
+			service = *mdnsService
+		}
+		mdnsClients = newMDNSDiscovery(service, *mdnsHosts, *dialTimeout, logger)
+		mdnsClients.refresh()
+		discoverers = append(discoverers, mdnsClients)
+	}
+	var pods *kubernetesDiscovery
+	if *kubernetes {
+		if *kubernetesInterval <= 0 {
+			level.Error(logger).Log("msg", "--discovery.kubernetes-interval must be positive")
+			os.Exit(1)
+		}
+		var err error
+		pods, err = newKubernetesDiscovery(*kubernetesNamespace, *kubernetesScrape, *kubernetesPort, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up Kubernetes discovery", "err", err)
+			os.Exit(1)
+		}
+		pods.refresh()
+		discoverers = append(discoverers, pods)
+	}
+	if *logDir != "" && (*configFile != "" || len(discoverers) > 0) {
+		level.Error(logger).Log("msg", "--fahclient.log-dir belongs to the client given by --fahclient.address and can't be used with --config.file or discovery")
+		os.Exit(1)
+	}
+	registries := newClientRegistries(*configFile, discoverers, defaultClients, *maxConcurrency, *livenessTimeout, frames, clientCollectors, localCollectors, logger)
+	if err := registries.reload(); err != nil {
+		level.Error(logger).Log("msg", "Error loading config", "err", err)
+		os.Exit(1)
+	}
+	relabel := func(g prometheus.Gatherer) prometheus.Gatherer {
+		if *workUnitsDisabled {
+			g = withoutMetricsGatherer{g, namespace + "_work_unit_"}
+		}
+		if *prcgLabels != prcgLabelsCombined {
+			g = prcgLabelsGatherer{g, *prcgLabels}
+		}
+		if *donorLabels {
+			g = donorLabelsGatherer{g}
+		}
+		return g
+	}
+	clientGatherer := func(ctx context.Context) prometheus.Gatherer {
+		return relabel(registries.metricsGatherer(ctx))
+	}
+	export := func(g prometheus.Gatherer) prometheus.Gatherer {
+		if len(*constLabels) > 0 {
+			g = constLabelsGatherer{g, *constLabels}
+		}
+		if *metricsNamespace != namespace {
+			g = namespaceGatherer{g, *metricsNamespace}
+		}
+		return g
+	}
+	if command == scrapeCmd.FullCommand() {
+		ctx, cancel := context.WithTimeout(context.Background(), *scrapeTimeout)
+		err := writeMetrics(export(clientGatherer(ctx)), os.Stdout)
+		cancel()
+		registries.close()
+		if err != nil {
+			level.Error(logger).Log("msg", "Error gathering metrics", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(registries)
+	if !*disableExporterMetrics {
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := registries.reload(); err != nil {
+				level.Error(logger).Log("msg", "Error reloading config", "err", err)
+			}
+		}
+	}()
+	if len(*targetFiles) > 0 {
+		if *targetFileInterval <= 0 {
+			level.Error(logger).Log("msg", "--discovery.file-interval must be positive")
+			os.Exit(1)
+		}
+		go runDiscovery(*targetFileInterval, newTargetFileWatcher(*targetFiles).changed, registries.reload, logger)
+	}
+	if srv != nil {
+		go runDiscovery(*srvInterval, srv.refresh, registries.reload, logger)
+	}
+	if mdnsClients != nil {
+		go runDiscovery(*mdnsInterval, mdnsClients.refresh, registries.reload, logger)
+	}
+	if pods != nil {
+		go runDiscovery(*kubernetesInterval, pods.refresh, registries.reload, logger)
+	}
+
+	if *statsUser != "" {
+		registry.MustRegister(newDonorStatsCollector(stats, *statsUser, logger))
+	}
+	if len(*statsTeams) > 0 {
+		registry.MustRegister(newTeamStatsCollector(stats, *statsTeams, logger))
+	}
+
+	if *guardMaxTemperature > 0 {
+		if *guardResumeTemperature <= 0 || *guardResumeTemperature >= *guardMaxTemperature {
+			level.Error(logger).Log("msg", "--thermal-guard.resume-temperature must be between 0 and --thermal-guard.max-temperature")
+			os.Exit(1)
+		}
+		if *configFile != "" {
+			level.Error(logger).Log("msg", "--thermal-guard.max-temperature guards the client given by --fahclient.address and can't be used with --config.file")
+			os.Exit(1)
+		}
+		if !defaultClient.isLocal() {
+			level.Error(logger).Log("msg", "--thermal-guard.max-temperature reads the GPUs of the exporter's host and can only guard a client on it", "address", defaultClient.Address)
+			os.Exit(1)
+		}
+		guard := newThermalGuard(defaultClient, *sysfsPath, *guardMaxTemperature, *guardResumeTemperature, *guardInterval, logger)
+		registry.MustRegister(guard)
+		go guard.run()
+	}
+
+	pushGatherer := func(ctx context.Context) prometheus.Gatherer {
+		return export(prometheus.Gatherers{registry, clientGatherer(ctx)})
+	}
+	if *pushGatewayURL != "" {
+		if *pushInterval <= 0 {
+			level.Error(logger).Log("msg", "--push.interval must be positive")
+			os.Exit(1)
+		}
+		instance, err := instanceLabel(*pushInstance)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error determining hostname for --push.instance", "err", err)
+			os.Exit(1)
+		}
+		pushGateway := newPushGateway(*pushGatewayURL, *pushJob, instance, *pushInterval, pushGatherer, logger)
+		go pushGateway.run()
+	}
+	if *remoteWriteURL != "" {
+		if *remoteWriteInterval <= 0 {
+			level.Error(logger).Log("msg", "--remote-write.interval must be positive")
+			os.Exit(1)
+		}
+		instance, err := instanceLabel(*pushInstance)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error determining hostname for --push.instance", "err", err)
+			os.Exit(1)
+		}
+		var bearerToken string
+		if *bearerTokenFile != "" {
+			bearerToken, err = readPasswordFile(*bearerTokenFile)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error reading bearer token file", "err", err)
+				os.Exit(1)
+			}
+		}
+		labels := prometheus.Labels{"job": *pushJob, "instance": instance}
+		remoteWriter := newRemoteWriter(*remoteWriteURL, bearerToken, *remoteWriteInterval, labels, pushGatherer, logger)
+		go remoteWriter.run()
+	}
+
+	if *mqttBroker != "" {
+		if *mqttInterval <= 0 {
+			level.Error(logger).Log("msg", "--mqtt.interval must be positive")
+			os.Exit(1)
+		}
+		clientID := *mqttClientID
+		if clientID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				level.Error(logger).Log("msg", "Error determining hostname for --mqtt.client-id", "err", err)
+				os.Exit(1)
+			}
+			clientID = "foldingathome_exporter-" + hostname
+		}
+		var mqttPassword string
+		if *mqttPasswordFile != "" {
+			p, err := readPasswordFile(*mqttPasswordFile)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error reading MQTT password file", "err", err)
+				os.Exit(1)
+			}
+			mqttPassword = p
+		}
+		var discoveryPrefix string
+		if *mqttDiscovery {
+			discoveryPrefix = *mqttDiscoveryPrefix
+		}
+		publisher := newMQTTPublisher(*mqttBroker, clientID, *mqttUsername, mqttPassword, *mqttTopicPrefix, discoveryPrefix, *mqttInterval, registries, logger)
+		go publisher.run()
+	}
+
+	if *webhookURL != "" {
+		if *webhookInterval <= 0 {
+			level.Error(logger).Log("msg", "--webhook.interval must be positive")
+			os.Exit(1)
+		}
+		notifier := newWebhookNotifier(*webhookURL, *webhookFormat, *webhookInterval, registries, logger)
+		go notifier.run()
+	}
+
+	var metricsHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r, *scrapeTimeoutOffset)
+		defer cancel()
+		gatherers := prometheus.Gatherers{registry, clientGatherer(ctx)}
+		promhttp.HandlerFor(export(gatherers), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+	if !*disableExporterMetrics {
+		metricsHandler = promhttp.InstrumentMetricHandler(registry, metricsHandler)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(*metricsPath, metricsHandler)
+	mux.Handle(*livenessPath, promhttp.HandlerFor(export(registries.livenessGatherer()), promhttp.HandlerOpts{}))
+	mux.HandleFunc("/-/reload", registries.reloadHandler)
+	mux.HandleFunc("/-/healthy", healthyHandler)
+	mux.HandleFunc("/-/ready", registries.readyHandler(*readyCheckClient))
+	hub := newStatusHub(registries, *eventsInterval, logger)
+	mux.Handle("/api/v1/status", corsHandler(*corsOrigins, http.HandlerFunc(registries.statusHandler)))
+	mux.Handle("/events", corsHandler(*corsOrigins, http.HandlerFunc(hub.eventsHandler)))
+	mux.Handle("/ws", hub.wsHandler(wsUpgrader(*corsOrigins)))
+	mux.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		probeHandler(w, r, defaultClient, *scrapeTimeoutOffset, frames, clientCollectors, func(g prometheus.Gatherer) prometheus.Gatherer {
+			return export(relabel(g))
+		}, probes, logger)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>Folding@home Exporter</title></head>
              <body>
              <h1>Folding@home Exporter</h1>
              <p><a href='` + *metricsPath + `'>Metrics</a></p>
+             <p><a href='` + *livenessPath + `'>Liveness</a></p>
+             <p><a href='/api/v1/status'>Status</a></p>
+             <p><a href='/probe?target=localhost:36330'>Probe localhost:36330</a></p>
              </body>
              </html>`))
 	})
 
-	level.Info(logger).Log("msg", "Listening on address", "address", *listenAddress)
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	if *enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	server := &http.Server{Handler: mux}
+	server.RegisterOnShutdown(hub.close)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- listenAndServe(server, webConfig, logger)
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	serviceStopped := runService(term, logger)
+	select {
+	case err := <-errc:
 		level.Error(logger).Log("msg", "Error running HTTP server", "err", err)
 		os.Exit(1)
+	case sig := <-term:
+		level.Info(logger).Log("msg", "Shutting down", "signal", sig)
+	}
+
+	// Stop accepting connections and wait for in-flight scrapes to finish
+	// before closing the sessions they use.
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		level.Error(logger).Log("msg", "Error shutting down HTTP server", "err", err)
+	}
+	registries.close()
+	if state != nil {
+		if err := state.save(); err != nil {
+			level.Error(logger).Log("msg", "Failed to save state file", "path", *stateFilePath, "err", err)
+		}
 	}
+	serviceStopped()
 }
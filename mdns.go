@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultFAHClientPort is the port of the command API of v7 clients.
+const defaultFAHClientPort = 36330
+
+// mdnsQueryTimeout is how long responses to an mDNS query are collected.
+const mdnsQueryTimeout = 2 * time.Second
+
+// mdnsAddress is where mDNS queries are sent.
+var mdnsAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsDiscovery is a discoverer finding the clients on the local network with
+// multicast DNS: the instances of a service, like _fahclient._tcp, advertised
+// by the hosts of clients, and hosts of well-known names, like rig1.local,
+// whose FAHClient port accepts connections. Queries are sent from an
+// ephemeral port, so that responders answer the exporter directly, as they
+// do for regular DNS resolvers.
+type mdnsDiscovery struct {
+	resolvedTargets
+	service     string
+	hosts       []string
+	dialTimeout time.Duration
+	logger      log.Logger
+}
+
+func newMDNSDiscovery(service string, hosts []string, dialTimeout time.Duration, logger log.Logger) *mdnsDiscovery {
+	return &mdnsDiscovery{
+		service:     service,
+		hosts:       hosts,
+		dialTimeout: dialTimeout,
+		logger:      logger,
+	}
+}
+
+// mdnsRecords are the records of mDNS responses, by lowercase name.
+type mdnsRecords struct {
+	ptr map[string][]string
+	srv map[string]dnsmessage.SRVResource
+	a   map[string]net.IP
+}
+
+// refresh looks for the clients and reports whether the targets changed. The
+// targets are kept if the network fails.
+func (d *mdnsDiscovery) refresh() bool {
+	records := mdnsRecords{
+		ptr: map[string][]string{},
+		srv: map[string]dnsmessage.SRVResource{},
+		a:   map[string]net.IP{},
+	}
+
+	var questions []dnsmessage.Question
+	if d.service != "" {
+		questions = append(questions, mdnsQuestion(d.service+".local.", dnsmessage.TypePTR))
+	}
+	for _, host := range d.hosts {
+		name, _ := splitHostPort(host)
+		questions = append(questions, mdnsQuestion(name+".local.", dnsmessage.TypeA))
+	}
+	if err := mdnsQuery(questions, &records); err != nil {
+		level.Error(d.logger).Log("msg", "Failed to query mDNS", "err", err)
+		return false
+	}
+
+	// Responders usually include the records of the instances and their
+	// hosts, but aren't required to.
+	var missing []dnsmessage.Question
+	for _, instance := range records.ptr[strings.ToLower(d.service+".local.")] {
+		srv, ok := records.srv[instance]
+		if !ok {
+			missing = append(missing, mdnsQuestion(instance, dnsmessage.TypeSRV))
+		} else if records.a[strings.ToLower(srv.Target.String())] == nil {
+			missing = append(missing, mdnsQuestion(srv.Target.String(), dnsmessage.TypeA))
+		}
+	}
+	if len(missing) > 0 {
+		if err := mdnsQuery(missing, &records); err != nil {
+			level.Error(d.logger).Log("msg", "Failed to query mDNS", "err", err)
+			return false
+		}
+	}
+
+	var targets []discoveredTarget
+	for _, instance := range records.ptr[strings.ToLower(d.service+".local.")] {
+		srv, ok := records.srv[instance]
+		if !ok {
+			continue
+		}
+		if ip := records.a[strings.ToLower(srv.Target.String())]; ip != nil {
+			targets = append(targets, discoveredTarget{address: net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port)))})
+		}
+	}
+	for _, host := range d.hosts {
+		name, port := splitHostPort(host)
+		ip := records.a[strings.ToLower(name+".local.")]
+		if ip == nil {
+			continue
+		}
+		target := net.JoinHostPort(ip.String(), port)
+		conn, err := net.DialTimeout("tcp", target, d.dialTimeout)
+		if err != nil {
+			level.Debug(d.logger).Log("msg", "Host doesn't accept FAHClient connections", "host", host, "err", err)
+			continue
+		}
+		conn.Close()
+		targets = append(targets, discoveredTarget{address: target})
+	}
+	return d.set(targets)
+}
+
+// splitHostPort splits a host with an optional port, defaulting to the port
+// of FAHClient.
+func splitHostPort(host string) (string, string) {
+	if name, port, err := net.SplitHostPort(host); err == nil {
+		return name, port
+	}
+	return host, strconv.Itoa(defaultFAHClientPort)
+}
+
+// mdnsQuestion asks for the records of a type of a name, requesting a unicast
+// response.
+func mdnsQuestion(name string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  typ,
+		Class: dnsmessage.ClassINET | 1<<15,
+	}
+}
+
+// mdnsQuery sends the questions and adds the records of the responses
+// received within mdnsQueryTimeout to records.
+func mdnsQuery(questions []dnsmessage.Question, records *mdnsRecords) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := dnsmessage.Message{Questions: questions}
+	b, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteToUDP(b, mdnsAddress); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(mdnsQueryTimeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buf[:n]); err != nil || !response.Response {
+			continue
+		}
+		for _, section := range [][]dnsmessage.Resource{response.Answers, response.Additionals} {
+			for _, r := range section {
+				records.add(r)
+			}
+		}
+	}
+}
+
+func (r *mdnsRecords) add(resource dnsmessage.Resource) {
+	name := strings.ToLower(resource.Header.Name.String())
+	switch body := resource.Body.(type) {
+	case *dnsmessage.PTRResource:
+		r.ptr[name] = append(r.ptr[name], strings.ToLower(body.PTR.String()))
+	case *dnsmessage.SRVResource:
+		r.srv[name] = *body
+	case *dnsmessage.AResource:
+		r.a[name] = net.IP(body.A[:])
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// mqttPublishTimeout bounds how long a publish waits for the broker.
+const mqttPublishTimeout = 10 * time.Second
+
+// mqttPublisher publishes the status of the clients to an MQTT broker at an
+// interval, for home automation built around MQTT. Values are published as
+// plain strings to one topic each and retained, so that subscribers get the
+// latest values right away.
+//
+// With a discovery prefix, the slots are also announced to Home Assistant as
+// sensors by its MQTT discovery protocol.
+type mqttPublisher struct {
+	client          mqtt.Client
+	clientID        string
+	prefix          string
+	discoveryPrefix string
+	interval        time.Duration
+	registries      *clientRegistries
+	logger          log.Logger
+
+	mtx sync.Mutex
+	// discovered holds the discovery topics published since connecting.
+	discovered map[string]bool
+}
+
+func newMQTTPublisher(broker, clientID, username, password, prefix, discoveryPrefix string, interval time.Duration, registries *clientRegistries, logger log.Logger) *mqttPublisher {
+	p := &mqttPublisher{
+		clientID:        clientID,
+		prefix:          strings.TrimSuffix(prefix, "/"),
+		discoveryPrefix: strings.TrimSuffix(discoveryPrefix, "/"),
+		interval:        interval,
+		registries:      registries,
+		logger:          logger,
+		discovered:      map[string]bool{},
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		// The broker announces that the exporter went away if it
+		// disconnects without saying goodbye.
+		SetWill(p.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			level.Info(logger).Log("msg", "Connected to MQTT broker", "broker", broker)
+			c.Publish(p.availabilityTopic(), 1, true, "online")
+			// Announce the sensors again, as the broker may have lost the
+			// retained discovery messages.
+			p.mtx.Lock()
+			p.discovered = map[string]bool{}
+			p.mtx.Unlock()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			level.Error(logger).Log("msg", "Lost connection to MQTT broker", "err", err)
+		})
+	p.client = mqtt.NewClient(opts)
+	return p
+}
+
+func (p *mqttPublisher) run() {
+	level.Info(p.logger).Log("msg", "Publishing status to MQTT broker", "prefix", p.prefix, "interval", p.interval)
+	// With connect retry, the connection is established in the background.
+	p.client.Connect()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.publish(); err != nil {
+			level.Error(p.logger).Log("msg", "Failed to publish status to MQTT broker", "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+// publish publishes the status of the clients once, giving up on the
+// FAHClients before the next publish is due.
+func (p *mqttPublisher) publish() error {
+	// Publishing while the connection is being established never completes.
+	if !p.client.IsConnectionOpen() {
+		return errors.New("not connected to MQTT broker")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	var tokens []mqtt.Token
+	for _, status := range p.registries.statuses(ctx) {
+		for topic, value := range p.values(status) {
+			tokens = append(tokens, p.client.Publish(topic, 0, true, value))
+		}
+		if p.discoveryPrefix != "" {
+			for topic, config := range p.discovery(status) {
+				tokens = append(tokens, p.client.Publish(topic, 1, true, config))
+			}
+		}
+	}
+	for _, t := range tokens {
+		if !t.WaitTimeout(mqttPublishTimeout) {
+			return errors.New("timeout publishing to MQTT broker")
+		}
+		if err := t.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// availabilityTopic is the topic telling whether the exporter is connected
+// to the broker.
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.prefix + "/status"
+}
+
+// clientTopic is the topic under which the status of a client is published.
+func (p *mqttPublisher) clientTopic(name string) string {
+	if name == "" {
+		return p.prefix
+	}
+	return p.prefix + "/" + topicLevel(name)
+}
+
+// values returns the values of the status of a client by topic.
+func (p *mqttPublisher) values(status clientStatus) map[string]string {
+	base := p.clientTopic(status.Name)
+	values := map[string]string{base + "/up": "0"}
+	if !status.Up {
+		return values
+	}
+	values[base+"/up"] = "1"
+	values[base+"/version"] = status.Version
+	for _, slot := range status.Slots {
+		slotTopic := base + "/slot/" + topicLevel(slot.ID)
+		values[slotTopic+"/status"] = slot.Status
+		values[slotTopic+"/description"] = slot.Description
+		values[slotTopic+"/estimated_points_per_day"] = strconv.Itoa(slot.EstimatedPointsPerDay)
+		values[slotTopic+"/percent_done"] = formatFloat(slot.PercentDone)
+		for _, wu := range slot.WorkUnits {
+			wuTopic := slotTopic + "/work_unit/" + topicLevel(wu.ID)
+			values[wuTopic+"/state"] = wu.State
+			values[wuTopic+"/prcg"] = fmt.Sprintf("%d (%d, %d, %d)", wu.Project, wu.Run, wu.Clone, wu.Gen)
+			values[wuTopic+"/percent_done"] = formatFloat(wu.PercentDone)
+			values[wuTopic+"/credit_estimate_points"] = strconv.Itoa(wu.CreditEstimate)
+			values[wuTopic+"/eta_seconds"] = formatFloat(wu.ETA.Seconds())
+			values[wuTopic+"/time_remaining_seconds"] = formatFloat(wu.TimeRemaining.Seconds())
+		}
+	}
+	return values
+}
+
+// haSensorConfig is the discovery message of a Home Assistant MQTT sensor.
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// haDevice groups the sensors of a client in Home Assistant.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// discovery returns the Home Assistant discovery messages of the slots of a
+// client by topic, leaving out those already published.
+func (p *mqttPublisher) discovery(status clientStatus) map[string][]byte {
+	if !status.Up {
+		return nil
+	}
+
+	nodeID := discoveryID(p.clientID)
+	deviceName := "Folding@home"
+	if status.Name != "" {
+		nodeID += "_" + discoveryID(status.Name)
+		deviceName += " " + status.Name
+	}
+	device := haDevice{
+		Identifiers:  []string{nodeID},
+		Name:         deviceName,
+		Manufacturer: "Folding@home",
+		SWVersion:    status.Version,
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	configs := map[string][]byte{}
+	for _, slot := range status.Slots {
+		slotTopic := p.clientTopic(status.Name) + "/slot/" + topicLevel(slot.ID)
+		for _, sensor := range []struct {
+			key, name, unit, stateClass, icon string
+		}{
+			{"status", "status", "", "", "mdi:state-machine"},
+			{"estimated_points_per_day", "points per day", "PPD", "measurement", "mdi:speedometer"},
+			{"percent_done", "progress", "%", "measurement", "mdi:progress-clock"},
+		} {
+			objectID := "slot_" + discoveryID(slot.ID) + "_" + sensor.key
+			topic := p.discoveryPrefix + "/sensor/" + nodeID + "/" + objectID + "/config"
+			if p.discovered[topic] {
+				continue
+			}
+			config, err := json.Marshal(haSensorConfig{
+				Name:              "Slot " + slot.ID + " " + sensor.name,
+				UniqueID:          nodeID + "_" + objectID,
+				StateTopic:        slotTopic + "/" + sensor.key,
+				AvailabilityTopic: p.availabilityTopic(),
+				UnitOfMeasurement: sensor.unit,
+				StateClass:        sensor.stateClass,
+				Icon:              sensor.icon,
+				Device:            device,
+			})
+			if err != nil {
+				level.Error(p.logger).Log("msg", "Failed to encode Home Assistant discovery message", "err", err)
+				continue
+			}
+			configs[topic] = config
+			p.discovered[topic] = true
+		}
+	}
+	return configs
+}
+
+// discoveryID makes s usable as an ID in Home Assistant discovery topics,
+// which only allow letters, digits, underscores and hyphens.
+func discoveryID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// topicLevel makes s usable as a single level of an MQTT topic.
+func topicLevel(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
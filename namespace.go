@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// namespaceGatherer renames the metrics of the exporter, which are prefixed
+// with the foldingathome namespace, to the namespace, so that they fit into
+// an existing naming scheme or don't clash with the metrics of another
+// exporter during a migration. Metrics of other namespaces, like go_*, are
+// left alone.
+type namespaceGatherer struct {
+	prometheus.Gatherer
+	namespace string
+}
+
+func (g namespaceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		if name := mf.GetName(); strings.HasPrefix(name, namespace+"_") {
+			mf.Name = proto.String(g.namespace + strings.TrimPrefix(name, namespace))
+		}
+	}
+	return mfs, err
+}
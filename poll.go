@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pollStaleIntervals is the number of poll intervals after which the metrics
+// of the last poll are no longer served, as polling has evidently stalled.
+const pollStaleIntervals = 3
+
+// pollCache holds the metrics of the last background poll of an Exporter,
+// which are served to scrapes instead of querying the FAHClient on every
+// scrape, and the state they were collected from, which the status is served
+// from.
+type pollCache struct {
+	done chan struct{}
+
+	mtx     sync.RWMutex
+	metrics []prometheus.Metric
+	state   *clientState
+	time    time.Time
+}
+
+// recentScrape holds the metrics of the last scrape of an Exporter, which are
+// served again to scrapes arriving less than MinInterval after it, like those
+// of Prometheus servers scraping in pairs, and the state they were collected
+// from.
+type recentScrape struct {
+	mtx     sync.Mutex
+	metrics []prometheus.Metric
+	state   *clientState
+	time    time.Time
+}
+
+// recentScrapeSet holds the last scrapes of probe targets, which outlive the
+// exporters created per probe request.
+type recentScrapeSet struct {
+	mtx    sync.Mutex
+	recent map[string]*recentScrape
+}
+
+func newRecentScrapeSet() *recentScrapeSet {
+	return &recentScrapeSet{recent: map[string]*recentScrape{}}
+}
+
+// get returns the last scrape of target.
+func (s *recentScrapeSet) get(target string) *recentScrape {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, ok := s.recent[target]
+	if !ok {
+		r = &recentScrape{}
+		s.recent[target] = r
+	}
+	return r
+}
+
+// forget discards the last scrape of target.
+func (s *recentScrapeSet) forget(target string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.recent, target)
+}
+
+// collectRecent delivers the metrics of the last scrape if it was less than
+// MinInterval ago, and otherwise collects them anew.
+func (e *Exporter) collectRecent(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.recent.mtx.Lock()
+	metrics, t := e.recent.metrics, e.recent.time
+	e.recent.mtx.Unlock()
+
+	if t.IsZero() || time.Since(t) >= e.client.MinInterval {
+		metrics = nil
+		var state *clientState
+		c := make(chan prometheus.Metric)
+		go func() {
+			state = e.collect(ctx, c)
+			close(c)
+		}()
+		for m := range c {
+			metrics = append(metrics, m)
+		}
+
+		e.recent.mtx.Lock()
+		e.recent.metrics, e.recent.state, e.recent.time = metrics, state, time.Now()
+		e.recent.mtx.Unlock()
+	}
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+// poll collects the metrics of the client every CollectInterval until the
+// Exporter is closed.
+func (e *Exporter) poll() {
+	ticker := time.NewTicker(e.client.CollectInterval)
+	defer ticker.Stop()
+
+	for {
+		var state *clientState
+		ch := make(chan prometheus.Metric)
+		go func() {
+			state = e.collect(context.Background(), ch)
+			close(ch)
+		}()
+		var metrics []prometheus.Metric
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+
+		e.cache.mtx.Lock()
+		e.cache.metrics, e.cache.state, e.cache.time = metrics, state, time.Now()
+		e.cache.mtx.Unlock()
+
+		select {
+		case <-e.cache.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectCached delivers the metrics of the last poll.
+func (e *Exporter) collectCached(ch chan<- prometheus.Metric) {
+	e.cache.mtx.RLock()
+	defer e.cache.mtx.RUnlock()
+
+	if e.cache.time.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(e.lastPoll, prometheus.GaugeValue, float64(e.cache.time.UnixNano())/1e9)
+	if time.Since(e.cache.time) > pollStaleIntervals*e.client.CollectInterval {
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		return
+	}
+	for _, m := range e.cache.metrics {
+		ch <- m
+	}
+}
+
+// cachedState returns the state of the last poll, unless polling has stalled.
+func (e *Exporter) cachedState() (*clientState, error) {
+	e.cache.mtx.RLock()
+	defer e.cache.mtx.RUnlock()
+
+	switch {
+	case e.cache.time.IsZero():
+		return nil, errNotPolled
+	case time.Since(e.cache.time) > pollStaleIntervals*e.client.CollectInterval:
+		return nil, errPollStale
+	case e.cache.state == nil:
+		return nil, errUnreachable
+	}
+	return e.cache.state, nil
+}
+
+// recentState returns the state of the last scrape and whether it was less
+// than MinInterval ago. The state is nil if the scrape could not reach the
+// client.
+func (e *Exporter) recentState() (*clientState, bool) {
+	e.recent.mtx.Lock()
+	defer e.recent.mtx.Unlock()
+
+	if e.recent.time.IsZero() || time.Since(e.recent.time) >= e.client.MinInterval {
+		return nil, false
+	}
+	return e.recent.state, true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// How the project, run, clone and gen of work units are labeled.
+const (
+	// prcgLabelsCombined labels them together in prcg, like
+	// "16600 (0, 1, 2)".
+	prcgLabelsCombined = "prcg"
+	// prcgLabelsSplit labels them separately in project, run, clone and
+	// gen instead.
+	prcgLabelsSplit = "split"
+	// prcgLabelsProject adds the project in project to prcg.
+	prcgLabelsProject = "project"
+)
+
+// prcgRegexp matches a prcg label, capturing the project, run, clone and gen.
+var prcgRegexp = regexp.MustCompile(`^(\d+) \((\d+), (\d+), (\d+)\)$`)
+
+// prcgLabelsGatherer relabels the prcg label of foldingathome_work_unit_info
+// according to mode, so that PromQL can filter and aggregate by project.
+type prcgLabelsGatherer struct {
+	prometheus.Gatherer
+	mode string
+}
+
+func (g prcgLabelsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			g.relabel(m)
+		}
+	}
+	return mfs, err
+}
+
+func (g prcgLabelsGatherer) relabel(m *dto.Metric) {
+	match := prcgRegexp.FindStringSubmatch(labelValue(m, "prcg"))
+	if match == nil {
+		return
+	}
+	names := []string{"project"}
+	if g.mode == prcgLabelsSplit {
+		names = []string{"project", "run", "clone", "gen"}
+		labels := m.Label[:0]
+		for _, lp := range m.Label {
+			if lp.GetName() != "prcg" {
+				labels = append(labels, lp)
+			}
+		}
+		m.Label = labels
+	}
+	for i, name := range names {
+		if !hasLabel(m, name) {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(match[i+1])})
+		}
+	}
+	sortLabels(m)
+}
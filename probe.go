@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+)
+
+// probeTargets holds the state of probe targets that outlives the exporters
+// created per probe request, by target. As anyone who can reach the exporter
+// chooses the targets, the state of a target that wasn't probed for expiry is
+// discarded.
+type probeTargets struct {
+	expiry        time.Duration
+	breakers      *breakerSet
+	limiters      *scrapeLimiterSet
+	recent        *recentScrapeSet
+	commandErrors *commandErrorSet
+	protocols     *protocolSet
+
+	mtx        sync.Mutex
+	lastProbed map[string]time.Time
+}
+
+func newProbeTargets(expiry time.Duration, breakers *breakerSet, limiters *scrapeLimiterSet) *probeTargets {
+	return &probeTargets{
+		expiry:        expiry,
+		breakers:      breakers,
+		limiters:      limiters,
+		recent:        newRecentScrapeSet(),
+		commandErrors: newCommandErrorSet(),
+		protocols:     newProtocolSet(),
+		lastProbed:    map[string]time.Time{},
+	}
+}
+
+// attach gives the exporter of a probe the state of its target.
+func (t *probeTargets) attach(e *Exporter, target string) {
+	t.probed(target, time.Now())
+	e.breaker = t.breakers.get(target)
+	e.limiter = t.limiters.get(target)
+	e.recent = t.recent.get(target)
+	e.errorCounts = t.commandErrors.get(target)
+	e.detected = t.protocols.get(target)
+}
+
+// probed records that target is probed at now, and discards the state of the
+// targets that weren't probed for expiry.
+func (t *probeTargets) probed(target string, now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.lastProbed[target] = now
+	for target, last := range t.lastProbed {
+		if now.Sub(last) <= t.expiry {
+			continue
+		}
+		delete(t.lastProbed, target)
+		t.breakers.forget(target)
+		t.limiters.forget(target)
+		t.recent.forget(target)
+		t.commandErrors.forget(target)
+		t.protocols.forget(target)
+	}
+}
+
+// probeHandler scrapes the FAHClient given by the target parameter, in the
+// style of the blackbox exporter, so that one exporter can serve many clients.
+// Targets are otherwise scraped like the client given on the command line.
+// Collectors that read local hardware telemetry are not used for probes as
+// the target generally isn't the exporter's host. The password of the client
+// given on the command line isn't sent to targets, as the caller chooses them
+// and could collect it with a listener of their own. The circuit breakers of
+// targets are kept across probes, as are their scrape limiters, last scrapes,
+// command error counts and detected protocols.
+func probeHandler(w http.ResponseWriter, r *http.Request, defaults ClientConfig, timeoutOffset time.Duration, frames *collector.FrameHistory, collectors []collector.Collector, relabel func(prometheus.Gatherer) prometheus.Gatherer, targets *probeTargets, logger log.Logger) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if err := validateAddress(target); err != nil {
+		http.Error(w, "Invalid target parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	protocol := defaults.Protocol
+	if protocol == protocolLog {
+		// Probed targets are reached at their address.
+		protocol = protocolAuto
+	}
+	client := ClientConfig{
+		Address:     target,
+		Protocol:    protocol,
+		DialTimeout: defaults.DialTimeout,
+		ReadTimeout: defaults.ReadTimeout,
+		Retries:     defaults.Retries,
+		RetryDelay:  defaults.RetryDelay,
+		RetryJitter: defaults.RetryJitter,
+		SlotInclude: defaults.SlotInclude,
+		SlotExclude: defaults.SlotExclude,
+		ProxyURL:    defaults.ProxyURL,
+		MinInterval: defaults.MinInterval,
+	}
+	exporter := NewExporter(client, frames, log.With(logger, "target", target), collectors...)
+	targets.attach(exporter, target)
+	defer exporter.Close()
+	ctx, cancel := scrapeContext(r, timeoutOffset)
+	defer cancel()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(scrapeCollector{ctx: ctx, exporter: exporter})
+
+	promhttp.HandlerFor(relabel(registry), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// The descriptions of projects are HTML.
+var (
+	htmlTagRegexp    = regexp.MustCompile(`<[^>]*>`)
+	whitespaceRegexp = regexp.MustCompile(`\s+`)
+)
+
+// projectDetails are the details of a project, as served at /project/<number>.
+// Projects without a quick return bonus have a k-factor of 0.
+type projectDetails struct {
+	Cause       string  `json:"cause"`
+	Manager     string  `json:"manager"`
+	Institution string  `json:"institution"`
+	Description string  `json:"description"`
+	KFactor     float64 `json:"k_factor"`
+}
+
+// project returns the details of a project.
+func (a *statsAPI) project(project int) (projectDetails, error) {
+	var details projectDetails
+	err := a.get("/project/"+strconv.Itoa(project), &details)
+	return details, err
+}
+
+// queuedProjects returns the projects of the work units in the queue, in
+// ascending order.
+func queuedProjects(queueInfo []fahclient.SlotQueueInfo) []int {
+	seen := map[int]bool{}
+	var projects []int
+	for _, q := range queueInfo {
+		if q.Project > 0 && !seen[q.Project] {
+			seen[q.Project] = true
+			projects = append(projects, q.Project)
+		}
+	}
+	sort.Ints(projects)
+	return projects
+}
+
+// projectInfoCollector exports the details of the projects of the work units
+// in the queue of a client from the stats API, so that dashboards can show
+// what disease a rig is working on.
+type projectInfoCollector struct {
+	api    *statsAPI
+	logger log.Logger
+
+	info *prometheus.Desc
+}
+
+func newProjectInfoCollector(api *statsAPI, logger log.Logger) *projectInfoCollector {
+	return &projectInfoCollector{
+		api:    api,
+		logger: logger,
+		info: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "project", "info"),
+			"The cause, manager, institution and description of a project of the work units in the queue, according to the Folding@home stats API, with a constant value of 1.",
+			[]string{"project", "cause", "manager", "institution", "description"},
+			nil,
+		),
+	}
+}
+
+func (c *projectInfoCollector) Name() string { return "project-info" }
+
+func (c *projectInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+}
+
+func (c *projectInfoCollector) Update(ctx context.Context, client collector.Client, ch chan<- prometheus.Metric) error {
+	queueInfo, err := client.QueueInfo()
+	if err != nil {
+		return err
+	}
+
+	for _, project := range queuedProjects(queueInfo) {
+		id := strconv.Itoa(project)
+		details, err := c.api.project(project)
+		if err != nil {
+			level.Error(c.logger).Log("msg", "Failed to get project details", "project", id, "err", err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, id, details.Cause, details.Manager, details.Institution, plainText(details.Description))
+	}
+	return nil
+}
+
+// plainText returns the text of an HTML fragment on a single line.
+func plainText(s string) string {
+	s = html.UnescapeString(htmlTagRegexp.ReplaceAllString(s, " "))
+	return strings.TrimSpace(whitespaceRegexp.ReplaceAllString(s, " "))
+}
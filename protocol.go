@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// Folding@home v7 clients speak a telnet protocol on port 36330, while v8
+// clients serve a WebSocket API on port 7396. With protocolAuto the exporter
+// finds out which one it is talking to.
+const (
+	protocolAuto = "auto"
+	protocolV7   = "v7"
+	protocolV8   = "v8"
+)
+
+// detectProtocol determines whether the FAHClient at address speaks the v7
+// command protocol or the v8 WebSocket API. A v7 client greets every new
+// connection, which fails the WebSocket handshake straight away, so trying v8
+// first costs v7 clients no more than a round trip.
+func detectProtocol(ctx context.Context, dial contextDialer, address string, dialTimeout, readTimeout time.Duration) (string, error) {
+	if conn, err := dialV8(ctx, dial, address, dialTimeout); err == nil {
+		conn.Close()
+		return protocolV8, nil
+	}
+
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(deadline(ctx, readTimeout)); err != nil {
+		return "", err
+	}
+	if err := readBanner(bufio.NewReader(conn)); err != nil {
+		return "", err
+	}
+	return protocolV7, nil
+}
+
+// detectedProtocol is the protocol detected for a client, or the empty string
+// until it is.
+type detectedProtocol struct {
+	mtx      sync.Mutex
+	protocol string
+}
+
+func (d *detectedProtocol) get() string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.protocol
+}
+
+func (d *detectedProtocol) set(protocol string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.protocol = protocol
+}
+
+// protocolSet holds the protocols detected for probe targets, which outlive
+// the exporters created per probe request, so that the protocol of a target
+// isn't detected again on every probe.
+type protocolSet struct {
+	mtx       sync.Mutex
+	protocols map[string]*detectedProtocol
+}
+
+func newProtocolSet() *protocolSet {
+	return &protocolSet{protocols: map[string]*detectedProtocol{}}
+}
+
+// get returns the protocol detected for target.
+func (s *protocolSet) get(target string) *detectedProtocol {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, ok := s.protocols[target]
+	if !ok {
+		d = &detectedProtocol{}
+		s.protocols[target] = d
+	}
+	return d
+}
+
+// forget discards the protocol detected for target.
+func (s *protocolSet) forget(target string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.protocols, target)
+}
+
+// protocol returns the protocol of the client, detecting it on first use when
+// it isn't configured. Scrapes arriving while the protocol is detected detect
+// it too rather than waiting for the connection attempts of another.
+func (e *Exporter) protocol(ctx context.Context) (string, error) {
+	if e.client.Protocol != protocolAuto {
+		return e.client.Protocol, nil
+	}
+	if protocol := e.detected.get(); protocol != "" {
+		return protocol, nil
+	}
+
+	protocol, err := detectProtocol(ctx, e.client.dialer(e.client.DialTimeout), e.client.Address, e.client.DialTimeout, e.client.ReadTimeout)
+	if err != nil {
+		return "", err
+	}
+	level.Debug(e.logger).Log("msg", "Detected FAHClient protocol", "protocol", protocol)
+	e.detected.set(protocol)
+	return protocol, nil
+}
+
+// forgetProtocol discards the detected protocol after a failed connection, in
+// case the client was replaced by one of another generation.
+func (e *Exporter) forgetProtocol() {
+	e.detected.set("")
+}
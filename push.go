@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushGateway pushes the metrics to a Prometheus Pushgateway at an interval,
+// for machines that can't be scraped, like laptops behind NAT. Each push
+// replaces the metrics previously pushed by the same instance.
+type pushGateway struct {
+	url      string
+	job      string
+	instance string
+	interval time.Duration
+	// gatherer returns the Gatherer for a push within ctx.
+	gatherer func(ctx context.Context) prometheus.Gatherer
+	logger   log.Logger
+}
+
+func newPushGateway(url, job, instance string, interval time.Duration, gatherer func(ctx context.Context) prometheus.Gatherer, logger log.Logger) *pushGateway {
+	return &pushGateway{
+		url:      url,
+		job:      job,
+		instance: instance,
+		interval: interval,
+		gatherer: gatherer,
+		logger:   logger,
+	}
+}
+
+func (p *pushGateway) run() {
+	level.Info(p.logger).Log("msg", "Pushing metrics to Pushgateway", "url", p.url, "interval", p.interval)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.push(); err != nil {
+			level.Error(p.logger).Log("msg", "Failed to push metrics to Pushgateway", "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+// push pushes the metrics once, giving up on the FAHClients and the
+// Pushgateway before the next push is due.
+func (p *pushGateway) push() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+	return push.New(p.url, p.job).
+		Grouping("instance", p.instance).
+		Gatherer(p.gatherer(ctx)).
+		PushContext(ctx)
+}
+
+// instanceLabel returns the instance label of pushed metrics, which defaults
+// to the hostname.
+func instanceLabel(instance string) (string, error) {
+	if instance != "" {
+		return instance, nil
+	}
+	return os.Hostname()
+}
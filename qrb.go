@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// qrbCollector estimates the quick return bonus of the work units in the
+// queue of a client. A work unit returned before its timeout is credited its
+// base credit times sqrt(k * deadline / elapsed), at least 1, where k is the
+// k-factor of its project, deadline the time it was given from assignment to
+// its final deadline, and elapsed the time it took from assignment to its
+// return.
+type qrbCollector struct {
+	api    *statsAPI
+	logger log.Logger
+
+	multiplier  *prometheus.Desc
+	bonusPoints *prometheus.Desc
+}
+
+func newQRBCollector(api *statsAPI, logger log.Logger) *qrbCollector {
+	return &qrbCollector{
+		api:    api,
+		logger: logger,
+		multiplier: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "work_unit", "qrb_multiplier"),
+			"Estimated quick return bonus multiplier of the base credit of the work unit, if it is returned at its ETA.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+		bonusPoints: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "work_unit", "estimated_bonus_points"),
+			"Estimated quick return bonus of the work unit on top of its base credit, if it is returned at its ETA.",
+			[]string{"id", "slot_description", "unit_id"},
+			nil,
+		),
+	}
+}
+
+func (c *qrbCollector) Name() string { return "qrb" }
+
+func (c *qrbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.multiplier
+	ch <- c.bonusPoints
+}
+
+func (c *qrbCollector) Update(ctx context.Context, client collector.Client, ch chan<- prometheus.Metric) error {
+	queueInfo, err := client.QueueInfo()
+	if err != nil {
+		return err
+	}
+	// Without slot-info, work units are exported without the slot.
+	slotInfo, _ := client.SlotInfo()
+	slotMap := map[string]fahclient.SlotInfo{}
+	for _, sInfo := range slotInfo {
+		slotMap[sInfo.ID] = sInfo
+	}
+
+	kFactors := map[int]float64{}
+	for _, project := range queuedProjects(queueInfo) {
+		details, err := c.api.project(project)
+		if err != nil {
+			level.Error(c.logger).Log("msg", "Failed to get project details", "project", strconv.Itoa(project), "err", err)
+			continue
+		}
+		kFactors[project] = details.KFactor
+	}
+
+	now := time.Now()
+	for _, q := range queueInfo {
+		k, ok := kFactors[q.Project]
+		if !ok || q.BaseCredit <= 0 {
+			continue
+		}
+		multiplier, ok := qrbMultiplier(q, k, now)
+		if !ok {
+			continue
+		}
+		id := slotMap[q.Slot].ID
+		desc := slotMap[q.Slot].Description
+		ch <- prometheus.MustNewConstMetric(c.multiplier, prometheus.GaugeValue, multiplier, id, desc, q.ID)
+		ch <- prometheus.MustNewConstMetric(c.bonusPoints, prometheus.GaugeValue, float64(q.BaseCredit)*(multiplier-1), id, desc, q.ID)
+	}
+	return nil
+}
+
+// qrbMultiplier returns the multiplier of the base credit of a work unit of a
+// project with k-factor k, if it is returned at its ETA. Work units waiting to
+// be uploaded are returned now; others need an ETA for an estimate.
+func qrbMultiplier(q fahclient.SlotQueueInfo, k float64, now time.Time) (float64, bool) {
+	if q.Assigned.IsZero() || !q.Deadline.After(q.Assigned) {
+		return 0, false
+	}
+	returned := now
+	if strings.ToLower(q.State) != "send" {
+		if q.ETA <= 0 {
+			return 0, false
+		}
+		returned = now.Add(q.ETA)
+	}
+	// Work units returned after their timeout are credited the base credit
+	// only.
+	if k <= 0 || (!q.Timeout.IsZero() && returned.After(q.Timeout)) {
+		return 1, true
+	}
+	elapsed := returned.Sub(q.Assigned)
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return math.Max(1, math.Sqrt(k*q.Deadline.Sub(q.Assigned).Seconds()/elapsed.Seconds())), true
+}
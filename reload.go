@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+)
+
+// clientRegistries holds the exporters and liveness collectors of the
+// FAHClients to scrape. They are rebuilt whenever the configuration file is
+// reloaded or the discovered clients change, keeping those of the clients
+// whose configuration is unchanged, while the HTTP handlers keep gathering
+// from the current ones.
+type clientRegistries struct {
+	configFile     string
+	discoverers    []discoverer
+	defaultClients []ClientConfig
+	// maxConcurrency limits the clients gathered at the same time, if
+	// positive.
+	maxConcurrency  int
+	livenessTimeout time.Duration
+	frames          *collector.FrameHistory
+	// commandErrors holds the command error counts of the clients, which
+	// are kept across reloads.
+	commandErrors *commandErrorSet
+	// collectors are run for every client in addition to the default ones,
+	// localCollectors only for the clients on the exporter's host.
+	collectors      []collector.Collector
+	localCollectors []collector.Collector
+	logger          log.Logger
+
+	// loadMtx serializes loads, which reuse the targets of the previous one.
+	loadMtx  sync.Mutex
+	mtx      sync.RWMutex
+	targets  []scrapeTarget
+	liveness *prometheus.Registry
+
+	lastReloadSuccessful       prometheus.Gauge
+	lastReloadSuccessTimestamp prometheus.Gauge
+}
+
+// scrapeTarget is an exporter, the liveness collector of its client and the
+// labels added to their metrics. local is whether the exporter runs the
+// collectors of the exporter's host.
+type scrapeTarget struct {
+	exporter *Exporter
+	liveness *livenessCollector
+	labels   prometheus.Labels
+	local    bool
+}
+
+// reusable reports whether the target serves client with the given labels
+// and collectors, so that it can be kept by a reload.
+func (t scrapeTarget) reusable(client ClientConfig, labels prometheus.Labels, local bool) bool {
+	return t.local == local && reflect.DeepEqual(t.labels, labels) && sameClient(t.exporter.client, client)
+}
+
+func newClientRegistries(configFile string, discoverers []discoverer, defaultClients []ClientConfig, maxConcurrency int, livenessTimeout time.Duration, frames *collector.FrameHistory, collectors, localCollectors []collector.Collector, logger log.Logger) *clientRegistries {
+	return &clientRegistries{
+		configFile:      configFile,
+		discoverers:     discoverers,
+		defaultClients:  defaultClients,
+		maxConcurrency:  maxConcurrency,
+		livenessTimeout: livenessTimeout,
+		frames:          frames,
+		commandErrors:   newCommandErrorSet(),
+		collectors:      collectors,
+		localCollectors: localCollectors,
+		logger:          logger,
+		liveness:        prometheus.NewRegistry(),
+		lastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		}),
+		lastReloadSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (r *clientRegistries) Describe(ch chan<- *prometheus.Desc) {
+	r.lastReloadSuccessful.Describe(ch)
+	r.lastReloadSuccessTimestamp.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (r *clientRegistries) Collect(ch chan<- prometheus.Metric) {
+	r.lastReloadSuccessful.Collect(ch)
+	r.lastReloadSuccessTimestamp.Collect(ch)
+}
+
+// reload reads the configuration file, if any, and replaces the registries
+// with ones for the configured and discovered clients, or the clients given
+// by the command-line flags. The current registries are kept if the configuration
+// is invalid.
+func (r *clientRegistries) reload() error {
+	if err := r.load(); err != nil {
+		r.lastReloadSuccessful.Set(0)
+		return err
+	}
+
+	r.lastReloadSuccessful.Set(1)
+	r.lastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (r *clientRegistries) load() error {
+	r.loadMtx.Lock()
+	defer r.loadMtx.Unlock()
+
+	clients := r.defaultClients
+	wrapLabels := len(clients) > 1
+	if r.configFile != "" || len(r.discoverers) > 0 {
+		clients = nil
+		wrapLabels = true
+	}
+	if r.configFile != "" {
+		cfg, err := LoadConfig(r.configFile)
+		if err != nil {
+			return err
+		}
+		clients = cfg.Clients
+	}
+	if len(r.discoverers) > 0 {
+		for _, d := range r.discoverers {
+			discovered, err := d.clients(r.defaultClients[0])
+			if err != nil {
+				return err
+			}
+			clients = append(clients, discovered...)
+		}
+		names := map[string]bool{}
+		for _, client := range clients {
+			if names[client.Name] {
+				return fmt.Errorf("duplicate client name %q", client.Name)
+			}
+			names[client.Name] = true
+		}
+		fillLabels(clients)
+	}
+
+	r.mtx.RLock()
+	previous := r.targets
+	r.mtx.RUnlock()
+	reused := map[*Exporter]bool{}
+
+	metrics, liveness := prometheus.NewRegistry(), prometheus.NewRegistry()
+	targets := make([]scrapeTarget, 0, len(clients))
+	// created holds the exporters created by this load, which are closed
+	// again if it fails.
+	var created []*Exporter
+	for _, client := range clients {
+		var labels prometheus.Labels
+		logger := r.logger
+		if wrapLabels {
+			labels = client.labels()
+			logger = log.With(logger, "client", client.Name)
+		}
+		registerer := prometheus.WrapRegistererWith(labels, metrics)
+		livenessRegisterer := prometheus.WrapRegistererWith(labels, liveness)
+
+		local := (!wrapLabels && !client.tunneled()) || client.isLocal()
+		target, ok := scrapeTarget{}, false
+		for _, t := range previous {
+			if !reused[t.exporter] && t.reusable(client, labels, local) {
+				target, ok = t, true
+				reused[t.exporter] = true
+				break
+			}
+		}
+		if !ok {
+			collectors := r.collectors
+			if local {
+				collectors = append(collectors[:len(collectors):len(collectors)], r.localCollectors...)
+			}
+			exporter := NewExporter(client, r.frames, logger, collectors...)
+			exporter.errorCounts = r.commandErrors.get(client.clientKey())
+			created = append(created, exporter)
+			target = scrapeTarget{
+				exporter: exporter,
+				liveness: newLivenessCollector(client, r.livenessTimeout, logger),
+				labels:   labels,
+				local:    local,
+			}
+		}
+		targets = append(targets, target)
+		// The exporters are registered for each scrape; registering them
+		// here checks that they are consistent.
+		if err := registerer.Register(target.exporter); err != nil {
+			closeExporters(created)
+			return fmt.Errorf("registering client %q: %w", client.Name, err)
+		}
+		if err := livenessRegisterer.Register(target.liveness); err != nil {
+			closeExporters(created)
+			return fmt.Errorf("registering client %q: %w", client.Name, err)
+		}
+	}
+	r.mtx.Lock()
+	r.targets, r.liveness = targets, liveness
+	r.mtx.Unlock()
+	var unused []*Exporter
+	for _, t := range previous {
+		if !reused[t.exporter] {
+			unused = append(unused, t.exporter)
+		}
+	}
+	closeExporters(unused)
+	// Discovered clients come and go, so the command error counts of those
+	// no longer listed are discarded.
+	keys := map[string]bool{}
+	for _, client := range clients {
+		keys[client.clientKey()] = true
+	}
+	for _, e := range unused {
+		if key := e.client.clientKey(); !keys[key] {
+			r.commandErrors.forget(key)
+		}
+	}
+
+	level.Info(r.logger).Log("msg", "Loaded clients", "clients", len(clients), "reused", len(reused))
+	return nil
+}
+
+// close closes the sessions of the current clients on shutdown.
+func (r *clientRegistries) close() {
+	r.mtx.Lock()
+	targets := r.targets
+	r.targets = nil
+	r.mtx.Unlock()
+	closeExporters(targetExporters(targets))
+}
+
+// closeExporters closes the sessions of exporters that are no longer used.
+func closeExporters(exporters []*Exporter) {
+	for _, e := range exporters {
+		e.Close()
+	}
+}
+
+func targetExporters(targets []scrapeTarget) []*Exporter {
+	exporters := make([]*Exporter, 0, len(targets))
+	for _, t := range targets {
+		exporters = append(exporters, t.exporter)
+	}
+	return exporters
+}
+
+// eachTarget runs f for each of the targets in parallel, up to maxConcurrency
+// at a time, and returns the errors by target. Targets still waiting for their
+// turn when ctx expires fail without running f.
+func (r *clientRegistries) eachTarget(ctx context.Context, targets []scrapeTarget, f func(i int, t scrapeTarget) error) []error {
+	errs := make([]error, len(targets))
+	var sem chan struct{}
+	if r.maxConcurrency > 0 {
+		sem = make(chan struct{}, r.maxConcurrency)
+	}
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t scrapeTarget) {
+			defer wg.Done()
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					errs[i] = fmt.Errorf("waiting for other clients to be scraped: %w", ctx.Err())
+					return
+				}
+			}
+			errs[i] = f(i, t)
+		}(i, t)
+	}
+	wg.Wait()
+	return errs
+}
+
+// metricsGatherer returns a Gatherer for the metrics of the current clients
+// within the context of a scrape. Several clients are gathered independently,
+// in parallel up to maxConcurrency at a time, so that one failing to gather
+// doesn't fail the scrape: its metrics are left out and
+// foldingathome_target_up tells which clients were scraped successfully.
+// Clients still waiting for their turn when the scrape times out fail.
+func (r *clientRegistries) metricsGatherer(ctx context.Context) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		r.mtx.RLock()
+		targets := r.targets
+		r.mtx.RUnlock()
+
+		if len(targets) == 1 && targets[0].labels == nil {
+			registry := prometheus.NewRegistry()
+			if err := registry.Register(scrapeCollector{ctx: ctx, exporter: targets[0].exporter}); err != nil {
+				return nil, err
+			}
+			return registry.Gather()
+		}
+
+		results := make([][]*dto.MetricFamily, len(targets))
+		errs := r.eachTarget(ctx, targets, func(i int, t scrapeTarget) error {
+			var err error
+			results[i], err = t.gather(ctx)
+			return err
+		})
+
+		gatherers := prometheus.Gatherers{}
+		targetUp := prometheus.NewRegistry()
+		for i, t := range targets {
+			up := errs[i] == nil && clientUp(results[i])
+			if errs[i] != nil {
+				level.Error(r.logger).Log("msg", "Error gathering metrics", "client", t.labels["client"], "err", errs[i])
+			} else {
+				mfs := results[i]
+				gatherers = append(gatherers, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+					return mfs, nil
+				}))
+			}
+			g := prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "target_up",
+				Help:        "Whether the client was scraped successfully: it could be reached and its metrics were gathered.",
+				ConstLabels: t.labels,
+			})
+			if up {
+				g.Set(1)
+			}
+			if err := targetUp.Register(g); err != nil {
+				return nil, err
+			}
+		}
+		return append(gatherers, targetUp).Gather()
+	})
+}
+
+// gather gathers the metrics of the target on its own.
+func (t scrapeTarget) gather(ctx context.Context) ([]*dto.MetricFamily, error) {
+	registry := prometheus.NewRegistry()
+	if err := prometheus.WrapRegistererWith(t.labels, registry).Register(scrapeCollector{ctx: ctx, exporter: t.exporter}); err != nil {
+		return nil, err
+	}
+	return registry.Gather()
+}
+
+// clientUp reports whether foldingathome_up among mfs says that the client
+// could be reached.
+func clientUp(mfs []*dto.MetricFamily) bool {
+	for _, mf := range mfs {
+		if mf.GetName() != namespace+"_up" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			if m.GetGauge().GetValue() != 1 {
+				return false
+			}
+		}
+		return len(mf.Metric) > 0
+	}
+	return false
+}
+
+// livenessGatherer returns a Gatherer for the liveness probes of the current
+// clients.
+func (r *clientRegistries) livenessGatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		r.mtx.RLock()
+		registry := r.liveness
+		r.mtx.RUnlock()
+		return registry.Gather()
+	})
+}
+
+// reachable returns an error if any of the current clients cannot be reached.
+func (r *clientRegistries) reachable() error {
+	r.mtx.RLock()
+	targets := r.targets
+	r.mtx.RUnlock()
+
+	for _, t := range targets {
+		if _, err := t.liveness.probe(); err != nil {
+			return fmt.Errorf("FAHClient %s: %w", t.liveness.address, err)
+		}
+	}
+	return nil
+}
+
+// reloadHandler reloads the configuration on POST requests to /-/reload.
+func (r *clientRegistries) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "This endpoint requires a POST request.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		level.Error(r.logger).Log("msg", "Error reloading config", "err", err)
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriter samples the metrics at an interval and sends them to an
+// endpoint of the Prometheus remote-write protocol, like Prometheus, Mimir or
+// VictoriaMetrics, for machines that can't be reached inbound at all.
+type remoteWriter struct {
+	url         string
+	bearerToken string
+	interval    time.Duration
+	// labels are added to every series in place of the target labels a
+	// scrape would add.
+	labels prometheus.Labels
+	// gatherer returns the Gatherer for a sample within ctx.
+	gatherer func(ctx context.Context) prometheus.Gatherer
+	client   *http.Client
+	logger   log.Logger
+}
+
+func newRemoteWriter(url, bearerToken string, interval time.Duration, labels prometheus.Labels, gatherer func(ctx context.Context) prometheus.Gatherer, logger log.Logger) *remoteWriter {
+	return &remoteWriter{
+		url:         url,
+		bearerToken: bearerToken,
+		interval:    interval,
+		labels:      labels,
+		gatherer:    gatherer,
+		client:      &http.Client{},
+		logger:      logger,
+	}
+}
+
+func (w *remoteWriter) run() {
+	level.Info(w.logger).Log("msg", "Sending metrics to remote-write endpoint", "url", w.url, "interval", w.interval)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.write(); err != nil {
+			level.Error(w.logger).Log("msg", "Failed to send metrics to remote-write endpoint", "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+// write samples the metrics once and sends them, giving up on the FAHClients
+// and the endpoint before the next sample is due.
+func (w *remoteWriter) write() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.interval)
+	defer cancel()
+
+	mfs, err := w.gatherer(ctx).Gather()
+	if err != nil {
+		return err
+	}
+	body := encodeWriteRequest(timeSeries(mfs, w.labels), time.Now().UnixMilli())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(snappy.Encode(nil, body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "foldingathome_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// series is a sample of a time series, identified by its labels, including
+// __name__, sorted by name.
+type series struct {
+	labels []*dto.LabelPair
+	value  float64
+}
+
+// timeSeries flattens metric families into series the way a scrape would,
+// splitting summaries and histograms into their _sum, _count, quantile and
+// _bucket series, and adding labels to every series.
+func timeSeries(mfs []*dto.MetricFamily, labels prometheus.Labels) []series {
+	var ss []series
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			add := func(suffix string, value float64, extra ...string) {
+				ls := make([]*dto.LabelPair, 0, len(m.GetLabel())+len(labels)+2)
+				ls = append(ls, labelPair("__name__", name+suffix))
+				for _, l := range m.GetLabel() {
+					ls = append(ls, labelPair(l.GetName(), l.GetValue()))
+				}
+				for k, v := range labels {
+					ls = append(ls, labelPair(k, v))
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					ls = append(ls, labelPair(extra[i], extra[i+1]))
+				}
+				sort.Slice(ls, func(i, j int) bool { return ls[i].GetName() < ls[j].GetName() })
+				ss = append(ss, series{labels: ls, value: value})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return ss
+}
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series sampled at timestamp, in milliseconds,
+// as a prometheus.WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(ss []series, timestamp int64) []byte {
+	var b []byte
+	for _, s := range ss {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.GetName())
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.GetValue())
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sb)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
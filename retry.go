@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/gorilla/websocket"
+)
+
+// retry calls f until it succeeds, fails with an error that isn't transient,
+// or the retries of the client are used up. The delay between attempts starts
+// at RetryDelay and doubles with each retry, randomized by RetryJitter. No
+// retry is made that would start after ctx expires.
+func (e *Exporter) retry(ctx context.Context, f func() error) error {
+	delay := e.client.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > e.client.Retries || !transient(err) {
+			return err
+		}
+
+		d := jitter(delay, e.client.RetryJitter)
+		if t, ok := ctx.Deadline(); ok && time.Until(t) < d {
+			return err
+		}
+		level.Debug(e.logger).Log("msg", "Retrying after transient failure", "attempt", attempt, "delay", d, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+		delay *= 2
+	}
+}
+
+// jitter randomizes d by up to the given fraction in either direction.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
+
+// transient reports whether err is a failure of the connection that may not
+// recur, like a connection reset while the client uploads a work unit, rather
+// than a failure the client will keep answering with.
+func transient(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		websocket.IsCloseError(err, websocket.CloseAbnormalClosure)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrapeContext returns a context for serving a scrape, which expires offset
+// before Prometheus gives up on the scrape according to the
+// X-Prometheus-Scrape-Timeout-Seconds header.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// deadline returns the deadline for work starting now that must end within
+// timeout, if positive, and before ctx expires. The zero time means no
+// deadline.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	return t
+}
+
+// scrapeCollector collects an Exporter within the context of a scrape.
+type scrapeCollector struct {
+	ctx      context.Context
+	exporter *Exporter
+}
+
+// Describe implements prometheus.Collector.
+func (c scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collectContext(c.ctx, ch)
+}
+
+// writeMetrics writes the metrics gathered from g to w in the text format,
+// for the scrape command. Metrics gathered despite an error are written
+// before the error is returned.
+func writeMetrics(g prometheus.Gatherer, w io.Writer) error {
+	mfs, err := g.Gather()
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return err
+}
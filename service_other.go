@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+)
+
+// addServiceCommands adds no commands; the exporter only runs as a service
+// on Windows.
+func addServiceCommands(app *kingpin.Application) {}
+
+func serviceCommand(command string, logger log.Logger) bool {
+	return false
+}
+
+func runService(term chan<- os.Signal, logger log.Logger) func() {
+	return func() {}
+}
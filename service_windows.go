@@ -0,0 +1,163 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "foldingathome_exporter"
+
+var serviceInstallCmd, serviceUninstallCmd *kingpin.CmdClause
+
+// addServiceCommands adds the commands that install and uninstall the
+// Windows service.
+func addServiceCommands(app *kingpin.Application) {
+	serviceCmd := app.Command("service", "Manage the Windows service of the exporter.")
+	serviceInstallCmd = serviceCmd.Command("install", "Install the exporter as a Windows service, started automatically with the flags given to this command.")
+	serviceUninstallCmd = serviceCmd.Command("uninstall", "Remove the Windows service of the exporter.")
+}
+
+// serviceCommand runs command if it is one of the service commands, and
+// reports whether it was.
+func serviceCommand(command string, logger log.Logger) bool {
+	var err error
+	switch command {
+	case serviceInstallCmd.FullCommand():
+		err = installService(serviceArgs(os.Args[1:]))
+	case serviceUninstallCmd.FullCommand():
+		err = uninstallService()
+	default:
+		return false
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to "+command, "err", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// serviceArgs returns the arguments of the service install command without
+// the command itself, which are passed to the service when it is started.
+func serviceArgs(args []string) []string {
+	words := []string{"service", "install"}
+	serviceArgs := make([]string, 0, len(args))
+	for _, arg := range args {
+		if len(words) > 0 && arg == words[0] {
+			words = words[1:]
+			continue
+		}
+		serviceArgs = append(serviceArgs, arg)
+	}
+	return serviceArgs
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Folding@home Exporter",
+		Description: "Prometheus exporter for Folding@home clients.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart the exporter if it fails, like systemd's Restart=on-failure.
+	return s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+	return s.Delete()
+}
+
+// runService reports to the service control manager if the exporter was
+// started as a Windows service, and sends SIGTERM to term when the service is
+// stopped. The returned function must be called once the exporter has shut
+// down, and waits until the service is reported as stopped.
+func runService(term chan<- os.Signal, logger log.Logger) func() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to determine whether running as a Windows service", "err", err)
+	}
+	if !isService {
+		return func() {}
+	}
+
+	h := &serviceHandler{term: term, done: make(chan struct{})}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := svc.Run(serviceName, h); err != nil {
+			level.Error(logger).Log("msg", "Failed to run Windows service", "err", err)
+		}
+	}()
+	return func() {
+		close(h.done)
+		<-stopped
+	}
+}
+
+// serviceHandler handles the requests of the service control manager.
+type serviceHandler struct {
+	term chan<- os.Signal
+	done chan struct{}
+}
+
+// Execute implements svc.Handler.
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				select {
+				case h.term <- syscall.SIGTERM:
+				default:
+				}
+			}
+		case <-h.done:
+			return false, 0
+		}
+	}
+}
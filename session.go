@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// clientSession keeps a command session with a v7 FAHClient open across
+// scrapes, so that a scrape doesn't have to connect and authenticate first.
+// The session is dropped after any error and reestablished by the next scrape.
+type clientSession struct {
+	client ClientConfig
+
+	mtx    sync.Mutex
+	api    *fahclient.Client
+	closed bool
+}
+
+func newClientSession(client ClientConfig) *clientSession {
+	return &clientSession{client: client}
+}
+
+// get returns the session, connecting first if there is none. The session is
+// held exclusively until it is handed back with put.
+func (s *clientSession) get(ctx context.Context) (*fahclient.Client, error) {
+	s.mtx.Lock()
+
+	if s.api != nil && s.api.Stale() {
+		// The client closed the session while it was idle.
+		s.drop()
+	}
+	if s.api == nil {
+		api, err := dialFAHClient(ctx, s.client)
+		if err != nil {
+			s.mtx.Unlock()
+			return nil, err
+		}
+		if s.client.Password != "" {
+			if err := authenticate(api, s.client.Password); err != nil {
+				api.Close()
+				s.mtx.Unlock()
+				return nil, fmt.Errorf("authenticating: %w", err)
+			}
+		}
+		s.api = api
+	}
+
+	if err := s.api.SetDeadline(deadline(ctx, s.client.Timeout)); err != nil {
+		s.drop()
+		s.mtx.Unlock()
+		return nil, err
+	}
+	return s.api, nil
+}
+
+// put hands back the session after use, closing it unless it is still
+// healthy.
+func (s *clientSession) put(healthy bool) {
+	if !healthy || s.closed {
+		s.drop()
+	}
+	s.mtx.Unlock()
+}
+
+// close closes the session once it is no longer in use.
+func (s *clientSession) close() {
+	s.mtx.Lock()
+	s.closed = true
+	s.drop()
+	s.mtx.Unlock()
+}
+
+func (s *clientSession) drop() {
+	if s.api != nil {
+		s.api.Close()
+		s.api = nil
+	}
+}
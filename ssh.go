@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHConfig is an SSH server to reach a client through, for clients whose
+// command port is only bound to localhost. The address of the client is then
+// dialed from the SSH server, so it is usually localhost:36330.
+type SSHConfig struct {
+	// Address is the host of the SSH server, with an optional port that
+	// defaults to 22.
+	Address string `yaml:"address"`
+	User    string `yaml:"user"`
+	// KeyFile is the private key to authenticate with, which must not be
+	// protected by a passphrase.
+	KeyFile string `yaml:"key_file"`
+	// KnownHostsFile lists the keys of the server in the format of
+	// ~/.ssh/known_hosts. InsecureIgnoreHostKey accepts any key instead.
+	KnownHostsFile        string `yaml:"known_hosts_file"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+}
+
+func (c *SSHConfig) validate() error {
+	if c.Address == "" {
+		return errors.New("ssh: address is required")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		c.Address = net.JoinHostPort(strings.Trim(c.Address, "[]"), "22")
+	}
+	if err := validateAddress(c.Address); err != nil {
+		return fmt.Errorf("ssh: %w", err)
+	}
+	if c.User == "" {
+		return errors.New("ssh: user is required")
+	}
+	if c.KeyFile == "" {
+		return errors.New("ssh: key_file is required")
+	}
+	if c.KnownHostsFile == "" && !c.InsecureIgnoreHostKey {
+		return errors.New("ssh: known_hosts_file is required unless insecure_ignore_host_key is set")
+	}
+	_, err := c.clientConfig(0)
+	return err
+}
+
+// clientConfig reads the key files for connecting to the server.
+func (c SSHConfig) clientConfig(timeout time.Duration) (*ssh.ClientConfig, error) {
+	key, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: parsing %s: %w", c.KeyFile, err)
+	}
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if c.KnownHostsFile != "" {
+		hostKeyCallback, err = knownhosts.New(c.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: %w", err)
+		}
+	}
+	return &ssh.ClientConfig{
+		User:            c.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+// sshTunnels holds the connections to the SSH servers, which are shared by
+// the clients reached through the same server and kept across reloads.
+var sshTunnels = &sshTunnelSet{tunnels: map[SSHConfig]*sshTunnel{}}
+
+type sshTunnelSet struct {
+	mtx     sync.Mutex
+	tunnels map[SSHConfig]*sshTunnel
+}
+
+func (s *sshTunnelSet) get(config SSHConfig) *sshTunnel {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	t, ok := s.tunnels[config]
+	if !ok {
+		t = &sshTunnel{config: config}
+		s.tunnels[config] = t
+	}
+	return t
+}
+
+// sshTunnel is a connection to an SSH server, established on first use and
+// again after it was lost.
+type sshTunnel struct {
+	config SSHConfig
+
+	mtx    sync.Mutex
+	client *ssh.Client
+}
+
+// dial connects to address from the SSH server.
+func (t *sshTunnel) dial(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+	client, err := t.connect(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := client.DialContext(ctx, network, address)
+	var openErr *ssh.OpenChannelError
+	if err != nil && !errors.As(err, &openErr) {
+		// The server didn't answer, so the connection is likely lost.
+		t.mtx.Lock()
+		if t.client == client {
+			t.client.Close()
+			t.client = nil
+		}
+		t.mtx.Unlock()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s through SSH server %s: %w", address, t.config.Address, err)
+	}
+	return withDeadlines(conn), nil
+}
+
+// connect returns the connection to the server, connecting first if there is
+// none.
+func (t *sshTunnel) connect(ctx context.Context, timeout time.Duration) (*ssh.Client, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	config, err := t.config.clientConfig(timeout)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to SSH server: %w", err)
+	}
+	if err := conn.SetDeadline(deadline(ctx, timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.config.Address, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to SSH server: %w", err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	t.client = ssh.NewClient(c, chans, reqs)
+	return t.client, nil
+}
+
+// withDeadlines returns a connection forwarding to conn that supports
+// deadlines, which the connections tunneled through SSH don't.
+func withDeadlines(conn net.Conn) net.Conn {
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(conn, remote)
+		conn.Close()
+	}()
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	return local
+}
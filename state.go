@@ -0,0 +1,152 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// v7Commands are the commands run for a scrape of a v7 client, in order.
+var v7Commands = []string{"uptime", "date", "info", "options", "slot-info", "slot-options", "queue-info", "ppd"}
+
+// clientState is the state of a FAHClient fetched for a scrape, which the
+// collectors export. It implements collector.Client.
+type clientState struct {
+	uptime      time.Duration
+	date        string
+	info        [][]interface{}
+	options     fahclient.Options
+	slotInfo    []fahclient.SlotInfo
+	slotOptions map[string]fahclient.SlotOptions
+	queueInfo   []fahclient.SlotQueueInfo
+	ppd         float64
+	// errs holds the errors of the commands that failed, by command.
+	errs map[string]error
+	// durations holds how long the commands that were run took.
+	durations map[string]time.Duration
+	// broken is the transient error that broke the session, after which
+	// the remaining commands aren't run.
+	broken error
+}
+
+// run runs a command, recording how long it took and its error. Once a
+// command failed with a transient error, like a read timeout, the session is
+// out of step with the client, which may still answer the command, so the
+// remaining commands fail with that error without being run.
+func (s *clientState) run(command string, f func() error) {
+	if s.broken != nil {
+		s.fail(command, s.broken)
+		return
+	}
+	start := time.Now()
+	err := f()
+	if s.durations == nil {
+		s.durations = map[string]time.Duration{}
+	}
+	s.durations[command] = time.Since(start)
+	if err != nil && transient(err) {
+		s.broken = err
+	}
+	s.fail(command, err)
+}
+
+// fail records the error of a command, if any.
+func (s *clientState) fail(command string, err error) {
+	if err == nil {
+		return
+	}
+	if s.errs == nil {
+		s.errs = map[string]error{}
+	}
+	s.errs[command] = err
+}
+
+// err returns the error that broke the session, or else the error of the
+// first command that failed.
+func (s *clientState) err() error {
+	if s.broken != nil {
+		return s.broken
+	}
+	for _, command := range v7Commands {
+		if err := s.errs[command]; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *clientState) Uptime() (time.Duration, error) {
+	return s.uptime, s.errs["uptime"]
+}
+
+func (s *clientState) Date() (string, error) {
+	return s.date, s.errs["date"]
+}
+
+func (s *clientState) Info() ([][]interface{}, error) {
+	return s.info, s.errs["info"]
+}
+
+func (s *clientState) Options() (fahclient.Options, error) {
+	return s.options, s.errs["options"]
+}
+
+func (s *clientState) SlotInfo() ([]fahclient.SlotInfo, error) {
+	return s.slotInfo, s.errs["slot-info"]
+}
+
+func (s *clientState) SlotOptions() (map[string]fahclient.SlotOptions, error) {
+	return s.slotOptions, s.errs["slot-options"]
+}
+
+func (s *clientState) QueueInfo() ([]fahclient.SlotQueueInfo, error) {
+	return s.queueInfo, s.errs["queue-info"]
+}
+
+func (s *clientState) PPD() (float64, error) {
+	return s.ppd, s.errs["ppd"]
+}
+
+// queuePPD sums the estimated points per day of the work units, which is what
+// the ppd command reports, for clients the command is not run on.
+func queuePPD(queueInfo []fahclient.SlotQueueInfo) float64 {
+	var ppd float64
+	for _, q := range queueInfo {
+		ppd += float64(q.PPD)
+	}
+	return ppd
+}
+
+// filterSlots returns the state without the slots that aren't included, and
+// their work units. The estimated points per day are then those of the work
+// units of the remaining slots.
+func (s *clientState) filterSlots(include func(fahclient.SlotInfo) bool) *clientState {
+	filtered := *s
+	filtered.slotInfo = nil
+	excluded := map[string]bool{}
+	for _, slot := range s.slotInfo {
+		if include(slot) {
+			filtered.slotInfo = append(filtered.slotInfo, slot)
+		} else {
+			excluded[slot.ID] = true
+		}
+	}
+	if len(excluded) == 0 {
+		return s
+	}
+
+	filtered.slotOptions = map[string]fahclient.SlotOptions{}
+	for id, options := range s.slotOptions {
+		if !excluded[id] {
+			filtered.slotOptions[id] = options
+		}
+	}
+	filtered.queueInfo = nil
+	for _, q := range s.queueInfo {
+		if !excluded[q.Slot] {
+			filtered.queueInfo = append(filtered.queueInfo, q)
+		}
+	}
+	filtered.ppd = queuePPD(filtered.queueInfo)
+	return &filtered
+}
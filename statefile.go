@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+)
+
+// stateFile keeps the counters the exporter derives from the changes it sees
+// between scrapes, like the work units completed, in a file, so that they
+// survive restarts of the exporter instead of starting over at zero.
+type stateFile struct {
+	path     string
+	interval time.Duration
+	frames   *collector.FrameHistory
+	logger   log.Logger
+}
+
+func newStateFile(path string, interval time.Duration, frames *collector.FrameHistory, logger log.Logger) *stateFile {
+	return &stateFile{
+		path:     path,
+		interval: interval,
+		frames:   frames,
+		logger:   logger,
+	}
+}
+
+// load restores the counters from the file, if it exists.
+func (s *stateFile) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.frames.ReadState(f)
+}
+
+// save writes the counters to the file, replacing it only once they are
+// written completely.
+func (s *stateFile) save() error {
+	var buf bytes.Buffer
+	if err := s.frames.WriteState(&buf); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *stateFile) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.save(); err != nil {
+			level.Error(s.logger).Log("msg", "Failed to save state file", "path", s.path, "err", err)
+		}
+	}
+}
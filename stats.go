@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+)
+
+// statsRetryInterval is how long to wait before requesting a path again after
+// a request failed, unless the stats are refreshed more often than that.
+const statsRetryInterval = 5 * time.Minute
+
+// statsAPI queries the Folding@home stats API, which serves the points of
+// donors and teams as credited by the work servers. The API is rate-limited
+// and only updates hourly, so responses are refreshed in the background at the
+// refresh interval, whatever the scrape interval, and scrapes only read the
+// cached ones. They are optionally kept in a file to survive restarts, along
+// with the counters derived from them.
+type statsAPI struct {
+	url       string
+	client    *http.Client
+	interval  time.Duration
+	cacheFile string
+	logger    log.Logger
+	// onDemand fetches responses when they are read, for the scrape
+	// command, which exits before any refresh in the background.
+	onDemand bool
+	// wake tells run that a path was requested for the first time.
+	wake chan struct{}
+
+	mtx       sync.Mutex
+	responses map[string]*statsResponse
+	points    map[string]*pointsCounter
+}
+
+// statsCache is the content of the cache file.
+type statsCache struct {
+	Responses map[string]*statsResponse `json:"responses"`
+	Points    map[string]*pointsCounter `json:"points"`
+}
+
+// pointsCounter counts the points of a donor from the increases of their
+// score, so that the counter never goes down, even if the API briefly serves
+// a lower score. It starts at the first score seen.
+type pointsCounter struct {
+	Total float64 `json:"total"`
+	Score float64 `json:"score"`
+}
+
+// statsResponse is the last response to a request for a path, and when it was
+// made. Failed requests only update Checked and Err. Read is when a scrape
+// last read the response; responses no scrape read within the refresh
+// interval are no longer refreshed, like those of projects that left the
+// queues.
+type statsResponse struct {
+	Fetched time.Time       `json:"fetched"`
+	Body    json.RawMessage `json:"body"`
+	Checked time.Time       `json:"-"`
+	Err     error           `json:"-"`
+	Read    time.Time       `json:"-"`
+}
+
+func newStatsAPI(url string, timeout, interval time.Duration, cacheFile string, logger log.Logger) *statsAPI {
+	return &statsAPI{
+		url:       strings.TrimSuffix(url, "/"),
+		client:    &http.Client{Timeout: timeout},
+		interval:  interval,
+		cacheFile: cacheFile,
+		logger:    logger,
+		wake:      make(chan struct{}, 1),
+		responses: map[string]*statsResponse{},
+		points:    map[string]*pointsCounter{},
+	}
+}
+
+// load restores the cached responses and counters from the cache file, if it
+// exists.
+func (a *statsAPI) load() error {
+	if a.cacheFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(a.cacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cache := statsCache{
+		Responses: map[string]*statsResponse{},
+		Points:    map[string]*pointsCounter{},
+	}
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return fmt.Errorf("parsing %s: %w", a.cacheFile, err)
+	}
+	for _, r := range cache.Responses {
+		r.Checked = r.Fetched
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.responses = cache.Responses
+	a.points = cache.Points
+	return nil
+}
+
+// save writes the cached responses and counters to the cache file, replacing
+// it only once they are written completely. It must be called with mtx held.
+func (a *statsAPI) save() error {
+	b, err := json.Marshal(statsCache{Responses: a.responses, Points: a.points})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.cacheFile), filepath.Base(a.cacheFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.cacheFile)
+}
+
+// get decodes the last response served at path into v, without waiting for
+// the API. A path read for the first time, or again after it was no longer
+// refreshed, is requested in the background right away, and its response is
+// served from the next scrape on.
+func (a *statsAPI) get(path string, v interface{}) error {
+	if a.onDemand {
+		a.refresh(path)
+	}
+
+	a.mtx.Lock()
+	r := a.response(path)
+	if time.Since(r.Read) >= a.interval {
+		select {
+		case a.wake <- struct{}{}:
+		default:
+		}
+	}
+	r.Read = time.Now()
+	body, err := r.Body, r.Err
+	a.mtx.Unlock()
+
+	if body == nil {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("GET %s: no response yet", path)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("GET %s: %w", path, err)
+	}
+	return nil
+}
+
+// response returns the response for path, creating an empty one if it was
+// never requested. It must be called with mtx held.
+func (a *statsAPI) response(path string) *statsResponse {
+	r := a.responses[path]
+	if r == nil {
+		r = &statsResponse{}
+		a.responses[path] = r
+	}
+	return r
+}
+
+// due returns when the path of r is to be requested again: once per refresh
+// interval, or sooner after a failure. It must be called with mtx held.
+func (a *statsAPI) due(r *statsResponse) time.Time {
+	retry := a.interval
+	if r.Err != nil && retry > statsRetryInterval {
+		retry = statsRetryInterval
+	}
+	return r.Checked.Add(retry)
+}
+
+// refresh requests path from the API if it is due. While the API fails, the
+// last response is kept. mtx is not held while waiting for the API, so that
+// scrapes reading the cache don't wait for it.
+func (a *statsAPI) refresh(path string) {
+	a.mtx.Lock()
+	r := a.response(path)
+	now := time.Now()
+	if now.Before(a.due(r)) {
+		a.mtx.Unlock()
+		return
+	}
+	r.Checked = now
+	a.mtx.Unlock()
+
+	body, err := a.fetch(context.Background(), path)
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	r.Err = err
+	if err != nil && r.Body != nil {
+		level.Warn(a.logger).Log("msg", "Failed to refresh stats, using the cached ones", "path", path, "fetched", r.Fetched, "err", err)
+	} else if err == nil {
+		r.Fetched = now
+		r.Body = body
+		a.saveCache()
+	}
+}
+
+// run refreshes the responses read by scrapes within the last refresh
+// interval as they become due, for as long as the exporter runs.
+func (a *statsAPI) run() {
+	for {
+		a.mtx.Lock()
+		now := time.Now()
+		next := now.Add(a.interval)
+		var paths []string
+		for path, r := range a.responses {
+			if now.Sub(r.Read) >= a.interval {
+				continue
+			}
+			if due := a.due(r); !due.After(now) {
+				paths = append(paths, path)
+			} else if due.Before(next) {
+				next = due
+			}
+		}
+		a.mtx.Unlock()
+
+		if len(paths) > 0 {
+			for _, path := range paths {
+				a.refresh(path)
+			}
+			continue
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-a.wake:
+		}
+		timer.Stop()
+	}
+}
+
+// countPoints adds the increase of the score of a donor since the last call to
+// their points counter, and returns the counter.
+func (a *statsAPI) countPoints(user string, score float64) float64 {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	c := a.points[user]
+	if c == nil {
+		c = &pointsCounter{Total: score, Score: score}
+		a.points[user] = c
+		a.saveCache()
+	} else if score > c.Score {
+		c.Total += score - c.Score
+		c.Score = score
+		a.saveCache()
+	}
+	return c.Total
+}
+
+// saveCache saves the cache file, if any. It must be called with mtx held.
+func (a *statsAPI) saveCache() {
+	if a.cacheFile == "" {
+		return
+	}
+	if err := a.save(); err != nil {
+		level.Error(a.logger).Log("msg", "Failed to save stats cache", "path", a.cacheFile, "err", err)
+	}
+}
+
+// fetch returns the JSON served at path.
+func (a *statsAPI) fetch(ctx context.Context, path string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "foldingathome_exporter/"+version.Version)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("GET %s: %w", path, err)
+	}
+	return body, nil
+}
+
+// donorStats are the stats of a donor, as served at /user/<name>. Anonymous
+// donors have no rank.
+type donorStats struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+	WUs   float64 `json:"wus"`
+	Rank  *int    `json:"rank"`
+}
+
+// donorStatsCollector exports the stats of a donor from the stats API, so
+// that dashboards can show the official scoreboard next to the local
+// progress.
+type donorStatsCollector struct {
+	api    *statsAPI
+	user   string
+	logger log.Logger
+
+	points    *prometheus.Desc
+	workUnits *prometheus.Desc
+	rank      *prometheus.Desc
+}
+
+func newDonorStatsCollector(api *statsAPI, user string, logger log.Logger) *donorStatsCollector {
+	return &donorStatsCollector{
+		api:    api,
+		user:   user,
+		logger: logger,
+		points: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "donor", "points_total"),
+			"Points credited to the donor, according to the Folding@home stats API. Decreases of the score served by the API are ignored.",
+			[]string{"user"},
+			nil,
+		),
+		workUnits: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "donor", "work_units"),
+			"Number of work units credited to the donor, according to the Folding@home stats API.",
+			[]string{"user"},
+			nil,
+		),
+		rank: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "donor", "rank"),
+			"Rank of the donor by points among all donors, according to the Folding@home stats API.",
+			[]string{"user"},
+			nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *donorStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.points
+	ch <- c.workUnits
+	ch <- c.rank
+}
+
+// Collect implements prometheus.Collector.
+func (c *donorStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	var stats donorStats
+	if err := c.api.get("/user/"+url.PathEscape(c.user), &stats); err != nil {
+		level.Error(c.logger).Log("msg", "Failed to get donor stats", "user", c.user, "err", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.points, prometheus.CounterValue, c.api.countPoints(c.user, stats.Score), c.user)
+	ch <- prometheus.MustNewConstMetric(c.workUnits, prometheus.GaugeValue, stats.WUs, c.user)
+	if stats.Rank != nil {
+		ch <- prometheus.MustNewConstMetric(c.rank, prometheus.GaugeValue, float64(*stats.Rank), c.user)
+	}
+}
+
+// teamStats are the stats of a team, as served at /team/<number>.
+type teamStats struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+	WUs   float64 `json:"wus"`
+	Rank  *int    `json:"rank"`
+}
+
+// teamStatsCollector exports the stats of teams from the stats API, for team
+// captains running shared dashboards.
+type teamStatsCollector struct {
+	api    *statsAPI
+	teams  []int
+	logger log.Logger
+
+	info      *prometheus.Desc
+	points    *prometheus.Desc
+	workUnits *prometheus.Desc
+	rank      *prometheus.Desc
+	members   *prometheus.Desc
+}
+
+func newTeamStatsCollector(api *statsAPI, teams []int, logger log.Logger) *teamStatsCollector {
+	return &teamStatsCollector{
+		api:    api,
+		teams:  teams,
+		logger: logger,
+		info: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "team", "info"),
+			"The name of the team, with a constant value of 1.",
+			[]string{"team", "name"},
+			nil,
+		),
+		points: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "team", "points"),
+			"Points credited to the team, according to the Folding@home stats API.",
+			[]string{"team"},
+			nil,
+		),
+		workUnits: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "team", "work_units"),
+			"Number of work units credited to the team, according to the Folding@home stats API.",
+			[]string{"team"},
+			nil,
+		),
+		rank: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "team", "rank"),
+			"Rank of the team by points among all teams, according to the Folding@home stats API.",
+			[]string{"team"},
+			nil,
+		),
+		members: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "team", "members"),
+			"Number of donors who folded for the team, according to the Folding@home stats API.",
+			[]string{"team"},
+			nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *teamStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.points
+	ch <- c.workUnits
+	ch <- c.rank
+	ch <- c.members
+}
+
+// Collect implements prometheus.Collector.
+func (c *teamStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, team := range c.teams {
+		c.collectTeam(ch, team)
+	}
+}
+
+func (c *teamStatsCollector) collectTeam(ch chan<- prometheus.Metric, team int) {
+	id := strconv.Itoa(team)
+	var stats teamStats
+	if err := c.api.get("/team/"+id, &stats); err != nil {
+		level.Error(c.logger).Log("msg", "Failed to get team stats", "team", id, "err", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, id, stats.Name)
+	ch <- prometheus.MustNewConstMetric(c.points, prometheus.GaugeValue, stats.Score, id)
+	ch <- prometheus.MustNewConstMetric(c.workUnits, prometheus.GaugeValue, stats.WUs, id)
+	if stats.Rank != nil {
+		ch <- prometheus.MustNewConstMetric(c.rank, prometheus.GaugeValue, float64(*stats.Rank), id)
+	}
+
+	members, err := c.memberCount(id)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Failed to get team members", "team", id, "err", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.members, prometheus.GaugeValue, float64(members), id)
+}
+
+// memberCount returns the number of members of a team. They are served at
+// /team/<number>/members as rows of a table, the first of which holds the
+// names of the columns, like
+// [["name","id","rank","score","wus"],["someone",1234,567,89012,34]].
+func (c *teamStatsCollector) memberCount(id string) (int, error) {
+	var rows [][]interface{}
+	if err := c.api.get("/team/"+id+"/members", &rows); err != nil {
+		return 0, err
+	}
+	n := len(rows)
+	if n > 0 && len(rows[0]) > 0 && rows[0][0] == "name" {
+		n--
+	}
+	return n, nil
+}
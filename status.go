@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+var (
+	errBreakerOpen = errors.New("circuit breaker open")
+	errNoUpdates   = errors.New("no updates received from FAHClient yet")
+	errNotPolled   = errors.New("FAHClient not polled yet")
+	errPollStale   = errors.New("last poll of FAHClient is stale")
+	errUnreachable = errors.New("FAHClient could not be reached")
+)
+
+// clientStatus is the status of a FAHClient, the same data behind the
+// metrics, for consumers other than Prometheus.
+type clientStatus struct {
+	// Name is the name of the client in the configuration file, if any.
+	Name    string       `json:"name,omitempty"`
+	Up      bool         `json:"up"`
+	Version string       `json:"version,omitempty"`
+	Slots   []slotStatus `json:"slots,omitempty"`
+}
+
+// slotStatus is the status of a slot and the work units assigned to it.
+type slotStatus struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	// EstimatedPointsPerDay and PercentDone are those of the work unit the
+	// slot is running, if any.
+	EstimatedPointsPerDay int              `json:"estimated_points_per_day"`
+	PercentDone           float64          `json:"percent_done"`
+	WorkUnits             []workUnitStatus `json:"work_units,omitempty"`
+}
+
+// workUnitStatus is the status of a work unit in the queue of a client.
+type workUnitStatus struct {
+	// ID is the position of the work unit in the queue, which is reused once
+	// the work unit is done.
+	ID             string        `json:"id"`
+	State          string        `json:"state"`
+	Project        int           `json:"project"`
+	Run            int           `json:"run"`
+	Clone          int           `json:"clone"`
+	Gen            int           `json:"gen"`
+	PercentDone    float64       `json:"percent_done"`
+	CreditEstimate int           `json:"credit_estimate_points"`
+	ETA            time.Duration `json:"-"`
+	TimeRemaining  time.Duration `json:"-"`
+	// Error is the error FAHClient reported for the work unit, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the durations in seconds, like the metrics.
+func (wu workUnitStatus) MarshalJSON() ([]byte, error) {
+	type plain workUnitStatus
+	return json.Marshal(struct {
+		plain
+		ETASeconds           float64 `json:"eta_seconds"`
+		TimeRemainingSeconds float64 `json:"time_remaining_seconds"`
+	}{plain(wu), wu.ETA.Seconds(), wu.TimeRemaining.Seconds()})
+}
+
+// state returns the state of the FAHClient outside of a scrape, the same way
+// a scrape would, but without exporting any metrics: that of the last poll if
+// the client is polled in the background, or that of a scrape less than
+// MinInterval ago, and otherwise fetched once it is its turn among the
+// scrapes of the client.
+func (e *Exporter) state(ctx context.Context) (*clientState, error) {
+	if e.cache != nil {
+		return e.cachedState()
+	}
+	if e.client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.client.Timeout)
+		defer cancel()
+	}
+	if err := e.limiter.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("waiting for other scrapes of the FAHClient: %w", err)
+	}
+	defer e.limiter.release()
+
+	if e.client.MinInterval > 0 {
+		if state, ok := e.recentState(); ok {
+			if state == nil {
+				return nil, errUnreachable
+			}
+			return state, nil
+		}
+	}
+	if e.breaker != nil && !e.breaker.allow() {
+		return nil, errBreakerOpen
+	}
+	state, err := e.fetchState(ctx)
+	if e.breaker != nil {
+		e.breaker.record(state != nil || errors.Is(err, errNoUpdates))
+	}
+	return state, err
+}
+
+func (e *Exporter) fetchState(ctx context.Context) (*clientState, error) {
+	protocol, err := e.protocol(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if protocol == protocolLog {
+		state, err := e.logFile.clientState()
+		if err != nil {
+			return nil, err
+		}
+		return e.filterSlots(state), nil
+	}
+	if protocol == protocolV8 {
+		state, _, err := e.fetchV8(ctx)
+		if err != nil {
+			e.forgetProtocol()
+			return nil, err
+		}
+		return e.filterSlots(state.clientState(time.Now())), nil
+	}
+	if e.updates != nil {
+		state, ok := e.updates.state()
+		if !ok {
+			return nil, errNoUpdates
+		}
+		return e.filterSlots(state.clientState()), nil
+	}
+	state, err := e.fetchV7(ctx)
+	if state == nil {
+		e.forgetProtocol()
+		return nil, err
+	}
+	return e.filterSlots(state), nil
+}
+
+// status returns the status of the FAHClient. The status of a client that
+// could not be reached only tells so.
+func (e *Exporter) status(ctx context.Context, name string) (clientStatus, error) {
+	state, err := e.state(ctx)
+	if err != nil {
+		return clientStatus{Name: name}, err
+	}
+	return newClientStatus(name, state), nil
+}
+
+// newClientStatus returns the status of a client from its state. Failed
+// commands leave the corresponding parts of the status empty.
+func newClientStatus(name string, state *clientState) clientStatus {
+	status := clientStatus{Name: name, Up: true}
+	if info, err := state.Info(); err == nil {
+		status.Version, _ = fahclient.InfoValue(info, "FAHClient", "Version")
+	}
+
+	slotInfo, _ := state.SlotInfo()
+	queueInfo, _ := state.QueueInfo()
+	for _, sInfo := range slotInfo {
+		slot := slotStatus{
+			ID:          sInfo.ID,
+			Description: sInfo.Description,
+			Status:      strings.ToLower(sInfo.Status),
+		}
+		for _, qInfo := range queueInfo {
+			if qInfo.Slot != sInfo.ID {
+				continue
+			}
+			percentDone, _ := strconv.ParseFloat(strings.TrimSuffix(qInfo.PercentDone, "%"), 64)
+			wu := workUnitStatus{
+				ID:             qInfo.ID,
+				State:          strings.ToLower(qInfo.State),
+				Project:        qInfo.Project,
+				Run:            qInfo.Run,
+				Clone:          qInfo.Clone,
+				Gen:            qInfo.Gen,
+				PercentDone:    percentDone,
+				CreditEstimate: qInfo.CreditEstimate,
+				ETA:            qInfo.ETA,
+				TimeRemaining:  qInfo.TimeRemaining,
+			}
+			if qInfo.Error != "NO_ERROR" {
+				wu.Error = qInfo.Error
+			}
+			if wu.State == "running" || wu.State == "finishing" {
+				slot.EstimatedPointsPerDay = qInfo.PPD
+				slot.PercentDone = percentDone
+			}
+			slot.WorkUnits = append(slot.WorkUnits, wu)
+		}
+		status.Slots = append(status.Slots, slot)
+	}
+	return status
+}
+
+// statuses returns the status of the current clients, named after the client
+// label they are exported with, if any. Like for a scrape, the clients are
+// queried in parallel up to maxConcurrency at a time.
+func (r *clientRegistries) statuses(ctx context.Context) []clientStatus {
+	r.mtx.RLock()
+	targets := r.targets
+	r.mtx.RUnlock()
+
+	statuses := make([]clientStatus, len(targets))
+	errs := r.eachTarget(ctx, targets, func(i int, t scrapeTarget) error {
+		var err error
+		statuses[i], err = t.exporter.status(ctx, t.labels["client"])
+		return err
+	})
+	for i, t := range targets {
+		if errs[i] != nil {
+			statuses[i] = clientStatus{Name: t.labels["client"]}
+			level.Debug(t.exporter.logger).Log("msg", "Failed to get FAHClient status", "err", errs[i])
+		}
+	}
+	return statuses
+}
+
+// statusHandler serves the status of the current clients as JSON, for
+// dashboards and scripts that would rather not parse the metrics.
+func (r *clientRegistries) statusHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Clients []clientStatus `json:"clients"`
+	}{r.statuses(req.Context())}); err != nil {
+		level.Error(r.logger).Log("msg", "Failed to encode status", "err", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readSysfsString returns the trimmed contents of a sysfs attribute.
+func readSysfsString(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readSysfsInt returns the contents of a sysfs attribute parsed as an integer.
+func readSysfsInt(path string) (int64, error) {
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 0, 64)
+}
+
+// readFirstSysfsInt returns the value of the first readable attribute in
+// paths, which allows falling back between driver-specific locations.
+func readFirstSysfsInt(paths []string) (int64, error) {
+	err := os.ErrNotExist
+	for _, path := range paths {
+		var v int64
+		if v, err = readSysfsInt(path); err == nil {
+			return v, nil
+		}
+	}
+	return 0, err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// thermalGuard periodically checks the temperature of the GPUs assigned to GPU
+// slots, pauses a slot whose GPU exceeds the maximum temperature and unpauses
+// it again once the GPU has cooled down to the resume temperature. Only slots
+// paused by the guard are ever unpaused by it.
+//
+// The temperature is read from the hwmon sensors of the GPU's PCI device, so
+// the guard must run on the FAHClient host and only covers GPUs whose driver
+// exposes hwmon (e.g. amdgpu, i915, xe).
+type thermalGuard struct {
+	client            ClientConfig
+	sysfsPath         string
+	maxTemperature    float64
+	resumeTemperature float64
+	interval          time.Duration
+	logger            log.Logger
+
+	mtx    sync.Mutex
+	paused map[string]bool
+
+	activations *prometheus.CounterVec
+	slotPaused  *prometheus.GaugeVec
+}
+
+func newThermalGuard(client ClientConfig, sysfsPath string, maxTemperature, resumeTemperature float64, interval time.Duration, logger log.Logger) *thermalGuard {
+	return &thermalGuard{
+		client:            client,
+		sysfsPath:         sysfsPath,
+		maxTemperature:    maxTemperature,
+		resumeTemperature: resumeTemperature,
+		interval:          interval,
+		logger:            logger,
+		paused:            map[string]bool{},
+		activations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "thermal_guard",
+				Name:      "activations_total",
+				Help:      "Number of times the thermal guard paused a slot because its GPU exceeded the maximum temperature.",
+			},
+			[]string{"id", "slot_description"},
+		),
+		slotPaused: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: "thermal_guard",
+				Name:      "slot_paused",
+				Help:      "Whether the slot is currently held paused by the thermal guard.",
+			},
+			[]string{"id", "slot_description"},
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (g *thermalGuard) Describe(ch chan<- *prometheus.Desc) {
+	g.activations.Describe(ch)
+	g.slotPaused.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (g *thermalGuard) Collect(ch chan<- prometheus.Metric) {
+	g.activations.Collect(ch)
+	g.slotPaused.Collect(ch)
+}
+
+// run checks the slots every interval. It never returns.
+func (g *thermalGuard) run() {
+	level.Info(g.logger).Log("msg", "Starting thermal guard", "max_temperature", g.maxTemperature, "resume_temperature", g.resumeTemperature)
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		if err := g.check(); err != nil {
+			level.Error(g.logger).Log("msg", "Thermal guard check failed", "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (g *thermalGuard) check() error {
+	api, err := dialFAHClient(context.Background(), g.client)
+	if err != nil {
+		return err
+	}
+	defer api.Close()
+
+	info, err := api.Info()
+	if err != nil {
+		return err
+	}
+	slotInfo, err := api.SlotInfo()
+	if err != nil {
+		return err
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for _, slot := range slotInfo {
+		addr, ok := slotGPUAddress(info, slot.Description)
+		if !ok {
+			continue
+		}
+		temp, err := readGPUTemperature(filepath.Join(g.sysfsPath, "bus", "pci", "devices", addr))
+		if err != nil {
+			level.Debug(g.logger).Log("msg", "Failed to read GPU temperature", "slot", slot.ID, "device", addr, "err", err)
+			continue
+		}
+		id, err := strconv.Atoi(slot.ID)
+		if err != nil {
+			level.Error(g.logger).Log("msg", "Unexpected slot id", "slot", slot.ID, "err", err)
+			continue
+		}
+		// A stopping slot is already on its way to being paused.
+		status := strings.ToLower(slot.Status)
+		paused := status == "paused" || status == "stopping"
+
+		switch {
+		case temp >= g.maxTemperature && !paused:
+			level.Warn(g.logger).Log("msg", "GPU too hot, pausing slot", "slot", slot.ID, "temperature", temp)
+			if err := api.PauseSlot(id); err != nil {
+				level.Error(g.logger).Log("msg", "Failed to pause slot", "slot", slot.ID, "err", err)
+				continue
+			}
+			g.paused[slot.ID] = true
+			g.activations.WithLabelValues(slot.ID, slot.Description).Inc()
+		case temp <= g.resumeTemperature && g.paused[slot.ID]:
+			level.Info(g.logger).Log("msg", "GPU cooled down, unpausing slot", "slot", slot.ID, "temperature", temp)
+			if err := api.UnpauseSlot(id); err != nil {
+				level.Error(g.logger).Log("msg", "Failed to unpause slot", "slot", slot.ID, "err", err)
+				continue
+			}
+			delete(g.paused, slot.ID)
+		}
+
+		held := float64(0)
+		if g.paused[slot.ID] {
+			held = 1
+		}
+		g.slotPaused.WithLabelValues(slot.ID, slot.Description).Set(held)
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// clientUpdates keeps a session with a v7 FAHClient subscribed to the updates
+// it pushes, and caches the latest state so that scrapes are served without
+// issuing any commands. Uptime and date are only queried when the session is
+// established and extrapolated from then on.
+type clientUpdates struct {
+	client ClientConfig
+	logger log.Logger
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	done      chan struct{}
+
+	mtx       sync.Mutex
+	connected time.Time
+	uptime    time.Duration
+	date      time.Time
+	info      [][]interface{}
+	slotInfo  []fahclient.SlotInfo
+	queueInfo []fahclient.SlotQueueInfo
+}
+
+// updatesState is a snapshot of the cached state of a client.
+type updatesState struct {
+	uptime    time.Duration
+	date      time.Time
+	info      [][]interface{}
+	slotInfo  []fahclient.SlotInfo
+	queueInfo []fahclient.SlotQueueInfo
+}
+
+func newClientUpdates(client ClientConfig, logger log.Logger) *clientUpdates {
+	return &clientUpdates{
+		client: client,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+}
+
+// state returns the cached state, starting the subscription on first use. It
+// returns false until all subscribed commands have been received.
+func (u *clientUpdates) state() (updatesState, bool) {
+	u.startOnce.Do(func() {
+		go u.run()
+	})
+
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.connected.IsZero() || u.info == nil || u.slotInfo == nil || u.queueInfo == nil {
+		return updatesState{}, false
+	}
+	elapsed := time.Since(u.connected)
+	return updatesState{
+		uptime:    u.uptime + elapsed,
+		date:      u.date.Add(elapsed),
+		info:      u.info,
+		slotInfo:  u.slotInfo,
+		queueInfo: u.queueInfo,
+	}, true
+}
+
+// clientState returns the state for the collectors. The options of the client
+// and its slots are not pushed as updates.
+func (s updatesState) clientState() *clientState {
+	state := &clientState{
+		uptime:    s.uptime,
+		date:      s.date.Format(time.RFC3339),
+		info:      s.info,
+		slotInfo:  s.slotInfo,
+		queueInfo: s.queueInfo,
+		ppd:       queuePPD(s.queueInfo),
+	}
+	state.fail("options", collector.ErrNotSupported)
+	state.fail("slot-options", collector.ErrNotSupported)
+	return state
+}
+
+// stop ends the subscription.
+func (u *clientUpdates) stop() {
+	u.stopOnce.Do(func() {
+		close(u.done)
+	})
+}
+
+func (u *clientUpdates) run() {
+	for {
+		err := u.subscribe()
+
+		u.mtx.Lock()
+		u.connected = time.Time{}
+		u.info, u.slotInfo, u.queueInfo = nil, nil, nil
+		u.mtx.Unlock()
+
+		select {
+		case <-u.done:
+			return
+		default:
+		}
+		level.Error(u.logger).Log("msg", "Lost update session with FAHClient", "err", err)
+
+		select {
+		case <-u.done:
+			return
+		case <-time.After(u.client.UpdatesInterval):
+		}
+	}
+}
+
+// subscribe establishes a session and reads updates until it fails or the
+// subscription is stopped.
+func (u *clientUpdates) subscribe() error {
+	api, err := dialFAHClient(context.Background(), u.client)
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-u.done:
+		case <-closed:
+		}
+		api.Close()
+	}()
+
+	if u.client.Password != "" {
+		if err := authenticate(api, u.client.Password); err != nil {
+			return err
+		}
+	}
+	uptime, err := api.Uptime()
+	if err != nil {
+		return err
+	}
+	date, err := api.Eval("$(date)")
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return err
+	}
+	if err := api.Subscribe(u.client.UpdatesInterval); err != nil {
+		return err
+	}
+
+	u.mtx.Lock()
+	u.connected, u.uptime, u.date = time.Now(), uptime, t
+	u.mtx.Unlock()
+	level.Debug(u.logger).Log("msg", "Subscribed to FAHClient updates")
+
+	for {
+		// Updates are pushed at least every interval, so a longer silence
+		// means the session is dead.
+		if err := api.SetDeadline(time.Now().Add(3*u.client.UpdatesInterval + u.client.ReadTimeout)); err != nil {
+			return err
+		}
+		update, err := api.ReadUpdate()
+		if err != nil {
+			return err
+		}
+
+		u.mtx.Lock()
+		switch {
+		case update.Info != nil:
+			u.info = update.Info
+		case update.SlotInfo != nil:
+			u.slotInfo = update.SlotInfo
+		case update.QueueInfo != nil:
+			u.queueInfo = update.QueueInfo
+		}
+		u.mtx.Unlock()
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jtai/foldingathome_exporter/internal/collector"
+	"github.com/jtai/foldingathome_exporter/internal/fahclient"
+)
+
+// Folding@home v8 (fah-client) replaced the telnet command server with a
+// WebSocket API. On connect the client sends its complete state as a JSON
+// document, followed by incremental updates, so a scrape only needs to read
+// the first message.
+
+type v8State struct {
+	Info   v8Info             `json:"info"`
+	Config v8Config           `json:"config"`
+	Groups map[string]v8Group `json:"groups"`
+	Units  []v8Unit           `json:"units"`
+}
+
+type v8Info struct {
+	Version string           `json:"version"`
+	GPUs    map[string]v8GPU `json:"gpus"`
+}
+
+type v8GPU struct {
+	Description string `json:"description"`
+}
+
+type v8Group struct {
+	Config v8Config `json:"config"`
+}
+
+type v8Config struct {
+	CPUs   int                      `json:"cpus"`
+	GPUs   map[string]v8GPUSettings `json:"gpus"`
+	Paused bool                     `json:"paused"`
+	Finish bool                     `json:"finish"`
+	OnIdle bool                     `json:"on_idle"`
+	// User, Team, Passkey and Cause are only set in the configuration of
+	// the client, not in that of its resource groups.
+	User    string      `json:"user"`
+	Team    json.Number `json:"team"`
+	Passkey string      `json:"passkey"`
+	Cause   string      `json:"cause"`
+}
+
+type v8GPUSettings struct {
+	Enabled bool `json:"enabled"`
+}
+
+type v8Unit struct {
+	ID         string       `json:"id"`
+	Number     int          `json:"number"`
+	Group      string       `json:"group"`
+	State      string       `json:"state"`
+	Progress   float64      `json:"progress"`
+	PPD        float64      `json:"ppd"`
+	Credit     float64      `json:"credit"`
+	ETA        v8Duration   `json:"eta"`
+	Retries    int          `json:"retries"`
+	RetryTime  v8Duration   `json:"retry_time"`
+	Assignment v8Assignment `json:"assignment"`
+	WU         struct {
+		Run   int `json:"run"`
+		Clone int `json:"clone"`
+		Gen   int `json:"gen"`
+	} `json:"wu"`
+}
+
+type v8Assignment struct {
+	Project  int        `json:"project"`
+	WS       string     `json:"ws"`
+	Time     time.Time  `json:"time"`
+	Timeout  v8Duration `json:"timeout"`
+	Deadline v8Duration `json:"deadline"`
+	Credit   float64    `json:"credit"`
+	Core     struct {
+		Type string `json:"type"`
+	} `json:"core"`
+}
+
+// v8Duration is a duration given either as a number of seconds or as a FAH
+// duration string.
+type v8Duration time.Duration
+
+func (d *v8Duration) UnmarshalJSON(b []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err == nil {
+		*d = v8Duration(seconds * float64(time.Second))
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := fahclient.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = v8Duration(parsed)
+	return nil
+}
+
+// v8StateMap maps v8 unit states to the v7 queue states used by the metrics.
+var v8StateMap = map[string]string{
+	"ASSIGN":   "DOWNLOAD",
+	"DOWNLOAD": "DOWNLOAD",
+	"CORE":     "DOWNLOAD",
+	"RUN":      "RUNNING",
+	"FINISH":   "FINISHING",
+	"UPLOAD":   "SEND",
+	"CLEAN":    "DONE",
+	"DONE":     "DONE",
+	"DUMP":     "DUMP",
+	"WAIT":     "READY",
+	"PAUSE":    "PAUSED",
+}
+
+// fetchV8State connects to the WebSocket API of a v8 client and returns the
+// state it sends on connect.
+func fetchV8State(ctx context.Context, dial contextDialer, address string, dialTimeout, readTimeout time.Duration) (*v8State, error) {
+	conn, err := dialV8(ctx, dial, address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(deadline(ctx, readTimeout)); err != nil {
+		return nil, err
+	}
+	state := &v8State{}
+	if err := conn.ReadJSON(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// dialV8 opens a connection to the WebSocket API of a v8 client, connecting
+// with dial.
+func dialV8(ctx context.Context, dial contextDialer, address string, timeout time.Duration) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{NetDialContext: dial, HandshakeTimeout: timeout}
+	// The URL escapes the zone of IPv6 link-local addresses.
+	u := url.URL{Scheme: "ws", Host: address, Path: "/api/websocket"}
+	conn, _, err := dialer.DialContext(ctx, u.String(), nil)
+	return conn, err
+}
+
+// groups returns the resource groups of the client. Clients before v8.3 have
+// a single, unnamed group configured at the top level.
+func (s *v8State) groups() map[string]v8Group {
+	if len(s.Groups) > 0 {
+		return s.Groups
+	}
+	return map[string]v8Group{"": {Config: s.Config}}
+}
+
+// slotInfo maps each resource group to a v7 slot.
+func (s *v8State) slotInfo() []fahclient.SlotInfo {
+	groups := s.groups()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	slots := make([]fahclient.SlotInfo, 0, len(names))
+	for _, name := range names {
+		config := groups[name].Config
+
+		status := "READY"
+		for _, unit := range s.Units {
+			if unit.Group != name {
+				continue
+			}
+			switch v8StateMap[unit.State] {
+			case "RUNNING":
+				status = "RUNNING"
+			case "DOWNLOAD":
+				if status == "READY" {
+					status = "DOWNLOAD"
+				}
+			}
+		}
+		if config.Finish && status == "RUNNING" {
+			status = "FINISHING"
+		}
+		if config.Paused {
+			status = "PAUSED"
+		}
+
+		slots = append(slots, fahclient.SlotInfo{
+			ID:          v8SlotID(name),
+			Status:      status,
+			Description: s.slotDescription(config),
+			Idle:        config.OnIdle,
+		})
+	}
+	return slots
+}
+
+func (s *v8State) slotDescription(config v8Config) string {
+	var resources []string
+	if config.CPUs > 0 {
+		resources = append(resources, fmt.Sprintf("cpu:%d", config.CPUs))
+	}
+
+	ids := make([]string, 0, len(config.GPUs))
+	for id, gpu := range config.GPUs {
+		if gpu.Enabled {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		resources = append(resources, strings.TrimSuffix(id+":"+s.Info.GPUs[id].Description, ":"))
+	}
+
+	return strings.Join(resources, " ")
+}
+
+// slotOptions maps the configuration of the resource groups of the client to
+// the options of v7 slots. v8 clients have no client type.
+func (s *v8State) slotOptions() map[string]fahclient.SlotOptions {
+	options := map[string]fahclient.SlotOptions{}
+	for name, group := range s.groups() {
+		options[v8SlotID(name)] = fahclient.SlotOptions{
+			CPUs:   group.Config.CPUs,
+			Idle:   group.Config.OnIdle,
+			Paused: group.Config.Paused,
+		}
+	}
+	return options
+}
+
+// queueInfo maps the units of the client to v7 queue entries.
+func (s *v8State) queueInfo(now time.Time) []fahclient.SlotQueueInfo {
+	queue := make([]fahclient.SlotQueueInfo, 0, len(s.Units))
+	for _, unit := range s.Units {
+		state, ok := v8StateMap[unit.State]
+		if !ok {
+			state = unit.State
+		}
+
+		creditEstimate := unit.Credit
+		if creditEstimate == 0 {
+			creditEstimate = unit.Assignment.Credit
+		}
+
+		q := fahclient.SlotQueueInfo{
+			ID:             fmt.Sprintf("%02d", unit.Number),
+			Slot:           v8SlotID(unit.Group),
+			State:          state,
+			Project:        unit.Assignment.Project,
+			Run:            unit.WU.Run,
+			Clone:          unit.WU.Clone,
+			Gen:            unit.WU.Gen,
+			Core:           unit.Assignment.Core.Type,
+			WS:             unit.Assignment.WS,
+			PercentDone:    fmt.Sprintf("%.2f%%", unit.Progress*100),
+			PPD:            int(unit.PPD),
+			CreditEstimate: int(creditEstimate),
+			BaseCredit:     int(unit.Assignment.Credit),
+			ETA:            time.Duration(unit.ETA),
+			Attempts:       unit.Retries,
+			NextAttempt:    time.Duration(unit.RetryTime),
+			Assigned:       unit.Assignment.Time,
+		}
+		if !unit.Assignment.Time.IsZero() {
+			q.Timeout = unit.Assignment.Time.Add(time.Duration(unit.Assignment.Timeout))
+			q.Deadline = unit.Assignment.Time.Add(time.Duration(unit.Assignment.Deadline))
+			q.TimeRemaining = q.Deadline.Sub(now)
+		}
+		queue = append(queue, q)
+	}
+	return queue
+}
+
+// v8SlotID returns the slot id used in the metrics for a resource group.
+func v8SlotID(group string) string {
+	if group == "" {
+		return "default"
+	}
+	return group
+}
+
+// collectV8 collects the metrics of a v8 client from its WebSocket API and
+// returns the state they were collected from, or nil if the client could not
+// be reached.
+func (e *Exporter) collectV8(ctx context.Context, ch chan<- prometheus.Metric) *clientState {
+	state, duration, err := e.fetchV8(ctx)
+	if err != nil {
+		e.forgetProtocol()
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
+		level.Error(e.logger).Log("msg", "Failed to collect state from FAHClient", "err", err)
+		return nil
+	}
+
+	// The state sent on connect takes the place of the commands of v7.
+	ch <- prometheus.MustNewConstMetric(e.commandDuration, prometheus.GaugeValue, duration.Seconds(), "state")
+	return e.update(ctx, ch, state.clientState(time.Now()))
+}
+
+// fetchV8 fetches the state of a v8 client, retrying transient failures, and
+// returns how long the last attempt took.
+func (e *Exporter) fetchV8(ctx context.Context) (*v8State, time.Duration, error) {
+	var (
+		state    *v8State
+		duration time.Duration
+	)
+	err := e.retry(ctx, func() error {
+		var err error
+		start := time.Now()
+		state, err = fetchV8State(ctx, e.client.dialer(e.client.DialTimeout), e.client.Address, e.client.DialTimeout, e.client.ReadTimeout)
+		duration = time.Since(start)
+		if err != nil {
+			e.errorCounts.inc("state")
+		}
+		return err
+	})
+	return state, duration, err
+}
+
+// clientState maps the state of a v8 client to that of a v7 client. v8
+// clients report neither their uptime nor their time, and their info only
+// provides the version.
+func (s *v8State) clientState(now time.Time) *clientState {
+	state := &clientState{
+		options: fahclient.Options{
+			User:    s.Config.User,
+			Team:    s.Config.Team.String(),
+			Passkey: s.Config.Passkey,
+			Cause:   s.Config.Cause,
+		},
+		slotInfo:    s.slotInfo(),
+		slotOptions: s.slotOptions(),
+		queueInfo:   s.queueInfo(now),
+	}
+	state.ppd = queuePPD(state.queueInfo)
+	state.fail("uptime", collector.ErrNotSupported)
+	state.fail("date", collector.ErrNotSupported)
+	if s.Info.Version != "" {
+		state.info = [][]interface{}{{"FAHClient", []interface{}{"Version", s.Info.Version}}}
+	} else {
+		state.fail("info", collector.ErrNotSupported)
+	}
+	return state
+}
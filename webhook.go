@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Formats of webhook payloads.
+const (
+	webhookGeneric = "generic"
+	webhookSlack   = "slack"
+	webhookDiscord = "discord"
+)
+
+// alert is a problem of a client worth notifying about.
+type alert struct {
+	Kind     string `json:"alert"`
+	Client   string `json:"client,omitempty"`
+	Slot     string `json:"slot"`
+	WorkUnit string `json:"work_unit,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Kinds of alerts.
+const (
+	alertWorkUnitDumped = "work_unit_dumped"
+	alertSlotFailed     = "slot_failed"
+	alertDeadlineRisk   = "deadline_risk"
+)
+
+// webhookNotifier polls the status of the clients at an interval and calls a
+// webhook when a work unit is dumped, a slot fails, or a work unit is not
+// expected to finish before its deadline, for users who don't run
+// Alertmanager. Each alert is sent once, when the problem is first observed.
+type webhookNotifier struct {
+	url        string
+	format     string
+	interval   time.Duration
+	registries *clientRegistries
+	client     *http.Client
+	logger     log.Logger
+
+	// active holds the alerts observed in the last poll, by key.
+	active map[string]bool
+}
+
+func newWebhookNotifier(url, format string, interval time.Duration, registries *clientRegistries, logger log.Logger) *webhookNotifier {
+	return &webhookNotifier{
+		url:        url,
+		format:     format,
+		interval:   interval,
+		registries: registries,
+		client:     &http.Client{Timeout: interval},
+		logger:     logger,
+		active:     map[string]bool{},
+	}
+}
+
+func (n *webhookNotifier) run() {
+	level.Info(n.logger).Log("msg", "Sending alerts to webhook", "format", n.format, "interval", n.interval)
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	for {
+		n.check()
+		<-ticker.C
+	}
+}
+
+// check polls the clients once and notifies about the alerts that weren't
+// active in the last poll.
+func (n *webhookNotifier) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), n.interval)
+	statuses := n.registries.statuses(ctx)
+	cancel()
+
+	active := map[string]bool{}
+	for _, status := range statuses {
+		if !status.Up {
+			// Keep the alerts of clients that can't be reached, so that
+			// they aren't sent again once the client is back.
+			for key := range n.active {
+				if strings.HasPrefix(key, status.Name+"/") {
+					active[key] = true
+				}
+			}
+			continue
+		}
+		for key, a := range clientAlerts(status) {
+			active[key] = true
+			if n.active[key] {
+				continue
+			}
+			if err := n.send(a); err != nil {
+				level.Error(n.logger).Log("msg", "Failed to send alert to webhook", "alert", a.Kind, "err", err)
+				// Try again on the next poll.
+				delete(active, key)
+			}
+		}
+	}
+	n.active = active
+}
+
+// clientAlerts returns the alerts of a client by a key identifying the
+// problem.
+func clientAlerts(status clientStatus) map[string]alert {
+	client := ""
+	if status.Name != "" {
+		client = status.Name + ": "
+	}
+
+	alerts := map[string]alert{}
+	for _, slot := range status.Slots {
+		if slot.Status == "failed" {
+			alerts[status.Name+"/"+slot.ID] = alert{
+				Kind:    alertSlotFailed,
+				Client:  status.Name,
+				Slot:    slot.ID,
+				Message: fmt.Sprintf("%sSlot %s (%s) failed", client, slot.ID, slot.Description),
+			}
+		}
+		for _, wu := range slot.WorkUnits {
+			prcg := fmt.Sprintf("%d (%d, %d, %d)", wu.Project, wu.Run, wu.Clone, wu.Gen)
+			key := status.Name + "/" + slot.ID + "/" + wu.ID + "/" + prcg
+			switch {
+			case wu.State == "dump" || wu.Error != "":
+				reason := wu.Error
+				if reason == "" {
+					reason = "dumped"
+				}
+				alerts[key+"/dumped"] = alert{
+					Kind:     alertWorkUnitDumped,
+					Client:   status.Name,
+					Slot:     slot.ID,
+					WorkUnit: wu.ID,
+					Message:  fmt.Sprintf("%sWork unit %s in slot %s was dumped: %s", client, prcg, slot.ID, reason),
+				}
+			case wu.State == "running" && wu.TimeRemaining > 0 && wu.ETA > wu.TimeRemaining:
+				alerts[key+"/deadline"] = alert{
+					Kind:     alertDeadlineRisk,
+					Client:   status.Name,
+					Slot:     slot.ID,
+					WorkUnit: wu.ID,
+					Message:  fmt.Sprintf("%sWork unit %s in slot %s is expected to finish in %s, after its deadline in %s", client, prcg, slot.ID, wu.ETA, wu.TimeRemaining),
+				}
+			}
+		}
+	}
+	return alerts
+}
+
+// send posts an alert to the webhook in its format.
+func (n *webhookNotifier) send(a alert) error {
+	var payload interface{} = a
+	switch n.format {
+	case webhookSlack:
+		payload = map[string]string{"text": a.Message}
+	case webhookDiscord:
+		payload = map[string]string{"content": a.Message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// withoutMetricsGatherer leaves out the metrics whose names start with prefix,
+// like the foldingathome_work_unit_* metrics, which start new series for
+// every work unit, for those who only need the status and points per day of
+// the slots.
+type withoutMetricsGatherer struct {
+	prometheus.Gatherer
+	prefix string
+}
+
+func (g withoutMetricsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	kept := mfs[:0]
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), g.prefix) {
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/gorilla/websocket"
+)
+
+// wsUpgrader accepts connections from pages served by the exporter itself and
+// from the given origins, like those allowed by corsHandler, so that pages
+// elsewhere can't read the status through the browsers of those who can reach
+// the exporter. An origin of * allows any origin. Connections without an
+// origin don't come from a browser and are accepted.
+func wsUpgrader(origins []string) *websocket.Upgrader {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || allowed["*"] || allowed[origin] {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		},
+	}
+}
+
+// wsSnapshot is a message of the WebSocket stream.
+type wsSnapshot struct {
+	Time    time.Time      `json:"time"`
+	Clients []clientStatus `json:"clients"`
+}
+
+// wsHandler streams a JSON snapshot of the status of the clients, like the
+// one of /api/v1/status, over a WebSocket on each poll, to connections
+// accepted by upgrader.
+func (h *statusHub) wsHandler(upgrader *websocket.Upgrader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.serveWS(upgrader, w, r)
+	}
+}
+
+func (h *statusHub) serveWS(upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with the error.
+		level.Debug(h.logger).Log("msg", "WebSocket upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	ch, unsubscribe := h.subscribe()
+	defer unsubscribe()
+
+	// Messages from the client are discarded, but must be read to handle
+	// control messages and notice the client going away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-h.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return
+		case statuses := <-ch:
+			conn.SetWriteDeadline(time.Now().Add(h.interval))
+			if err := conn.WriteJSON(wsSnapshot{Time: time.Now(), Clients: statuses}); err != nil {
+				level.Debug(h.logger).Log("msg", "Failed to write to WebSocket", "err", err)
+				return
+			}
+		}
+	}
+}